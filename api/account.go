@@ -0,0 +1,129 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/orgs"
+	"github.com/maybemaby/oapibase/api/userdata"
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+// AccountDeletionGracePeriod is how long a deleted account can still be restored before it is purged
+var AccountDeletionGracePeriod = time.Hour * 24 * 30
+
+// ReauthWindow is how recent a login must be to delete an account without a password
+var ReauthWindow = time.Minute * 5
+
+type DeleteMeBody struct {
+	// Password is required for users with a password, others must have logged in within the last few minutes
+	Password string `json:"password,omitempty"`
+}
+
+type DeleteMeResponse struct {
+	DeleteAfter time.Time `json:"deleteAfter" required:"true"`
+}
+
+// UserExport documents the archive written by ExportAuthMe, data holds one key per registered section
+type UserExport struct {
+	UserId     int            `json:"userId" required:"true"`
+	ExportedAt time.Time      `json:"exportedAt" required:"true"`
+	Data       map[string]any `json:"data" required:"true"`
+}
+
+// DeleteAuthMe schedules the current user for deletion after re-authenticating them
+func (h *AuthHandler) DeleteAuthMe(w http.ResponseWriter, r *http.Request) {
+	var data DeleteMeBody
+	logger := RequestLogger(r)
+	sess, _ := auth.RequestUser(r)
+
+	if !decodeBody(w, r, &data, utils.DecodeOptions{AllowEmpty: true}) {
+		return
+	}
+
+	user, err := auth.GetUserById(r.Context(), sess.UserId, h.pool)
+
+	if err != nil {
+		logger.Error("Error getting user", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	if user.PasswordHash != nil {
+		if auth.CheckPasswordHash(data.Password, *user.PasswordHash) != nil {
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusUnauthorized, utils.CodeInvalidCredentials, "Invalid password"))
+			return
+		}
+	} else if sess.AuthTime.IsZero() || time.Since(sess.AuthTime) > ReauthWindow {
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusUnauthorized, utils.CodeReauthRequired, "Recent login required"))
+		return
+	}
+
+	// Organizations the user owns alone are deleted along with them, unless others are still members
+	soleOwned, err := orgs.SoleOwnedOrganizations(r.Context(), user.ID, h.pool)
+
+	if err != nil {
+		logger.Error("Error listing owned organizations", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	if len(soleOwned) > 0 {
+		slugs := []string{}
+
+		for _, org := range soleOwned {
+			slugs = append(slugs, org.Slug)
+		}
+
+		utils.WriteProblem(w, r, utils.Conflict(utils.CodeLastOwner,
+			"Transfer ownership of "+strings.Join(slugs, ", ")+" or remove their other members before deleting your account"))
+		return
+	}
+
+	deleteAfter := time.Now().Add(AccountDeletionGracePeriod)
+
+	if err := auth.ScheduleUserDeletion(r.Context(), user.ID, deleteAfter, h.pool); err != nil {
+		logger.Error("Error scheduling user deletion", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	logger.Info("User deletion scheduled", slog.Int("user_id", user.ID), slog.Time("delete_after", deleteAfter))
+
+	if err := utils.WriteResponse(w, r, http.StatusAccepted, DeleteMeResponse{DeleteAfter: deleteAfter}); err != nil {
+		logger.Error("Error encoding response", slog.Any("err", err))
+	}
+}
+
+// RestoreAuthMe cancels a pending deletion of the current user
+func (h *AuthHandler) RestoreAuthMe(w http.ResponseWriter, r *http.Request) {
+	logger := RequestLogger(r)
+	sess, _ := auth.RequestUser(r)
+
+	if err := auth.CancelUserDeletion(r.Context(), sess.UserId, h.pool); err != nil {
+		logger.Error("Error cancelling user deletion", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExportAuthMe streams every registered userdata section for the current user as a JSON download
+func (h *AuthHandler) ExportAuthMe(w http.ResponseWriter, r *http.Request) {
+	logger := RequestLogger(r)
+	sess, _ := auth.RequestUser(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"user-%d-export.json\"", sess.UserId))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := userdata.DefaultRegistry.WriteArchive(r.Context(), w, sess.UserId, h.pool); err != nil {
+		// Headers are already sent, all that's left is to cut the archive short
+		logger.Error("Error exporting user data", slog.Any("err", err))
+	}
+}
@@ -1,20 +1,27 @@
 package api
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/invites"
+	"github.com/maybemaby/oapibase/api/mail"
 	"github.com/maybemaby/oapibase/api/utils"
 )
 
 type AuthHandler struct {
 	jwtManager *auth.JwtManager
-	pool       *pgxpool.Pool
+	invites    *invites.Manager
+	mailer     mail.Mailer
+	// emailVerifyURL is the frontend page receiving email verification tokens in its "token" query parameter
+	emailVerifyURL string
+	pool           *pgxpool.Pool
 }
 
 type PassLoginBody struct {
@@ -23,9 +30,11 @@ type PassLoginBody struct {
 }
 
 type PassSignupBody struct {
-	Email     string `json:"email" example:"email@site.com"`
-	Password  string `json:"password" minLength:"8"`
-	Password2 string `json:"password2"`
+	Email     string `json:"email" format:"email" required:"true" example:"email@site.com"`
+	Password  string `json:"password" minLength:"8" maxLength:"72" required:"true"`
+	Password2 string `json:"password2" required:"true"`
+	// InviteToken is required when signups are invite only
+	InviteToken string `json:"inviteToken,omitempty"`
 }
 
 type LoginJwtResponse struct {
@@ -33,18 +42,31 @@ type LoginJwtResponse struct {
 	RefreshToken string `json:"refreshToken"`
 }
 
+// issueTokens encodes an access and refresh token pair for operations answering with new tokens
+func issueTokens(manager *auth.JwtManager, sessData auth.SessionData) (LoginJwtResponse, error) {
+	tok, err := manager.EncodeAccessToken(sessData)
+	refreshTok, refreshErr := manager.EncodeRefreshToken(sessData)
+
+	if err := errors.Join(err, refreshErr); err != nil {
+		return LoginJwtResponse{}, fmt.Errorf("encoding JWT tokens: %w", err)
+	}
+
+	return LoginJwtResponse{AccessToken: tok, RefreshToken: refreshTok}, nil
+}
+
 func (h *AuthHandler) SignupJWT(w http.ResponseWriter, r *http.Request) {
 	var data PassSignupBody
 	logger := RequestLogger(r)
 
 	// Decode the JSON request body into SignupData
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeBody(w, r, &data, utils.DecodeOptions{}) {
 		return
 	}
 
 	if data.Password != data.Password2 {
-		http.Error(w, "Passwords do not match", http.StatusBadRequest)
+		utils.WriteProblem(w, r, utils.BadRequest(utils.CodeValidationFailed, "Passwords do not match").WithErrors(
+			utils.FieldError{Field: "password2", Message: "must match password"},
+		))
 		return
 	}
 
@@ -52,28 +74,79 @@ func (h *AuthHandler) SignupJWT(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil && err != pgx.ErrNoRows {
 		logger.Error("Error during signup", "error", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServerError(w, r)
 		return
 	}
 
 	if user.ID != 0 {
 		// User already exists with this email
-		http.Error(w, "Invalid email or password", http.StatusBadRequest)
+		utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidCredentials, "Invalid email or password"))
+		return
+	}
+
+	var invite *invites.Invite
+
+	if data.InviteToken != "" {
+		inv, err := verifyInvite(r.Context(), h.invites, data.InviteToken, data.Email, h.pool)
+
+		if err != nil {
+			utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidInvite, "Invalid invite"))
+			return
+		}
+
+		invite = &inv
+	} else if !h.invites.SignupAllowed(data.Email) {
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusForbidden, utils.CodeInviteOnly, "Signup is invite only"))
 		return
 	}
 
+	// The user is only created along with accepting their invite, a failed signup leaves nothing behind
+	tx, err := h.pool.Begin(r.Context())
+
+	if err != nil {
+		logger.Error("Error during signup", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	defer tx.Rollback(r.Context())
+
 	// Add any other signup validation logic here
-	newUser, err := auth.CreateUser(r.Context(), data.Email, data.Password, h.pool)
+	newUser, err := auth.CreateUser(r.Context(), data.Email, data.Password, tx)
 
 	if err != nil {
 		slog.Error("Error during signup", "error", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServerError(w, r)
 		return
 	}
 
 	sessData := auth.SessionData{
-		UserId: newUser.ID,
-		Role:   "user",
+		UserId:   newUser.ID,
+		Role:     "user",
+		AuthTime: time.Now(),
+	}
+
+	if invite != nil {
+		accepted, err := invites.AcceptInvite(r.Context(), invite.ID, newUser.ID, tx)
+
+		if inviteUnusable(err) {
+			utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidInvite, "Invalid invite"))
+			return
+		}
+
+		if err != nil {
+			logger.Error("Error accepting invite", slog.Any("err", err), slog.Int("invite_id", invite.ID))
+			ServerError(w, r)
+			return
+		}
+
+		sessData = invitedSession(sessData, accepted)
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		logger.Error("Error during signup", slog.Any("err", err))
+		ServerError(w, r)
+		return
 	}
 
 	token, err := h.jwtManager.EncodeAccessToken(sessData)
@@ -81,22 +154,17 @@ func (h *AuthHandler) SignupJWT(w http.ResponseWriter, r *http.Request) {
 
 	if errors.Join(err, refreshErr) != nil {
 		logger.Error("Error encoding JWT tokens", slog.Any("err", err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServerError(w, r)
 		return
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-
 	response := LoginJwtResponse{
 		AccessToken:  token,
 		RefreshToken: refreshToken,
 	}
 
-	if err := json.NewEncoder(w).Encode(response); err != nil {
+	if err := utils.WriteResponse(w, r, http.StatusCreated, response); err != nil {
 		slog.Error("Error encoding response", "error", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
 	}
 }
 
@@ -105,34 +173,28 @@ func (h *AuthHandler) LoginJWT(w http.ResponseWriter, r *http.Request) {
 	logger := RequestLogger(r)
 
 	// Decode the JSON request body into LoginData
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeBody(w, r, &data, utils.DecodeOptions{}) {
 		return
 	}
 
 	user, err := auth.GetUserByEmail(r.Context(), data.Email, h.pool)
 
 	if err != nil {
-		utils.ErrorJSON(w, AuthErrorResponse{
-			Message: "Invalid email or password",
-			Status:  401,
-		}, 401)
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusUnauthorized, utils.CodeInvalidCredentials, "Invalid email or password"))
 		return
 	}
 
 	err = auth.CheckPasswordHash(data.Password, *user.PasswordHash)
 
 	if err != nil {
-		utils.ErrorJSON(w, AuthErrorResponse{
-			Message: "Invalid email or password",
-			Status:  401,
-		}, 401)
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusUnauthorized, utils.CodeInvalidCredentials, "Invalid email or password"))
 		return
 	}
 
 	sessData := auth.SessionData{
-		UserId: user.ID,
-		Role:   user.Role,
+		UserId:   user.ID,
+		Role:     user.Role,
+		AuthTime: time.Now(),
 	}
 
 	tok, err := h.jwtManager.EncodeAccessToken(sessData)
@@ -140,41 +202,16 @@ func (h *AuthHandler) LoginJWT(w http.ResponseWriter, r *http.Request) {
 
 	if errors.Join(err, refreshErr) != nil {
 		logger.Error("Error encoding JWT tokens", slog.Any("err", err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServerError(w, r)
 		return
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
 	response := LoginJwtResponse{
 		AccessToken:  tok,
 		RefreshToken: refreshTok,
 	}
 
-	if err := json.NewEncoder(w).Encode(response); err != nil {
+	if err := utils.WriteResponse(w, r, http.StatusOK, response); err != nil {
 		logger.Error("Error encoding response", slog.Any("err", err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-}
-
-type MeResponse struct {
-	Id int `json:"id"`
-}
-
-func (h *AuthHandler) GetAuthMe(w http.ResponseWriter, r *http.Request) {
-
-	res := MeResponse{}
-	sess, _ := auth.RequestUser(r)
-
-	res.Id = sess.UserId
-
-	err := utils.WriteJSON(w, r, res)
-
-	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
 	}
-
 }
@@ -96,12 +96,12 @@ func GetUserAccountByEmail(ctx context.Context, email string, provider string, p
 	var user User
 	var account AccountSelect
 
-	row := pool.QueryRow(ctx, `SELECT u.id, u.email, a.provider, a.provider_id
+	row := pool.QueryRow(ctx, `SELECT u.id, u.email, u.role, a.provider, a.provider_id
 	FROM users u
 	JOIN accounts a ON u.id = a.user_id
 	WHERE u.email = $1 AND a.provider = $2`, email, provider)
 
-	err := row.Scan(&user.ID, &user.Email, &account.Provider, &account.ProviderId)
+	err := row.Scan(&user.ID, &user.Email, &user.Role, &account.Provider, &account.ProviderId)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return &User{}, &AccountSelect{}, nil // No user found
@@ -122,9 +122,10 @@ func UserAccountStatus(user *User, account *AccountSelect) AccountStatus {
 	return AccountStatusLinked
 }
 
-func CreateUserAccount(ctx context.Context, user User, account AccountInsert, db *pgxpool.Pool) (User, error) {
+// CreateUserAccount creates the user along with their first linked account, profile is usually filled from the provider's claims
+func CreateUserAccount(ctx context.Context, user User, profile ProfileFields, account AccountInsert, db Conn) (User, error) {
 
-	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	tx, err := db.Begin(ctx)
 
 	if err != nil {
 		return User{}, err
@@ -132,7 +133,10 @@ func CreateUserAccount(ctx context.Context, user User, account AccountInsert, db
 
 	defer tx.Rollback(ctx)
 
-	row := tx.QueryRow(ctx, "INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id, created_at", user.Email, user.PasswordHash)
+	row := tx.QueryRow(ctx, `INSERT INTO users (email, password_hash, email_verified, name, given_name, family_name, picture, locale)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		user.Email, user.PasswordHash, user.EmailVerified,
+		profile.Name, profile.GivenName, profile.FamilyName, profile.Picture, profile.Locale)
 
 	var id int
 	var createdAt time.Time
@@ -157,10 +161,11 @@ func CreateUserAccount(ctx context.Context, user User, account AccountInsert, db
 	}
 
 	return User{
-		ID:           int(id),
-		Email:        user.Email,
-		PasswordHash: user.PasswordHash,
-		CreatedAt:    createdAt,
-		Role:         "user",
+		ID:            int(id),
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		PasswordHash:  user.PasswordHash,
+		CreatedAt:     createdAt,
+		Role:          "user",
 	}, nil
 }
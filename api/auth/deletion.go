@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/maybemaby/oapibase/api/userdata"
+)
+
+func init() {
+	userdata.Register("user", func(ctx context.Context, userId int, db *pgxpool.Pool) (any, error) {
+		return GetProfile(ctx, userId, db)
+	})
+
+	userdata.Register("accounts", exportAccounts)
+}
+
+// AccountExport is the exported view of a linked account, provider tokens are secrets and left out
+type AccountExport struct {
+	Provider   string    `json:"provider"`
+	ProviderId string    `json:"providerId"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func exportAccounts(ctx context.Context, userId int, db *pgxpool.Pool) (any, error) {
+	rows, err := db.Query(ctx, "SELECT provider, provider_id, created_at FROM accounts WHERE user_id = $1 ORDER BY id", userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	accounts := []AccountExport{}
+
+	for rows.Next() {
+		var account AccountExport
+
+		if err := rows.Scan(&account.Provider, &account.ProviderId, &account.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	return accounts, rows.Err()
+}
+
+// ScheduleUserDeletion marks the user for deletion once deleteAfter has passed
+func ScheduleUserDeletion(ctx context.Context, userId int, deleteAfter time.Time, db *pgxpool.Pool) error {
+	tag, err := db.Exec(ctx, "UPDATE users SET delete_after = $1 WHERE id = $2", deleteAfter, userId)
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
+
+// CancelUserDeletion clears a pending deletion, it is a no-op when none is scheduled
+func CancelUserDeletion(ctx context.Context, userId int, db *pgxpool.Pool) error {
+	_, err := db.Exec(ctx, "UPDATE users SET delete_after = NULL WHERE id = $1", userId)
+	return err
+}
+
+// PurgeDeletedUsers deletes users whose grace period has ended.
+// Accounts and memberships are removed through ON DELETE CASCADE. Organizations left without members are
+// deleted, and those left without an owner get one among the remaining members, admins first
+func PurgeDeletedUsers(ctx context.Context, db *pgxpool.Pool) (int64, error) {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	// CURRENT_TIMESTAMP is the start of the transaction, every statement sees the same users as purged
+	_, err = tx.Exec(ctx, `DELETE FROM organizations o
+	WHERE EXISTS (SELECT 1 FROM memberships m JOIN users u ON u.id = m.user_id
+		WHERE m.organization_id = o.id AND u.delete_after <= CURRENT_TIMESTAMP)
+	AND NOT EXISTS (SELECT 1 FROM memberships m JOIN users u ON u.id = m.user_id
+		WHERE m.organization_id = o.id AND (u.delete_after IS NULL OR u.delete_after > CURRENT_TIMESTAMP))`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE memberships SET role = 'owner'
+	WHERE (organization_id, user_id) IN (
+		SELECT DISTINCT ON (m.organization_id) m.organization_id, m.user_id
+		FROM memberships m JOIN users u ON u.id = m.user_id
+		WHERE (u.delete_after IS NULL OR u.delete_after > CURRENT_TIMESTAMP)
+		AND EXISTS (SELECT 1 FROM memberships o JOIN users ou ON ou.id = o.user_id
+			WHERE o.organization_id = m.organization_id AND o.role = 'owner' AND ou.delete_after <= CURRENT_TIMESTAMP)
+		AND NOT EXISTS (SELECT 1 FROM memberships o JOIN users ou ON ou.id = o.user_id
+			WHERE o.organization_id = m.organization_id AND o.role = 'owner' AND (ou.delete_after IS NULL OR ou.delete_after > CURRENT_TIMESTAMP))
+		ORDER BY m.organization_id, m.role = 'admin' DESC, m.created_at, m.user_id
+	)`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	tag, err := tx.Exec(ctx, "DELETE FROM users WHERE delete_after IS NOT NULL AND delete_after <= CURRENT_TIMESTAMP")
+
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
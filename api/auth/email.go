@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// EmailTokenLifetime is how long an email verification link stays valid
+var EmailTokenLifetime = time.Hour * 24
+
+type EmailTokenClaims struct {
+	UserId int    `json:"user_id"`
+	Email  string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// emailTokenSecret derives a key from the access token secret,
+// so verification tokens can never pass as access tokens
+func (m *JwtManager) emailTokenSecret() []byte {
+	mac := hmac.New(sha256.New, m.AccessTokenSecret)
+	mac.Write([]byte("email-verification"))
+	return mac.Sum(nil)
+}
+
+// EncodeEmailToken signs a token proving userId controls email
+func (m *JwtManager) EncodeEmailToken(userId int, email string) (string, error) {
+	claims := EmailTokenClaims{
+		UserId: userId,
+		Email:  email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(EmailTokenLifetime)),
+			Subject:   strconv.Itoa(userId),
+			Issuer:    "go-auth-snippets",
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	return token.SignedString(m.emailTokenSecret())
+}
+
+func (m *JwtManager) ValidateEmailToken(tokenString string) (*EmailTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &EmailTokenClaims{}, func(token *jwt.Token) (any, error) {
+		return m.emailTokenSecret(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+
+	if err != nil || !token.Valid {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*EmailTokenClaims)
+
+	if !ok {
+		return nil, jwt.ErrTokenMalformed
+	}
+
+	return claims, nil
+}
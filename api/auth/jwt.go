@@ -2,25 +2,30 @@ package auth
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/maybemaby/oapibase/api/utils"
 )
 
 type AccessTokenClaims struct {
-	UserId int    `json:"user_id"`
-	Role   string `json:"role"`
+	UserId   int              `json:"user_id"`
+	Role     string           `json:"role"`
+	OrgId    int              `json:"org_id,omitempty"`
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type RefreshTokenClaims struct {
-	UserId int    `json:"user_id"`
-	Role   string `json:"role"`
+	UserId   int              `json:"user_id"`
+	Role     string           `json:"role"`
+	OrgId    int              `json:"org_id,omitempty"`
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -31,11 +36,23 @@ type JwtManager struct {
 	RefreshTokenLifetime time.Duration
 }
 
+// authTime is the auth_time claim of data, left out when the session has none
+func authTime(data SessionData) *jwt.NumericDate {
+	if data.AuthTime.IsZero() {
+		return nil
+	}
+
+	return jwt.NewNumericDate(data.AuthTime)
+}
+
 func (m *JwtManager) EncodeAccessToken(data SessionData) (string, error) {
 	claims := AccessTokenClaims{
-		UserId: data.UserId,
-		Role:   data.Role,
+		UserId:   data.UserId,
+		Role:     data.Role,
+		OrgId:    data.OrgId,
+		AuthTime: authTime(data),
 		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(m.AccessTokenLifetime)),
 			Subject:   strconv.Itoa(data.UserId),
 			Issuer:    "go-auth-snippets",
@@ -73,43 +90,83 @@ func RequireAccessToken(manager *JwtManager) func(http.Handler) http.Handler {
 			parts := strings.Split(token, " ")
 
 			if len(parts) < 2 || parts[1] == "" {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				utils.WriteProblem(w, r, utils.Unauthorized())
 				return
 			}
 
 			claims, err := manager.ValidateAccessToken(parts[1])
 
 			if err != nil {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				utils.WriteProblem(w, r, utils.Unauthorized())
 				return
 			}
 
-			// Store the user ID and role in the context
+			// Store the user ID, role and active org in the context
 			ctx := context.WithValue(r.Context(), SessionUserIdKey, claims.UserId)
 			ctx = context.WithValue(ctx, SessionRoleKey, claims.Role)
+			ctx = context.WithValue(ctx, SessionOrgIdKey, claims.OrgId)
+
+			if claims.AuthTime != nil {
+				ctx = context.WithValue(ctx, SessionAuthTimeKey, claims.AuthTime.Time)
+			}
+
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
 func RequestUser(r *http.Request) (SessionData, error) {
-	userId := r.Context().Value(SessionUserIdKey)
-	role := r.Context().Value(SessionRoleKey)
+	return ContextUser(r.Context())
+}
+
+// ContextUser is RequestUser for code that only has the request context
+func ContextUser(ctx context.Context) (SessionData, error) {
+	userId := ctx.Value(SessionUserIdKey)
+	role := ctx.Value(SessionRoleKey)
 
 	if userId == nil || role == nil {
 		return SessionData{}, errors.New("unauthorized")
 	}
 
+	orgId, _ := ctx.Value(SessionOrgIdKey).(int)
+	authTime, _ := ctx.Value(SessionAuthTimeKey).(time.Time)
+
 	return SessionData{
-		UserId: userId.(int),
-		Role:   role.(string),
+		UserId:   userId.(int),
+		Role:     role.(string),
+		OrgId:    orgId,
+		AuthTime: authTime,
 	}, nil
 }
 
+// RequireRole rejects sessions whose global role is not one of roles.
+// Must run after RequireAccessToken
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sess, err := RequestUser(r)
+
+			if err != nil {
+				utils.WriteProblem(w, r, utils.Unauthorized())
+				return
+			}
+
+			if !slices.Contains(roles, sess.Role) {
+				utils.WriteProblem(w, r, utils.Forbidden())
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func (m *JwtManager) EncodeRefreshToken(data SessionData) (string, error) {
 	claims := RefreshTokenClaims{
-		UserId: data.UserId,
-		Role:   data.Role,
+		UserId:   data.UserId,
+		Role:     data.Role,
+		OrgId:    data.OrgId,
+		AuthTime: authTime(data),
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(m.RefreshTokenLifetime)),
 			Subject:   strconv.Itoa(data.UserId),
@@ -151,43 +208,41 @@ func RefreshTokenHandler(manager *JwtManager) http.Handler {
 		parts := strings.Split(token, " ")
 
 		if len(parts) < 2 || parts[1] == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			utils.WriteProblem(w, r, utils.Unauthorized())
 			return
 		}
 
 		claims, err := manager.ValidateRefreshToken(parts[1])
 
 		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			utils.WriteProblem(w, r, utils.Unauthorized())
 			return
 		}
 
-		newAccessToken, err := manager.EncodeAccessToken(SessionData{
+		// Refreshing isn't logging in, the new tokens keep the original auth_time
+		sessData := SessionData{
 			UserId: claims.UserId,
 			Role:   claims.Role,
-		})
+			OrgId:  claims.OrgId,
+		}
 
-		newRefreshToken, refreshErr := manager.EncodeRefreshToken(SessionData{
-			UserId: claims.UserId,
-			Role:   claims.Role,
-		})
+		if claims.AuthTime != nil {
+			sessData.AuthTime = claims.AuthTime.Time
+		}
+
+		newAccessToken, err := manager.EncodeAccessToken(sessData)
+		newRefreshToken, refreshErr := manager.EncodeRefreshToken(sessData)
 
 		if errors.Join(err, refreshErr) != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusInternalServerError, utils.CodeInternal, ""))
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-
 		response := RefreshTokenResponse{
 			AccessToken:  newAccessToken,
 			RefreshToken: newRefreshToken,
 		}
 
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+		_ = utils.WriteResponse(w, r, http.StatusOK, response)
 	})
 }
@@ -119,3 +119,31 @@ func TestRefreshHandler(t *testing.T) {
 		t.Errorf("Expected new refresh token, got the same as input %s", validRefreshToken)
 	}
 }
+
+func TestRefreshKeepsAuthTime(t *testing.T) {
+	manager := bootstrapManager()
+	loggedInAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	refreshToken, _ := manager.EncodeRefreshToken(auth.SessionData{
+		UserId:   1,
+		Role:     "user",
+		AuthTime: loggedInAt,
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshToken)
+
+	auth.RefreshTokenHandler(manager).ServeHTTP(rec, req)
+
+	var response auth.RefreshTokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	claims, err := manager.ValidateAccessToken(response.AccessToken)
+
+	if err != nil || claims.AuthTime == nil || !claims.AuthTime.Equal(loggedInAt) {
+		t.Errorf("Expected the refreshed token to keep auth_time %v, got %+v, %v", loggedInAt, claims, err)
+	}
+}
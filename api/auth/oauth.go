@@ -15,6 +15,7 @@ import (
 
 const OAUTH_STATE_SESSION_KEY = "oauth_state"
 const OAUTH_VERIFIER_SESSION_KEY = "oauth_verifier"
+const OAUTH_INVITE_SESSION_KEY = "oauth_invite"
 
 var ErrStateMismatch = errors.New("state mismatch")
 
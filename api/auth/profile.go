@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ProfileFields holds the user details that can be filled from OIDC claims or edited by the user
+type ProfileFields struct {
+	Name       *string `json:"name"`
+	GivenName  *string `json:"givenName"`
+	FamilyName *string `json:"familyName"`
+	Picture    *string `json:"picture"`
+	Locale     *string `json:"locale"`
+}
+
+type Profile struct {
+	ID            int     `json:"id" required:"true"`
+	Email         *string `json:"email"`
+	EmailVerified bool    `json:"emailVerified" required:"true"`
+	// PendingEmail is the new email awaiting verification
+	PendingEmail *string `json:"pendingEmail"`
+	Role         string  `json:"role" required:"true"`
+	ProfileFields
+	// Providers lists the linked OAuth providers
+	Providers   []string   `json:"providers" required:"true"`
+	CreatedAt   time.Time  `json:"createdAt" required:"true"`
+	DeleteAfter *time.Time `json:"deleteAfter,omitempty"`
+}
+
+// profileColumns maps the editable ProfileFields json names to their columns
+var profileColumns = map[string]string{
+	"name":       "name",
+	"givenName":  "given_name",
+	"familyName": "family_name",
+	"picture":    "picture",
+	"locale":     "locale",
+}
+
+func IsProfileField(field string) bool {
+	_, ok := profileColumns[field]
+	return ok
+}
+
+func GetProfile(ctx context.Context, userId int, db *pgxpool.Pool) (Profile, error) {
+	var p Profile
+
+	err := db.QueryRow(ctx, `SELECT u.id, u.email, u.email_verified, u.pending_email, u.role,
+	u.name, u.given_name, u.family_name, u.picture, u.locale, u.created_at, u.delete_after,
+	COALESCE(array_agg(a.provider ORDER BY a.provider) FILTER (WHERE a.provider IS NOT NULL), '{}')
+	FROM users u
+	LEFT JOIN accounts a ON a.user_id = u.id
+	WHERE u.id = $1
+	GROUP BY u.id`, userId).Scan(&p.ID, &p.Email, &p.EmailVerified, &p.PendingEmail, &p.Role,
+		&p.Name, &p.GivenName, &p.FamilyName, &p.Picture, &p.Locale, &p.CreatedAt, &p.DeleteAfter, &p.Providers)
+
+	if err != nil {
+		return Profile{}, err
+	}
+
+	return p, nil
+}
+
+// UpdateProfile sets the given profile fields, keyed by json name. A nil value clears the field
+func UpdateProfile(ctx context.Context, userId int, changes map[string]*string, db Conn) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	fields := make([]string, 0, len(changes))
+
+	for field := range changes {
+		if !IsProfileField(field) {
+			return fmt.Errorf("unknown profile field %q", field)
+		}
+		fields = append(fields, field)
+	}
+
+	// Stable ordering keeps the statement cacheable
+	slices.Sort(fields)
+
+	sets := make([]string, len(fields))
+	args := []any{userId}
+
+	for i, field := range fields {
+		args = append(args, changes[field])
+		sets[i] = fmt.Sprintf("%s = $%d", profileColumns[field], len(args))
+	}
+
+	tag, err := db.Exec(ctx, "UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = $1", args...)
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
+
+// SetPendingEmail stores an email change until it is verified with ConfirmPendingEmail, nil cancels the change
+func SetPendingEmail(ctx context.Context, userId int, email *string, db Conn) error {
+	_, err := db.Exec(ctx, "UPDATE users SET pending_email = $1 WHERE id = $2", email, userId)
+	return err
+}
+
+// ConfirmPendingEmail swaps in the pending email if it still matches email, returns pgx.ErrNoRows otherwise
+func ConfirmPendingEmail(ctx context.Context, userId int, email string, db *pgxpool.Pool) error {
+	tag, err := db.Exec(ctx, `UPDATE users SET email = pending_email, pending_email = NULL, email_verified = TRUE
+	WHERE id = $1 AND pending_email = $2`, userId, email)
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
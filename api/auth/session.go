@@ -1,12 +1,23 @@
 package auth
 
+import "time"
+
 type SessionUserIdContextKey string
 type SessionRoleContextKey string
+type SessionOrgIdContextKey string
+type SessionAuthTimeContextKey string
 
 var SessionUserIdKey SessionUserIdContextKey = "userid"
 var SessionRoleKey SessionRoleContextKey = "role"
+var SessionOrgIdKey SessionOrgIdContextKey = "orgid"
+var SessionAuthTimeKey SessionAuthTimeContextKey = "authtime"
 
 type SessionData struct {
 	UserId int
 	Role   string
+	// OrgId is the active organization of the session, 0 when none is selected
+	OrgId int
+	// AuthTime is when the user last proved their identity by logging in. Refreshed and reissued
+	// tokens carry it unchanged, it is zero for tokens issued without the claim
+	AuthTime time.Time
 }
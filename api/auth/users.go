@@ -4,17 +4,28 @@ import (
 	"context"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
-	ID           int       `json:"id"`
-	Email        *string   `json:"email"`
-	Role         string    `json:"role"`
-	PasswordHash *string   `json:"-"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID    int     `json:"id"`
+	Email *string `json:"email"`
+	Role  string  `json:"role"`
+	// EmailVerified is set when the email was confirmed by a link or an identity provider
+	EmailVerified bool      `json:"email_verified"`
+	PasswordHash  *string   `json:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+	// DeleteAfter is set while the user is pending deletion
+	DeleteAfter *time.Time `json:"delete_after,omitempty"`
 }
 
 func HashPassword(password string) (string, error) {
@@ -42,7 +53,27 @@ func GetUserByEmail(ctx context.Context, email string, db *pgxpool.Pool) (User,
 	return user, nil
 }
 
-func CreateUser(ctx context.Context, email, password string, db *pgxpool.Pool) (User, error) {
+func GetUserById(ctx context.Context, id int, db *pgxpool.Pool) (User, error) {
+	var user User
+
+	err := db.QueryRow(ctx, "SELECT id, email, email_verified, password_hash, role, created_at, delete_after FROM users WHERE id = $1", id).Scan(&user.ID, &user.Email, &user.EmailVerified, &user.PasswordHash, &user.Role, &user.CreatedAt, &user.DeleteAfter)
+
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// Conn is what functions writing users go through, a *pgxpool.Pool or a pgx.Tx to join the caller's
+// transaction. Functions needing a transaction of their own Begin one, a savepoint within a pgx.Tx
+type Conn interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func CreateUser(ctx context.Context, email, password string, db Conn) (User, error) {
 	tracer := otel.Tracer("auth")
 	spanCtx, span := tracer.Start(ctx, "CreateUser")
 	defer span.End()
@@ -0,0 +1,376 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/justinas/alice"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+	EncodingGzip   = "gzip"
+)
+
+// CompressOptions configures CompressMiddleware
+type CompressOptions struct {
+	// Encodings in order of preference, used to break ties between equal q-values. Defaults to br, zstd, gzip
+	Encodings []string
+	// MinSize is the smallest body worth compressing, defaults to 1KiB. Flushed responses are always compressed
+	MinSize int
+}
+
+// incompressibleTypes are already compressed, compressing them again only costs CPU.
+// Entries ending in "/" match a whole top level type
+var incompressibleTypes = []string{
+	"image/", "audio/", "video/", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-brotli", "application/x-7z-compressed", "application/x-rar-compressed",
+	"application/pdf", "application/octet-stream",
+}
+
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+	Flush() error
+}
+
+var encoderPools = map[string]*sync.Pool{
+	EncodingBrotli: {New: func() any { return brotli.NewWriterLevel(nil, brotli.DefaultCompression) }},
+	EncodingZstd: {New: func() any {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return enc
+	}},
+	EncodingGzip: {New: func() any { return gzip.NewWriter(nil) }},
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+
+	for _, t := range incompressibleTypes {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// negotiateEncoding picks the encoding with the highest q-value in Accept-Encoding.
+// Ties go to the earliest of supported, "*" stands for any encoding not listed. Empty means identity
+func negotiateEncoding(acceptEncoding string, supported []string) string {
+	qualities := map[string]float64{}
+
+	for part := range strings.SplitSeq(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+
+			if err != nil {
+				continue
+			}
+
+			q = parsed
+		}
+
+		// x-gzip is an alias of gzip
+		if coding == "x-gzip" {
+			coding = EncodingGzip
+		}
+
+		qualities[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, coding := range supported {
+		q, ok := qualities[coding]
+
+		if !ok {
+			q, ok = qualities["*"]
+		}
+
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter buffers the start of the body until it knows whether compressing is worth it
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	buf     []byte
+	status  int
+	decided bool
+	enc     encoder
+	// validatedEncoding is the encoding of the tags in the request's If-None-Match, if any
+	validatedEncoding string
+}
+
+// encodedETag is the strong tag of a content coding of the representation tagged etag, e.g. "abc" becomes
+// "abc-gzip". Weak tags stay as they are, they already stand for every encoding
+func encodedETag(etag, encoding string) string {
+	if strings.HasPrefix(etag, "W/") || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// decodeETags strips the encoding suffixes encodedETag adds from the tags of an If-Match or If-None-Match
+// value, so handlers compare them with the tags of their identity representation. It also returns the
+// encoding it found, if any
+func decodeETags(header string) (string, string) {
+	if header == "" || strings.TrimSpace(header) == "*" {
+		return header, ""
+	}
+
+	tags := []string{}
+	found := ""
+
+	for tag := range strings.SplitSeq(header, ",") {
+		tag = strings.TrimSpace(tag)
+
+		for encoding := range encoderPools {
+			if stripped, ok := strings.CutSuffix(tag, "-"+encoding+`"`); ok {
+				tag, found = stripped+`"`, encoding
+				break
+			}
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return strings.Join(tags, ", "), found
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	// Informational responses go straight through
+	if status < 200 {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+// decide sets up compression when the response qualifies, then sends the headers
+func (c *compressWriter) decide(compress bool) {
+	c.decided = true
+	h := c.Header()
+
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+
+	if h.Get("Content-Type") == "" && len(c.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+
+	noBody := c.status == http.StatusNoContent || c.status == http.StatusNotModified
+
+	// A 304 validates the representation the client holds, it echoes the tag of its encoding
+	if c.status == http.StatusNotModified && c.validatedEncoding != "" {
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", encodedETag(etag, c.validatedEncoding))
+		}
+	}
+
+	if compress && !noBody && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+
+		// The compressed bytes are a different representation, they get their own strong ETag
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", encodedETag(etag, c.encoding))
+		}
+
+		c.enc = encoderPools[c.encoding].Get().(encoder)
+		c.enc.Reset(c.ResponseWriter)
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+}
+
+// flushBuffer writes out whatever was held back while deciding
+func (c *compressWriter) flushBuffer() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	buf := c.buf
+	c.buf = nil
+
+	_, err := c.write(buf)
+	return err
+}
+
+func (c *compressWriter) write(b []byte) (int, error) {
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.decided {
+		return c.write(b)
+	}
+
+	c.buf = append(c.buf, b...)
+
+	if len(c.buf) < c.minSize {
+		return len(b), nil
+	}
+
+	// A declared length below the threshold means the handler knows the body is small
+	if length, err := strconv.Atoi(c.Header().Get("Content-Length")); err == nil && length < c.minSize {
+		c.decide(false)
+	} else {
+		c.decide(true)
+	}
+
+	if err := c.flushBuffer(); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Flush compresses what was written so far, a flushing handler is streaming so the size threshold is ignored
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide(true)
+		c.flushBuffer()
+	}
+
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := c.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	return hijacker.Hijack()
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// close finishes the response, small bodies that never reached the threshold are sent uncompressed
+func (c *compressWriter) close() error {
+	if !c.decided {
+		if c.status == 0 && len(c.buf) == 0 {
+			// Nothing was written, leave the implicit 200 to net/http
+			return nil
+		}
+
+		c.decide(len(c.buf) >= c.minSize)
+	}
+
+	err := c.flushBuffer()
+
+	if c.enc != nil {
+		if closeErr := c.enc.Close(); err == nil {
+			err = closeErr
+		}
+
+		c.enc.Reset(nil)
+		encoderPools[c.encoding].Put(c.enc)
+		c.enc = nil
+	}
+
+	return err
+}
+
+// CompressMiddleware compresses responses with the best encoding the client accepts
+func CompressMiddleware(opts CompressOptions) alice.Constructor {
+	encodings := opts.Encodings
+
+	if encodings == nil {
+		encodings = []string{EncodingBrotli, EncodingZstd, EncodingGzip}
+	}
+
+	encodings = slices.DeleteFunc(slices.Clone(encodings), func(e string) bool {
+		return encoderPools[e] == nil
+	})
+
+	minSize := opts.MinSize
+
+	if minSize <= 0 {
+		minSize = 1024
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			var validatedEncoding string
+
+			// Validators of compressed responses are checked against the identity representation
+			if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+				ifMatch, _ = decodeETags(ifMatch)
+				r.Header.Set("If-Match", ifMatch)
+			}
+
+			if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+				ifNoneMatch, validatedEncoding = decodeETags(ifNoneMatch)
+				r.Header.Set("If-None-Match", ifNoneMatch)
+			}
+
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), encodings)
+
+			// Ranges apply to the encoded bytes, leave them to handlers serving identity content
+			if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize, validatedEncoding: validatedEncoding}
+			defer cw.close()
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
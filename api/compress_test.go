@@ -0,0 +1,135 @@
+package api_test
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api"
+)
+
+var largeBody = strings.Repeat(`{"name": "compress me"}`, 100)
+
+func compressed(acceptEncoding string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+
+	api.CompressMiddleware(api.CompressOptions{})(handler).ServeHTTP(rec, req)
+
+	return rec
+}
+
+func writeBody(body, contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, body)
+	}
+}
+
+func TestCompressNegotiatesEncoding(t *testing.T) {
+	cases := map[string]string{
+		"gzip":                      "gzip",
+		"gzip, br":                  "br",
+		"br;q=0.5, gzip;q=0.8":      "gzip",
+		"*":                         "br",
+		"*;q=0.5, br;q=0, zstd;q=0": "gzip",
+		"identity":                  "",
+		"gzip;q=0":                  "",
+	}
+
+	for accept, expected := range cases {
+		rec := compressed(accept, writeBody(largeBody, "application/json"))
+
+		if got := rec.Header().Get("Content-Encoding"); got != expected {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", accept, expected, got)
+		}
+
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: expected Vary: Accept-Encoding", accept)
+		}
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	rec := compressed("gzip", writeBody(largeBody, "application/json"))
+
+	reader, err := gzip.NewReader(rec.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := io.ReadAll(reader)
+
+	if string(body) != largeBody {
+		t.Error("Expected decompressed body to match")
+	}
+}
+
+func TestCompressSkipsSmallAndCompressedBodies(t *testing.T) {
+	small := compressed("gzip", writeBody(`{"ok": true}`, "application/json"))
+
+	if small.Header().Get("Content-Encoding") != "" || small.Body.String() != `{"ok": true}` {
+		t.Error("Expected small body to be sent as is")
+	}
+
+	image := compressed("gzip", writeBody(largeBody, "image/png"))
+
+	if image.Header().Get("Content-Encoding") != "" {
+		t.Error("Expected image to be sent as is")
+	}
+}
+
+func TestCompressFlushesStreams(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	handler := api.CompressMiddleware(api.CompressOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, "{}\n")
+
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Expected flush to be supported, got %v", err)
+		}
+
+		if !rec.Flushed {
+			t.Error("Expected flush to reach the underlying writer")
+		}
+	}))
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Error("Expected flushed stream to be compressed")
+	}
+}
+
+func TestCompressTagsEncodedRepresentations(t *testing.T) {
+	handler := api.PrivateRevalidate.Middleware(writeBody(largeBody, "application/json"))
+
+	serve := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("If-None-Match", ifNoneMatch)
+
+		api.CompressMiddleware(api.CompressOptions{})(handler).ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	etag := serve("").Header().Get("ETag")
+
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `-gzip"`) {
+		t.Fatalf("Expected a strong ETag of the gzip encoding, got %q", etag)
+	}
+
+	if rec := serve(etag); rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != etag {
+		t.Errorf("Expected the encoded ETag to revalidate, got %d with %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
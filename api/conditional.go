@@ -0,0 +1,166 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/maybemaby/oapibase/api/utils"
+	"github.com/oaswrap/spec/option"
+)
+
+// CachePolicy declares how clients may cache a route's responses
+type CachePolicy struct {
+	CacheControl utils.CacheControlOpts
+	// WeakETag marks generated ETags weak, for bodies that are equivalent but not byte for byte stable
+	WeakETag bool
+}
+
+// PrivateRevalidate lets browsers keep per user responses but revalidate them on every use
+var PrivateRevalidate = CachePolicy{
+	CacheControl: utils.CacheControlOpts{Private: true, NoCache: true},
+}
+
+// CacheHeaders documents the validator headers sent by CachePolicy.Middleware
+type CacheHeaders struct {
+	ETag         string `header:"ETag"`
+	CacheControl string `header:"Cache-Control"`
+	LastModified string `header:"Last-Modified"`
+}
+
+// bufferedWriter holds a response back so its validators can be computed from the full body
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+
+	return b.body.Write(p)
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since when it is absent
+func notModified(r *http.Request, h http.Header) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return utils.ETagMatch(ifNoneMatch, h.Get("ETag"))
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
+
+// Middleware sets Cache-Control and an ETag on successful GET and HEAD responses and answers
+// matching conditional requests with a 304. Handlers may set their own ETag or Last-Modified.
+// Responses are buffered, so it doesn't suit streaming routes
+func (p CachePolicy) Middleware(next http.Handler) http.Handler {
+	cacheControl, err := utils.EncodeCacheControl(&p.CacheControl)
+
+	if err != nil {
+		panic("invalid cache policy: " + err.Error())
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buf := &bufferedWriter{ResponseWriter: w}
+		next.ServeHTTP(buf, r)
+
+		if buf.status == 0 {
+			buf.status = http.StatusOK
+		}
+
+		h := w.Header()
+
+		if buf.status == http.StatusOK {
+			if h.Get("ETag") == "" {
+				h.Set("ETag", utils.ETag(buf.body.Bytes(), p.WeakETag))
+			}
+
+			if h.Get("Cache-Control") == "" && cacheControl != "" {
+				h.Set("Cache-Control", cacheControl)
+			}
+
+			if notModified(r, h) {
+				h.Del("Content-Type")
+				h.Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		w.WriteHeader(buf.status)
+
+		if _, err := w.Write(buf.body.Bytes()); err != nil {
+			RequestLogger(r).Error("Error writing response", slog.Any("err", err))
+		}
+	})
+}
+
+// Cacheable documents the validators and 304 response of a route using policy.
+// It must come after the route's 200 response option, headers declared before the body are dropped
+func Cacheable(policy CachePolicy) option.OperationOption {
+	cacheControl, _ := utils.EncodeCacheControl(&policy.CacheControl)
+
+	return func(oc *option.OperationConfig) {
+		option.Response(http.StatusOK, new(CacheHeaders))(oc)
+		option.Response(http.StatusNotModified, new(CacheHeaders),
+			option.ContentDescription(fmt.Sprintf("Not Modified, responses are sent with Cache-Control: %s", cacheControl)),
+		)(oc)
+	}
+}
+
+// checkIfMatch enforces an If-Match precondition against the current representation of a resource,
+// which must be the value its GET route writes. It writes a 412 and returns false when the client's copy is stale
+func checkIfMatch(w http.ResponseWriter, r *http.Request, current any) bool {
+	if err := ifMatchError(r.Header.Get("If-Match"), current); err != nil {
+		writeOpError(w, r, err)
+		return false
+	}
+
+	return true
+}
+
+// ifMatchError is checkIfMatch for operations, which get If-Match bound to their request.
+// It returns a 412 problem when the client's copy is stale
+func ifMatchError(ifMatch string, current any) error {
+	if ifMatch == "" {
+		return nil
+	}
+
+	etags, err := utils.RepresentationETags(current)
+
+	if err != nil {
+		return fmt.Errorf("computing ETag: %w", err)
+	}
+
+	// The client may hold any encoding of the resource
+	if !slices.ContainsFunc(etags, func(etag string) bool { return utils.ETagMatchStrong(ifMatch, etag) }) {
+		return utils.NewProblem(http.StatusPreconditionFailed, utils.CodePreconditionFailed,
+			"The resource changed since it was fetched")
+	}
+
+	return nil
+}
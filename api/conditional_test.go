@@ -0,0 +1,91 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api"
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+func cachedGet(headers map[string]string) *httptest.ResponseRecorder {
+	handler := api.PrivateRevalidate.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Last-Modified", "Mon, 19 Oct 2026 10:00:00 GMT")
+		w.Write([]byte(`{"id": 1}`))
+	}))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/auth/me", nil)
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	handler.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestCachePolicySetsValidators(t *testing.T) {
+	rec := cachedGet(nil)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"id": 1}` {
+		t.Fatalf("Expected body to pass through, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if rec.Header().Get("ETag") == "" {
+		t.Error("Expected an ETag")
+	}
+
+	if rec.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("Expected private, no-cache, got %q", rec.Header().Get("Cache-Control"))
+	}
+}
+
+func TestCachePolicyNotModified(t *testing.T) {
+	etag := cachedGet(nil).Header().Get("ETag")
+
+	cases := map[string]map[string]string{
+		"etag":       {"If-None-Match": etag},
+		"weak etag":  {"If-None-Match": `"other", W/` + etag},
+		"not since":  {"If-Modified-Since": "Mon, 19 Oct 2026 10:00:00 GMT"},
+		"etag first": {"If-None-Match": etag, "If-Modified-Since": "Sun, 18 Oct 2026 10:00:00 GMT"},
+	}
+
+	for name, headers := range cases {
+		rec := cachedGet(headers)
+
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("%s: expected an empty 304, got %d", name, rec.Code)
+		}
+	}
+
+	for _, headers := range []map[string]string{{"If-None-Match": `"other"`}, {"If-Modified-Since": "Sun, 18 Oct 2026 10:00:00 GMT"}} {
+		if rec := cachedGet(headers); rec.Code != http.StatusOK {
+			t.Errorf("Expected stale validator %v to get a 200, got %d", headers, rec.Code)
+		}
+	}
+}
+
+func TestIfMatchComparesStrongly(t *testing.T) {
+	cases := map[string]bool{
+		`"v1"`:         true,
+		`"v0", "v1"`:   true,
+		`*`:            true,
+		`W/"v1"`:       false,
+		`"v2"`:         false,
+		`"v2", W/"v1"`: false,
+	}
+
+	for header, expected := range cases {
+		if utils.ETagMatchStrong(header, `"v1"`) != expected {
+			t.Errorf("If-Match %s: expected a match to be %t", header, expected)
+		}
+	}
+
+	if utils.ETagMatchStrong(`"v1"`, `W/"v1"`) || !utils.ETagMatch(`W/"v1"`, `"v1"`) {
+		t.Error("Expected weak tags to only match If-None-Match")
+	}
+}
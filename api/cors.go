@@ -0,0 +1,263 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/justinas/alice"
+)
+
+// CorsOptions configures cross origin access for a set of routes
+type CorsOptions struct {
+	// AllowedOrigins holds exact origins like "https://app.site.com", or patterns with a single
+	// "*" wildcard like "https://*.site.com". A lone "*" allows every origin, but not with AllowCredentials
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers readable by the browser beyond the safelisted ones
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response, zero leaves it to the browser
+	MaxAge time.Duration
+}
+
+// CorsPolicy applies Default everywhere except under the path prefixes of Groups, where the longest matching prefix wins
+type CorsPolicy struct {
+	Default CorsOptions
+	Groups  map[string]CorsOptions
+}
+
+var DefaultCorsMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+var DefaultCorsHeaders = []string{"Authorization", "Content-Type", "X-User-Agent", "Cache-Control"}
+
+// Validate rejects options that would trust every site, a lone "*" origin with credentials
+func (o CorsOptions) Validate() error {
+	if o.AllowCredentials && slices.Contains(o.AllowedOrigins, "*") {
+		return errors.New(`cors: a lone "*" origin can't allow credentials, list the trusted origins instead`)
+	}
+
+	return nil
+}
+
+// Validate checks Default and every group
+func (p CorsPolicy) Validate() error {
+	if err := p.Default.Validate(); err != nil {
+		return err
+	}
+
+	for prefix, opts := range p.Groups {
+		if err := opts.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", prefix, err)
+		}
+	}
+
+	return nil
+}
+
+type corsMatcher struct {
+	opts     CorsOptions
+	any      bool
+	exact    map[string]bool
+	patterns [][2]string
+	methods  map[string]bool
+	headers  map[string]bool
+	maxAge   string
+}
+
+func newCorsMatcher(opts CorsOptions) *corsMatcher {
+	if err := opts.Validate(); err != nil {
+		panic(err)
+	}
+
+	if opts.AllowedMethods == nil {
+		opts.AllowedMethods = DefaultCorsMethods
+	}
+
+	if opts.AllowedHeaders == nil {
+		opts.AllowedHeaders = DefaultCorsHeaders
+	}
+
+	m := &corsMatcher{
+		opts:    opts,
+		exact:   map[string]bool{},
+		methods: map[string]bool{},
+		headers: map[string]bool{},
+	}
+
+	for _, origin := range opts.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+
+		if origin == "*" {
+			m.any = true
+		} else if prefix, suffix, ok := strings.Cut(origin, "*"); ok {
+			m.patterns = append(m.patterns, [2]string{prefix, suffix})
+		} else {
+			m.exact[origin] = true
+		}
+	}
+
+	for _, method := range opts.AllowedMethods {
+		m.methods[strings.ToUpper(method)] = true
+	}
+
+	for _, header := range opts.AllowedHeaders {
+		m.headers[strings.ToLower(header)] = true
+	}
+
+	if opts.MaxAge > 0 {
+		m.maxAge = strconv.Itoa(int(opts.MaxAge.Seconds()))
+	}
+
+	return m
+}
+
+func (m *corsMatcher) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+
+	if m.any || m.exact[origin] {
+		return true
+	}
+
+	for _, pattern := range m.patterns {
+		prefix, suffix := pattern[0], pattern[1]
+
+		if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+			continue
+		}
+
+		// The wildcard stands for host labels only, it can't swallow a port or path
+		wildcard := origin[len(prefix) : len(origin)-len(suffix)]
+
+		if !strings.ContainsAny(wildcard, "/:@?#") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsHeaders checks the comma separated Access-Control-Request-Headers value
+func (m *corsMatcher) allowsHeaders(requested string) bool {
+	for header := range strings.SplitSeq(requested, ",") {
+		header = strings.ToLower(strings.TrimSpace(header))
+
+		if header != "" && !m.headers[header] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// allowOrigin sets the origin headers, a wildcard is only sent when credentials are not allowed
+func (m *corsMatcher) allowOrigin(h http.Header, origin string) {
+	if m.any && !m.opts.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if m.opts.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (m *corsMatcher) preflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+
+	if !m.allowsOrigin(origin) || !m.methods[method] || !m.allowsHeaders(requestedHeaders) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	m.allowOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(m.opts.AllowedMethods, ", "))
+
+	if requestedHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", strings.Join(m.opts.AllowedHeaders, ", "))
+	}
+
+	if m.maxAge != "" {
+		h.Set("Access-Control-Max-Age", m.maxAge)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *corsMatcher) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	origin := r.Header.Get("Origin")
+
+	// Same origin and non browser requests are none of CORS' business
+	if origin == "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		m.preflight(w, r)
+		return
+	}
+
+	h := w.Header()
+
+	if !(m.any && !m.opts.AllowCredentials) {
+		h.Add("Vary", "Origin")
+	}
+
+	// Disallowed origins still get a response, the browser withholds it from the page
+	if m.allowsOrigin(origin) {
+		m.allowOrigin(h, origin)
+
+		if len(m.opts.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(m.opts.ExposedHeaders, ", "))
+		}
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+// CorsMiddleware answers preflight requests and reflects allowed origins on actual requests.
+// Preflights are answered before routing, so it must wrap the mux rather than individual routes
+// for method specific patterns to be reachable. It panics on options rejected by Validate
+func CorsMiddleware(policy CorsPolicy) alice.Constructor {
+	defaultMatcher := newCorsMatcher(policy.Default)
+
+	prefixes := make([]string, 0, len(policy.Groups))
+	matchers := map[string]*corsMatcher{}
+
+	for prefix, opts := range policy.Groups {
+		prefixes = append(prefixes, prefix)
+		matchers[prefix] = newCorsMatcher(opts)
+	}
+
+	// Longest prefix first so the most specific group wins
+	slices.SortFunc(prefixes, func(a, b string) int {
+		return len(b) - len(a)
+	})
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(r.URL.Path, prefix) {
+					matchers[prefix].serve(w, r, next)
+					return
+				}
+			}
+
+			defaultMatcher.serve(w, r, next)
+		})
+	}
+}
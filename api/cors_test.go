@@ -0,0 +1,146 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/maybemaby/oapibase/api"
+)
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func corsHandler() http.Handler {
+	return api.CorsMiddleware(api.CorsPolicy{
+		Default: api.CorsOptions{
+			AllowedOrigins:   []string{"https://app.site.com", "https://*.staging.site.com"},
+			ExposedHeaders:   []string{"X-Request-Id"},
+			AllowCredentials: true,
+			MaxAge:           time.Minute,
+		},
+		Groups: map[string]api.CorsOptions{
+			"/public/": {AllowedOrigins: []string{"*"}},
+		},
+	})(http.HandlerFunc(okHandler))
+}
+
+func preflight(path, origin, method, headers string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodOptions, path, nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+
+	if headers != "" {
+		req.Header.Set("Access-Control-Request-Headers", headers)
+	}
+
+	corsHandler().ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestCorsReflectsAllowedOrigin(t *testing.T) {
+	for _, origin := range []string{"https://app.site.com", "https://pr-12.staging.site.com"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/auth/me", nil)
+		req.Header.Set("Origin", origin)
+
+		corsHandler().ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != origin {
+			t.Errorf("Expected origin %s to be reflected, got %q", origin, got)
+		}
+
+		if !slices.Contains(rec.Header().Values("Vary"), "Origin") {
+			t.Errorf("Expected Vary: Origin, got %v", rec.Header().Values("Vary"))
+		}
+
+		if rec.Header().Get("Access-Control-Expose-Headers") != "X-Request-Id" {
+			t.Errorf("Expected exposed headers, got %q", rec.Header().Get("Access-Control-Expose-Headers"))
+		}
+	}
+}
+
+func TestCorsIgnoresDisallowedOrigin(t *testing.T) {
+	for _, origin := range []string{"https://evil.com", "https://staging.site.com", "https://x.staging.site.com.evil.com"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/auth/me", nil)
+		req.Header.Set("Origin", origin)
+
+		corsHandler().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected request from %s to pass through, got %d", origin, rec.Code)
+		}
+
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("Expected no allow origin for %s, got %q", origin, got)
+		}
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	rec := preflight("/orgs/1", "https://app.site.com", "PATCH", "content-type, authorization")
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	if rec.Header().Get("Access-Control-Max-Age") != "60" {
+		t.Errorf("Expected max age 60, got %q", rec.Header().Get("Access-Control-Max-Age"))
+	}
+
+	if rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("Expected credentials to be allowed")
+	}
+}
+
+func TestCorsRejectsPreflight(t *testing.T) {
+	cases := map[string]*httptest.ResponseRecorder{
+		"origin":  preflight("/orgs/1", "https://evil.com", "GET", ""),
+		"method":  preflight("/orgs/1", "https://app.site.com", "TRACE", ""),
+		"headers": preflight("/orgs/1", "https://app.site.com", "GET", "x-secret"),
+	}
+
+	for name, rec := range cases {
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("Disallowed %s: expected status %d, got %d", name, http.StatusForbidden, rec.Code)
+		}
+
+		if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Disallowed %s: expected no allow origin", name)
+		}
+	}
+}
+
+func TestCorsGroupOverride(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/public/feed", nil)
+	req.Header.Set("Origin", "https://anywhere.com")
+
+	corsHandler().ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Expected wildcard origin for public group, got %q", got)
+	}
+}
+
+func TestCorsRejectsWildcardWithCredentials(t *testing.T) {
+	opts := api.CorsOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+
+	if err := opts.Validate(); err == nil {
+		t.Error("Expected a wildcard origin with credentials to be rejected")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected the middleware to refuse the options")
+		}
+	}()
+
+	api.CorsMiddleware(api.CorsPolicy{Default: opts})
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/maybemaby/oapibase/api/utils"
+	"github.com/maybemaby/oapibase/api/validate"
+)
+
+type BodyLimitContextKey string
+
+const BodyLimitKey BodyLimitContextKey = "body_limit"
+
+// BodyLimit sets the max request body size decoded for the routes it wraps, overriding any outer BodyLimit
+func BodyLimit(maxBytes int64) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), BodyLimitKey, maxBytes)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequestBodyLimit returns the limit set by BodyLimit, zero when unset
+func RequestBodyLimit(r *http.Request) int64 {
+	maxBytes, _ := r.Context().Value(BodyLimitKey).(int64)
+	return maxBytes
+}
+
+// HandlerTimeout cancels the request context after timeout so slow database calls are abandoned.
+// Deadlines only shrink, an inner HandlerTimeout can't extend an outer one
+func HandlerTimeout(timeout time.Duration) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			r = r.WithContext(ctx)
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			if !rec.wroteHeader && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				ServerError(w, r)
+			}
+		})
+	}
+}
+
+// decodeBody strictly decodes the body of r into target and validates it, writing a problem when either fails.
+// The max size comes from BodyLimit unless opts sets one
+func decodeBody(w http.ResponseWriter, r *http.Request, target any, opts utils.DecodeOptions) bool {
+	return readBody(w, r, target, opts) && validateRequest(w, r, target)
+}
+
+// validateRequest checks target against its jsonschema tags, then its Validate method if it has one,
+// and answers all the field errors with a 422
+func validateRequest(w http.ResponseWriter, r *http.Request, target any) bool {
+	errs := validate.Struct(target)
+
+	if validatable, ok := target.(Validatable); ok {
+		errs = append(errs, validatable.Validate()...)
+	}
+
+	if len(errs) > 0 {
+		utils.WriteProblem(w, r, utils.ValidationFailed(errs...))
+		return false
+	}
+
+	return true
+}
+
+// readBody is decodeBody without the validation
+func readBody(w http.ResponseWriter, r *http.Request, target any, opts utils.DecodeOptions) bool {
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = RequestBodyLimit(r)
+	}
+
+	err := utils.Decode(w, r, target, opts)
+
+	if err == nil {
+		return true
+	}
+
+	var decodeErr *utils.DecodeError
+
+	if !errors.As(err, &decodeErr) {
+		RequestLogger(r).Warn("Error reading request body", slog.Any("err", err))
+		utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidBody, "Invalid request body"))
+		return false
+	}
+
+	code := utils.CodeInvalidBody
+
+	switch decodeErr.Status {
+	case http.StatusRequestEntityTooLarge:
+		code = utils.CodeBodyTooLarge
+	case http.StatusUnsupportedMediaType:
+		code = utils.CodeUnsupportedMediaType
+	}
+
+	problem := utils.NewProblem(decodeErr.Status, code, decodeErr.Message)
+
+	if decodeErr.Field != "" {
+		problem.WithErrors(utils.FieldError{Field: decodeErr.Field, Message: decodeErr.Message})
+	}
+
+	if decodeErr.Offset >= 0 {
+		problem.Offset = &decodeErr.Offset
+	}
+
+	utils.WriteProblem(w, r, problem)
+	return false
+}
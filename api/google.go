@@ -12,6 +12,8 @@ import (
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/invites"
+	"github.com/maybemaby/oapibase/api/utils"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
@@ -22,9 +24,10 @@ type GoogleHandler struct {
 	Provider   *auth.OAuthProvider
 	DB         *pgxpool.Pool
 	jwtManager *auth.JwtManager
+	invites    *invites.Manager
 }
 
-func NewGoogleHandler(db *pgxpool.Pool, jwtManager *auth.JwtManager) *GoogleHandler {
+func NewGoogleHandler(db *pgxpool.Pool, jwtManager *auth.JwtManager, inviteManager *invites.Manager) *GoogleHandler {
 	config := &oauth2.Config{
 		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
 		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
@@ -41,6 +44,7 @@ func NewGoogleHandler(db *pgxpool.Pool, jwtManager *auth.JwtManager) *GoogleHand
 		Provider:   provider,
 		DB:         db,
 		jwtManager: jwtManager,
+		invites:    inviteManager,
 	}
 }
 
@@ -55,6 +59,11 @@ type GoogleToken struct {
 	Scope        string    `json:"scope"`
 }
 
+type GoogleAuthQuery struct {
+	// Invite is an optional invite token applied once the login completes
+	Invite string `query:"invite"`
+}
+
 // For OIDC
 type googleUserInfo struct {
 	Email         string `json:"email"`
@@ -67,6 +76,24 @@ type googleUserInfo struct {
 	Locale        string `json:"locale"`
 }
 
+// profile maps the OIDC claims to the user's profile, leaving out claims Google didn't send
+func (info googleUserInfo) profile() auth.ProfileFields {
+	optional := func(value string) *string {
+		if value == "" {
+			return nil
+		}
+		return &value
+	}
+
+	return auth.ProfileFields{
+		Name:       optional(info.Name),
+		GivenName:  optional(info.GivenName),
+		FamilyName: optional(info.FamilyName),
+		Picture:    optional(info.Picture),
+		Locale:     optional(info.Locale),
+	}
+}
+
 func parseGoogleToken(tok *oauth2.Token) *GoogleToken {
 
 	tokExpiresIn := tok.Extra("expires_in")
@@ -99,10 +126,22 @@ func (h *GoogleHandler) HandleAuth(w http.ResponseWriter, r *http.Request) {
 	state, verifier, err := h.Provider.InitStateAndVerifier(w)
 
 	if err != nil {
-		http.Error(w, "Failed to initialize state and verifier", http.StatusInternalServerError)
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusInternalServerError, utils.CodeInternal, "Failed to initialize state and verifier"))
 		return
 	}
 
+	// Carry the invite through the provider redirect so the callback can apply it
+	if invite := r.URL.Query().Get("invite"); invite != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     auth.OAUTH_INVITE_SESSION_KEY,
+			Value:    invite,
+			Path:     "/",
+			MaxAge:   300, // 5 minutes
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
 	url := h.Provider.Config.AuthCodeURL(state, oauth2.AccessTypeOnline, oauth2.S256ChallengeOption(verifier))
 
 	http.Redirect(w, r, url, http.StatusFound)
@@ -114,21 +153,21 @@ func (h *GoogleHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	stateErr := auth.ValidateState(r)
 
 	if stateErr != nil {
-		http.Error(w, "State validation failed", http.StatusBadRequest)
+		utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidToken, "State validation failed"))
 		return
 	}
 
 	verifierCookie, err := r.Cookie(auth.OAUTH_VERIFIER_SESSION_KEY)
 
 	if err != nil {
-		http.Error(w, "Missing verifier cookie", http.StatusBadRequest)
+		utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidToken, "Missing verifier cookie"))
 		return
 	}
 
 	tok, err := h.Provider.Config.Exchange(r.Context(), code, oauth2.VerifierOption(verifierCookie.Value))
 
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServerError(w, r)
 		return
 	}
 
@@ -139,7 +178,7 @@ func (h *GoogleHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	userInfo, err := client.Get(userInfoEndpoint)
 
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServerError(w, r)
 		return
 	}
 
@@ -148,10 +187,35 @@ func (h *GoogleHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	var user googleUserInfo
 
 	if err := json.NewDecoder(userInfo.Body).Decode(&user); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServerError(w, r)
 		return
 	}
 
+	var invite *invites.Invite
+
+	if inviteCookie, err := r.Cookie(auth.OAUTH_INVITE_SESSION_KEY); err == nil && inviteCookie.Value != "" {
+		// Clear the invite so it is only ever applied once
+		http.SetCookie(w, &http.Cookie{
+			Name:   auth.OAUTH_INVITE_SESSION_KEY,
+			Path:   "/",
+			MaxAge: -1,
+		})
+
+		if !user.EmailVerified {
+			utils.WriteProblem(w, r, utils.BadRequest(utils.CodeEmailNotVerified, "Email is not verified"))
+			return
+		}
+
+		inv, err := verifyInvite(r.Context(), h.invites, inviteCookie.Value, user.Email, h.DB)
+
+		if err != nil {
+			utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidInvite, "Invalid invite"))
+			return
+		}
+
+		invite = &inv
+	}
+
 	existingUser, existingAccount, err := auth.GetUserAccountByEmail(r.Context(), user.Email, "google", h.DB)
 
 	// No error, so we have an existing user or account
@@ -162,7 +226,7 @@ func (h *GoogleHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 		switch status {
 		case auth.AccountStatusNoAccount:
 			// Probably don't want to link accounts by default
-			w.Write([]byte("Could not login"))
+			utils.WriteProblem(w, r, utils.Conflict(utils.CodeAccountNotLinked, "An account with this email exists but is not linked to Google"))
 
 			return
 		case auth.AccountStatusLinked:
@@ -171,24 +235,41 @@ func (h *GoogleHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 				googleToken.AccessToken, googleToken.RefreshToken, &googleToken.Expiry, nil, h.DB)
 
 			if err != nil {
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				ServerError(w, r)
 				return
 			}
 
-			accessToken, err := h.jwtManager.EncodeAccessToken(auth.SessionData{
-				UserId: existingUser.ID,
-				Role:   existingUser.Role,
-			})
+			sessData := auth.SessionData{
+				UserId:   existingUser.ID,
+				Role:     existingUser.Role,
+				AuthTime: time.Now(),
+			}
+
+			if invite != nil {
+				accepted, err := invites.AcceptInvite(r.Context(), invite.ID, existingUser.ID, h.DB)
+
+				if inviteUnusable(err) {
+					utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidInvite, "Invalid invite"))
+					return
+				}
+
+				if err != nil {
+					RequestLogger(r).Error("Error accepting invite", slog.Any("err", err), slog.Int("invite_id", invite.ID))
+					ServerError(w, r)
+					return
+				}
+
+				sessData = invitedSession(sessData, accepted)
+			}
+
+			accessToken, err := h.jwtManager.EncodeAccessToken(sessData)
 
-			refreshToken, refreshErr := h.jwtManager.EncodeRefreshToken(auth.SessionData{
-				UserId: existingUser.ID,
-				Role:   existingUser.Role,
-			})
+			refreshToken, refreshErr := h.jwtManager.EncodeRefreshToken(sessData)
 
 			jwtErr := errors.Join(err, refreshErr)
 
 			if jwtErr != nil {
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				ServerError(w, r)
 				return
 			}
 
@@ -198,55 +279,93 @@ func (h *GoogleHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	} else if err != sql.ErrNoRows {
 		// Unexpected error, log it and return
 		slog.Error("Error during Google login", "error", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServerError(w, r)
 		return
 	}
 
+	if invite == nil && !h.invites.SignupAllowed(user.Email) {
+		utils.WriteProblem(w, r, utils.NewProblem(http.StatusForbidden, utils.CodeInviteOnly, "Signup is invite only"))
+		return
+	}
+
+	// The user is only created along with accepting their invite, a failed signup leaves nothing behind
+	tx, err := h.DB.Begin(r.Context())
+
+	if err != nil {
+		RequestLogger(r).Error("Error creating user account", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	defer tx.Rollback(r.Context())
+
 	newUser, err := auth.CreateUserAccount(r.Context(), auth.User{
-		Email:        &user.Email,
-		PasswordHash: nil,
-		Role:         "user",
-	}, auth.AccountInsert{
+		Email:         &user.Email,
+		EmailVerified: user.EmailVerified,
+		PasswordHash:  nil,
+		Role:          "user",
+	}, user.profile(), auth.AccountInsert{
 		Provider:              "google",
 		ProviderId:            user.Sub,
 		AccessToken:           googleToken.AccessToken,
 		AccessTokenExpiresAt:  googleToken.Expiry,
 		RefreshToken:          googleToken.RefreshToken,
 		RefreshTokenExpiresAt: nil, // Google does not return this
-	}, h.DB)
+	}, tx)
 
 	if err != nil {
 		logger := RequestLogger(r)
 		logger.Error("Error creating user account", slog.Any("err", err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServerError(w, r)
+		return
+	}
+
+	sessData := auth.SessionData{
+		UserId:   newUser.ID,
+		Role:     newUser.Role,
+		AuthTime: time.Now(),
+	}
+
+	if invite != nil {
+		accepted, err := invites.AcceptInvite(r.Context(), invite.ID, newUser.ID, tx)
+
+		if inviteUnusable(err) {
+			utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidInvite, "Invalid invite"))
+			return
+		}
+
+		if err != nil {
+			RequestLogger(r).Error("Error accepting invite", slog.Any("err", err), slog.Int("invite_id", invite.ID))
+			ServerError(w, r)
+			return
+		}
+
+		sessData = invitedSession(sessData, accepted)
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		RequestLogger(r).Error("Error creating user account", slog.Any("err", err))
+		ServerError(w, r)
 		return
 	}
 
-	accessToken, err := h.jwtManager.EncodeAccessToken(auth.SessionData{
-		UserId: newUser.ID,
-		Role:   newUser.Role,
-	})
+	accessToken, err := h.jwtManager.EncodeAccessToken(sessData)
 
-	refreshToken, refreshErr := h.jwtManager.EncodeRefreshToken(auth.SessionData{
-		UserId: newUser.ID,
-		Role:   newUser.Role,
-	})
+	refreshToken, refreshErr := h.jwtManager.EncodeRefreshToken(sessData)
 
 	jwtErr := errors.Join(err, refreshErr)
 
 	if jwtErr != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServerError(w, r)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
 	response := map[string]any{
 		"message": "Login successful",
 		"user": map[string]any{
 			"id":    newUser.ID,
 			"email": newUser.Email,
-			"role":  newUser.Role,
+			"role":  sessData.Role,
 		},
 		"token": map[string]any{
 			"accessToken":  googleToken.AccessToken,
@@ -260,8 +379,7 @@ func (h *GoogleHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 			"refreshToken": refreshToken,
 		},
 	}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	if err := utils.WriteResponse(w, r, http.StatusOK, response); err != nil {
+		slog.Error("Error encoding response", slog.Any("err", err))
 	}
 }
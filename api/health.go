@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/maybemaby/oapibase/api/health"
+	"github.com/maybemaby/oapibase/migrations"
+)
+
+// newHealthChecks sets up the built in probes. Liveness has no checks of its own so a database outage
+// doesn't get instances restarted, readiness covers the server state, postgres, the schema and OTel when configured
+func (s *Server) newHealthChecks() {
+	s.liveness = health.NewRegistry()
+	s.readiness = health.NewRegistry()
+
+	s.readiness.Register(
+		health.Check{
+			Name: "server",
+			Run: func(ctx context.Context) error {
+				if !s.Ready() {
+					return errors.New("not serving or shutting down")
+				}
+
+				return nil
+			},
+		},
+		health.Check{
+			Name:     "postgres",
+			Run:      health.PgxPing(s.pool),
+			Timeout:  time.Second,
+			CacheTTL: time.Second * 5,
+		},
+	)
+
+	if version, err := migrations.LatestVersion(); err != nil {
+		s.logger.Error("Error reading embedded migrations, skipping the migrations check", slog.Any("err", err))
+	} else {
+		s.readiness.Register(health.Check{
+			Name:     "migrations",
+			Run:      health.MigrationVersion(s.pool, version),
+			CacheTTL: time.Second * 30,
+		})
+	}
+
+	// Telemetry going missing shouldn't take instances out of rotation, it is only reported
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		s.readiness.Register(health.Check{
+			Name:     "otel",
+			Run:      health.TCPReachable(endpoint),
+			Timeout:  time.Second,
+			CacheTTL: time.Second * 30,
+			Optional: true,
+		})
+	}
+}
+
+// mountHealthChecks serves the probes outside the middleware chains to keep them cheap and out of the logs
+func (s *Server) mountHealthChecks(mux *http.ServeMux) {
+	mux.Handle("GET /livez", s.liveness.Handler())
+	mux.Handle("GET /readyz", s.readiness.Handler())
+}
+
+// Liveness holds the checks behind /livez, failing them gets the instance restarted
+func (s *Server) Liveness() *health.Registry {
+	return s.liveness
+}
+
+// Readiness holds the checks behind /readyz, failing them takes the instance out of rotation
+func (s *Server) Readiness() *health.Registry {
+	return s.readiness
+}
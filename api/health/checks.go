@@ -0,0 +1,76 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PgxPing checks the pool can reach the database
+func PgxPing(pool *pgxpool.Pool) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return pool.Ping(ctx)
+	}
+}
+
+// MigrationVersion checks the database schema is at least at version, the newest migration this build knows.
+// A newer schema passes so instances of the previous release stay ready during a rolling deploy
+func MigrationVersion(pool *pgxpool.Pool, version int64) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var current int64
+
+		// Like goose, only the latest row of a version counts, a rollback adds a not applied row after the applied one
+		err := pool.QueryRow(ctx, `SELECT coalesce(max(version_id), 0) FROM (
+			SELECT DISTINCT ON (version_id) version_id, is_applied FROM goose_db_version ORDER BY version_id, id DESC
+		) latest WHERE is_applied`).Scan(&current)
+
+		if err != nil {
+			return fmt.Errorf("reading migration version: %w", err)
+		}
+
+		if current < version {
+			return fmt.Errorf("database is at migration %d, expected %d", current, version)
+		}
+
+		return nil
+	}
+}
+
+// TCPReachable checks an endpoint such as an OTLP collector accepts connections.
+// endpoint may be a URL or a bare host:port
+func TCPReachable(endpoint string) func(ctx context.Context) error {
+	addr := endpoint
+
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		addr = u.Host
+
+		if u.Port() == "" {
+			port := "80"
+
+			if u.Scheme == "https" {
+				port = "443"
+			}
+
+			addr = net.JoinHostPort(u.Hostname(), port)
+		}
+	}
+
+	return func(ctx context.Context) error {
+		if addr == "" {
+			return errors.New("no endpoint configured")
+		}
+
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+}
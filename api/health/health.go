@@ -0,0 +1,219 @@
+// Package health runs liveness and readiness checks for orchestrator probes.
+// Checks run concurrently with a timeout each, and results are cached so frequent probes
+// don't hammer the dependencies they check
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+// DefaultTimeout bounds a check that doesn't set its own Timeout
+const DefaultTimeout = time.Second * 2
+
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+	// Timeout bounds a single run, defaults to DefaultTimeout
+	Timeout time.Duration
+	// CacheTTL reuses the last result for this long, zero runs the check on every probe
+	CacheTTL time.Duration
+	// Optional checks are reported but never fail the probe
+	Optional bool
+}
+
+type Status string
+
+const (
+	StatusOK      Status = "ok"
+	StatusFailing Status = "failing"
+)
+
+type Result struct {
+	Name      string    `json:"name"`
+	Status    Status    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Optional  bool      `json:"optional,omitempty"`
+	Duration  string    `json:"duration"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Report is the outcome of all checks of a Registry, failing when any required check fails
+type Report struct {
+	Status Status   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+type entry struct {
+	check Check
+
+	// mu makes concurrent probes share a single run
+	mu      sync.Mutex
+	last    Result
+	expires time.Time
+}
+
+func (e *entry) result(ctx context.Context) Result {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if time.Now().Before(e.expires) {
+		return e.last
+	}
+
+	timeout := e.check.Timeout
+
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+
+	// Checks that ignore their context still can't hold the probe past the timeout
+	go func() {
+		done <- e.check.Run(runCtx)
+	}()
+
+	var err error
+
+	select {
+	case err = <-done:
+	case <-runCtx.Done():
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	res := Result{
+		Name:      e.check.Name,
+		Status:    StatusOK,
+		Optional:  e.check.Optional,
+		Duration:  time.Since(start).Round(time.Microsecond).String(),
+		CheckedAt: start.UTC(),
+	}
+
+	if err != nil {
+		res.Status = StatusFailing
+		res.Error = err.Error()
+	}
+
+	// A probe that went away says nothing about the dependency, don't keep its result
+	if ctx.Err() == nil {
+		e.last = res
+		e.expires = start.Add(e.check.CacheTTL)
+	}
+
+	return res
+}
+
+// Registry holds the checks behind a single probe endpoint
+type Registry struct {
+	mu      sync.RWMutex
+	entries []*entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds checks, a check named like an existing one replaces it
+func (r *Registry) Register(checks ...Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Copy on write, Run iterates the old slice without holding the lock
+	r.entries = slices.Clone(r.entries)
+
+	for _, check := range checks {
+		e := &entry{check: check}
+		replaced := false
+
+		for i, existing := range r.entries {
+			if existing.check.Name == check.Name {
+				r.entries[i] = e
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			r.entries = append(r.entries, e)
+		}
+	}
+}
+
+// Run runs all checks concurrently, results are in registration order
+func (r *Registry) Run(ctx context.Context) Report {
+	r.mu.RLock()
+	entries := r.entries
+	r.mu.RUnlock()
+
+	report := Report{Status: StatusOK, Checks: make([]Result, len(entries))}
+
+	var wg sync.WaitGroup
+
+	for i, e := range entries {
+		wg.Go(func() {
+			report.Checks[i] = e.result(ctx)
+		})
+	}
+
+	wg.Wait()
+
+	for _, res := range report.Checks {
+		if res.Status != StatusOK && !res.Optional {
+			report.Status = StatusFailing
+		}
+	}
+
+	return report
+}
+
+// Handler serves the registry as a probe endpoint. It answers 200 or 503 with a plain "ok" or the failing checks,
+// or with the full Report as JSON when the verbose query parameter is present
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		report := r.Run(req.Context())
+
+		w.Header().Set("Cache-Control", "no-store")
+
+		status := http.StatusOK
+
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+
+		if req.URL.Query().Has("verbose") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			_ = utils.WriteJSON(w, req, report)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+
+		if status == http.StatusOK {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+
+		failing := []string{}
+
+		for _, res := range report.Checks {
+			if res.Status != StatusOK && !res.Optional {
+				failing = append(failing, res.Name)
+			}
+		}
+
+		fmt.Fprintf(w, "failing: %s\n", strings.Join(failing, ", "))
+	})
+}
@@ -0,0 +1,96 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maybemaby/oapibase/api/health"
+)
+
+func TestRegistryCachesResults(t *testing.T) {
+	var runs atomic.Int32
+
+	registry := health.NewRegistry()
+	registry.Register(health.Check{
+		Name: "counted",
+		Run: func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		},
+		CacheTTL: time.Minute,
+	})
+
+	for range 3 {
+		if report := registry.Run(context.Background()); report.Status != health.StatusOK {
+			t.Fatalf("Expected ok, got %+v", report)
+		}
+	}
+
+	if runs.Load() != 1 {
+		t.Errorf("Expected the check to run once, ran %d times", runs.Load())
+	}
+}
+
+func TestRegistryTimesOutChecks(t *testing.T) {
+	registry := health.NewRegistry()
+	registry.Register(health.Check{
+		Name: "stuck",
+		Run: func(ctx context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		},
+		Timeout: time.Millisecond * 20,
+	})
+
+	start := time.Now()
+	report := registry.Run(context.Background())
+
+	if time.Since(start) > time.Millisecond*500 {
+		t.Errorf("Expected the probe to return at the timeout, took %s", time.Since(start))
+	}
+
+	if report.Status != health.StatusFailing || !strings.Contains(report.Checks[0].Error, "timed out") {
+		t.Errorf("Expected a timed out failure, got %+v", report)
+	}
+}
+
+func TestHandlerVerboseAndOptional(t *testing.T) {
+	registry := health.NewRegistry()
+	registry.Register(
+		health.Check{Name: "db", Run: func(ctx context.Context) error { return nil }},
+		health.Check{Name: "otel", Run: func(ctx context.Context) error { return errors.New("unreachable") }, Optional: true},
+	)
+
+	rec := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz?verbose", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected optional failures to keep the probe passing, got %d", rec.Code)
+	}
+
+	var report health.Report
+
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Checks) != 2 || report.Checks[1].Status != health.StatusFailing || report.Checks[1].Error != "unreachable" {
+		t.Errorf("Expected every check listed with its status, got %+v", report.Checks)
+	}
+
+	registry.Register(health.Check{Name: "db", Run: func(ctx context.Context) error { return errors.New("down") }})
+
+	rec = httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "failing: db\n" {
+		t.Errorf("Expected 503 naming the failing check, got %d %q", rec.Code, rec.Body.String())
+	}
+}
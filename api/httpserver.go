@@ -0,0 +1,85 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/justinas/alice"
+)
+
+// ServerConfig tunes the underlying http.Server, zero durations leave that timeout off
+type ServerConfig struct {
+	// ReadHeaderTimeout bounds reading request headers, the main defense against slowloris clients
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading the whole request including the body
+	ReadTimeout time.Duration
+	// WriteTimeout bounds writing the response, streaming routes extend it with WriteDeadline
+	WriteTimeout time.Duration
+	// IdleTimeout is how long keep-alive connections wait for the next request
+	IdleTimeout time.Duration
+	// MaxHeaderBytes caps the size of request headers, defaults to http.DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+	// TLS serves HTTPS when set, HTTP/2 is negotiated through ALPN
+	TLS *TLSConfig
+	// H2C accepts HTTP/2 without TLS, for proxies that speak cleartext HTTP/2 to the backend
+	H2C bool
+}
+
+// DefaultServerConfig returns hardened timeouts in production. Development only guards header reads
+// so debuggers and slow local databases don't get cut off
+func DefaultServerConfig(isProd bool) ServerConfig {
+	if !isProd {
+		return ServerConfig{
+			ReadHeaderTimeout: time.Second * 10,
+		}
+	}
+
+	return ServerConfig{
+		ReadHeaderTimeout: time.Second * 5,
+		ReadTimeout:       time.Second * 30,
+		WriteTimeout:      time.Minute,
+		IdleTimeout:       time.Minute * 2,
+		MaxHeaderBytes:    64 << 10,
+	}
+}
+
+// newHTTPServer applies cfg to a server for handler, TLS is set up by Start once certificates load
+func newHTTPServer(addr string, handler http.Handler, cfg ServerConfig) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		Protocols:         new(http.Protocols),
+	}
+
+	srv.Protocols.SetHTTP1(true)
+
+	if cfg.TLS != nil {
+		srv.Protocols.SetHTTP2(true)
+	} else if cfg.H2C {
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return srv
+}
+
+// WriteDeadline replaces the server's write deadline for a route, for streams that outlive ServerConfig.WriteTimeout
+func WriteDeadline(timeout time.Duration) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+
+			if err != nil && !errors.Is(err, http.ErrNotSupported) {
+				RequestLogger(r).Warn("Error extending write deadline", slog.Any("err", err))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/justinas/alice"
+	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/idempotency"
+	"github.com/maybemaby/oapibase/api/utils"
+	"github.com/oaswrap/spec/option"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader marks responses replayed from the store
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength caps client supplied keys, UUIDs are well below it
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyOptions configures IdempotencyMiddleware
+type IdempotencyOptions struct {
+	// TTL is how long responses are kept for replay, defaults to 24 hours
+	TTL time.Duration
+	// LockTimeout is how long an in-flight request holds its key before a retry may take it over, defaults to 1 minute
+	LockTimeout time.Duration
+	// Required rejects requests without an Idempotency-Key
+	Required bool
+	// Seal encrypts stored bodies, for routes answering with credentials like tokens. Headers are stored as is
+	Seal cipher.AEAD
+}
+
+// IdempotencyHeaders documents the request and replay headers of idempotent routes
+type IdempotencyHeaders struct {
+	IdempotencyKey string `header:"Idempotency-Key" description:"Unique key, e.g. a UUID, making retries of this request safe"`
+}
+
+// recordingWriter passes the response through while keeping a copy to store
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+
+		flusher.Flush()
+	}
+}
+
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// replayable tells whether a response may be stored and replayed. Server errors, timeouts and
+// rate limits are transient and a retry should run the request again
+func replayable(status int) bool {
+	return status != 0 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+// IdempotencySeal derives the AEAD sealing stored bodies from secret, e.g. the refresh token secret.
+// The tokens it protects are signed with that secret, so it exposes nothing new
+func IdempotencySeal(secret []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, nil, "oapibase idempotency", 32)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts body, binding it to the key it is stored under
+func seal(aead cipher.AEAD, scope, key string, body []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+
+	return aead.Seal(nonce, nonce, body, []byte(scope+"\n"+key))
+}
+
+func openSealed(aead cipher.AEAD, scope, key string, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed body too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, []byte(scope+"\n"+key))
+}
+
+// idempotencyScope keeps keys of different routes and users apart
+func idempotencyScope(r *http.Request) string {
+	scope := r.Pattern
+
+	if sess, err := auth.RequestUser(r); err == nil {
+		scope += " user:" + strconv.Itoa(sess.UserId)
+	}
+
+	return scope
+}
+
+// fingerprint identifies the request payload so a reused key with another payload is caught
+func fingerprint(r *http.Request, body []byte) []byte {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+
+	return h.Sum(nil)
+}
+
+// addedHeaders returns the headers the handler set, leaving out per request ones like X-Request-Id
+func addedHeaders(before, after http.Header) http.Header {
+	added := http.Header{}
+
+	for key, values := range after {
+		if !slices.Equal(before[key], values) {
+			added[key] = values
+		}
+	}
+
+	return added
+}
+
+func idempotencyError(w http.ResponseWriter, r *http.Request, code utils.ProblemCode, message string, status int) {
+	utils.WriteProblem(w, r, utils.NewProblem(status, code, message))
+}
+
+// IdempotencyMiddleware implements the IETF Idempotency-Key draft for the routes it wraps.
+// The first request with a key runs and its response is stored, retries with the same payload get it replayed.
+// Transient failures are not stored so they can be retried. It must run after auth middleware to scope keys per user,
+// and inside rate limits so retries count against them
+func IdempotencyMiddleware(db *pgxpool.Pool, opts IdempotencyOptions) alice.Constructor {
+	if opts.TTL <= 0 {
+		opts.TTL = time.Hour * 24
+	}
+
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = time.Minute
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := RequestLogger(r)
+			key := r.Header.Get(IdempotencyKeyHeader)
+
+			if key == "" && !opts.Required {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if key == "" || len(key) > maxIdempotencyKeyLength {
+				idempotencyError(w, r, utils.CodeBadRequest, "A valid Idempotency-Key header is required", http.StatusBadRequest)
+				return
+			}
+
+			maxBytes := RequestBodyLimit(r)
+
+			if maxBytes <= 0 {
+				maxBytes = utils.DefaultMaxBodyBytes
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+
+			if err != nil {
+				utils.WriteProblem(w, r, utils.NewProblem(http.StatusRequestEntityTooLarge, utils.CodeBodyTooLarge, "Request body too large"))
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			scope := idempotencyScope(r)
+
+			record, claimed, err := idempotency.Begin(r.Context(), scope, key, fingerprint(r, body), opts.TTL, opts.LockTimeout, db)
+
+			switch {
+			case errors.Is(err, idempotency.ErrFingerprintMismatch):
+				idempotencyError(w, r, utils.CodeIdempotencyMismatch, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+				return
+			case errors.Is(err, idempotency.ErrInFlight):
+				idempotencyError(w, r, utils.CodeIdempotencyInFlight, "A request with this Idempotency-Key is in flight", http.StatusConflict)
+				return
+			case err != nil:
+				logger.Error("Error claiming idempotency key", slog.Any("err", err))
+				ServerError(w, r)
+				return
+			}
+
+			if !claimed {
+				if opts.Seal != nil {
+					if record.Body, err = openSealed(opts.Seal, scope, key, record.Body); err != nil {
+						// Replaying is the only safe answer, running the request again could repeat its effects
+						logger.Error("Error opening idempotent response", slog.Any("err", err))
+						ServerError(w, r)
+						return
+					}
+				}
+
+				maps.Copy(w.Header(), record.Header)
+				w.Header().Set(IdempotentReplayedHeader, "true")
+				w.WriteHeader(*record.Status)
+				w.Write(record.Body)
+				return
+			}
+
+			before := w.Header().Clone()
+			rec := &recordingWriter{ResponseWriter: w}
+
+			// The outcome has to be stored even if the client went away mid request
+			ctx := context.WithoutCancel(r.Context())
+
+			defer func() {
+				// Free the key right away for a retry, RecoveryMiddleware answers the panic further up
+				if recovered := recover(); recovered != nil {
+					idempotency.Release(ctx, scope, key, db)
+					panic(recovered)
+				}
+			}()
+
+			next.ServeHTTP(rec, r)
+
+			if !replayable(rec.status) {
+				if err := idempotency.Release(ctx, scope, key, db); err != nil {
+					logger.Error("Error releasing idempotency key", slog.Any("err", err))
+				}
+
+				return
+			}
+
+			stored := rec.body.Bytes()
+
+			if opts.Seal != nil {
+				stored = seal(opts.Seal, scope, key, stored)
+			}
+
+			if err := idempotency.Complete(ctx, scope, key, rec.status, addedHeaders(before, w.Header()), stored, db); err != nil {
+				logger.Error("Error storing idempotent response", slog.Any("err", err))
+			}
+		})
+	}
+}
+
+// Idempotent documents the Idempotency-Key header and its error responses on a route.
+// It must come after the route's own responses, whose descriptions are extended for shared status codes
+func Idempotent() option.OperationOption {
+	return func(oc *option.OperationConfig) {
+		option.Request(new(IdempotencyHeaders))(oc)
+
+		// document adds the response, or appends the idempotency cause to the one the route already documents
+		document := func(status int, description string) {
+			documented := false
+
+			for _, cu := range oc.Responses {
+				if cu.HTTPStatus == status {
+					cu.Description += ", or " + description
+					documented = true
+				}
+			}
+
+			if !documented {
+				ProblemResponse(status, strings.ToUpper(description[:1])+description[1:])(oc)
+			}
+		}
+
+		document(http.StatusConflict, fmt.Sprintf("a request with the same Idempotency-Key is in flight (%s)", utils.CodeIdempotencyInFlight))
+		document(http.StatusUnprocessableEntity, fmt.Sprintf("the Idempotency-Key was used with a different request (%s)", utils.CodeIdempotencyMismatch))
+	}
+}
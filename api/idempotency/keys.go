@@ -0,0 +1,95 @@
+// Package idempotency stores the outcome of requests sent with an Idempotency-Key so retries can be replayed
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrFingerprintMismatch = errors.New("idempotency key reused with a different request")
+var ErrInFlight = errors.New("a request with this idempotency key is in flight")
+
+// Record is a stored request outcome. Status is nil while the request is in flight
+type Record struct {
+	Scope       string
+	Key         string
+	Fingerprint []byte
+	Status      *int
+	Header      http.Header
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// Begin claims key for a new request. When the key was already used it returns the stored record and false,
+// or ErrFingerprintMismatch / ErrInFlight when it can't be replayed.
+// Expired records and in-flight claims older than lockTimeout, left by crashed requests, are taken over
+func Begin(ctx context.Context, scope, key string, fingerprint []byte, ttl, lockTimeout time.Duration, db *pgxpool.Pool) (Record, bool, error) {
+	var record Record
+
+	err := db.QueryRow(ctx, `
+		INSERT INTO idempotency_keys (scope, key, fingerprint, expires_at)
+		VALUES ($1, $2, $3, now() + make_interval(secs => $4))
+		ON CONFLICT (scope, key) DO UPDATE
+			SET fingerprint = EXCLUDED.fingerprint, status = NULL, headers = NULL, body = NULL,
+				created_at = now(), expires_at = EXCLUDED.expires_at
+			WHERE idempotency_keys.expires_at <= now()
+				OR (idempotency_keys.status IS NULL AND idempotency_keys.created_at <= now() - make_interval(secs => $5))
+		RETURNING scope, key, fingerprint, created_at, expires_at`,
+		scope, key, fingerprint, ttl.Seconds(), lockTimeout.Seconds(),
+	).Scan(&record.Scope, &record.Key, &record.Fingerprint, &record.CreatedAt, &record.ExpiresAt)
+
+	if err == nil {
+		return record, true, nil
+	}
+
+	if err != pgx.ErrNoRows {
+		return Record{}, false, err
+	}
+
+	err = db.QueryRow(ctx, "SELECT scope, key, fingerprint, status, headers, body, created_at, expires_at FROM idempotency_keys WHERE scope = $1 AND key = $2", scope, key).
+		Scan(&record.Scope, &record.Key, &record.Fingerprint, &record.Status, &record.Header, &record.Body, &record.CreatedAt, &record.ExpiresAt)
+
+	if err != nil {
+		return Record{}, false, err
+	}
+
+	if !bytes.Equal(record.Fingerprint, fingerprint) {
+		return Record{}, false, ErrFingerprintMismatch
+	}
+
+	if record.Status == nil {
+		return Record{}, false, ErrInFlight
+	}
+
+	return record, false, nil
+}
+
+// Complete stores the response of a request claimed with Begin
+func Complete(ctx context.Context, scope, key string, status int, header http.Header, body []byte, db *pgxpool.Pool) error {
+	_, err := db.Exec(ctx, "UPDATE idempotency_keys SET status = $3, headers = $4, body = $5 WHERE scope = $1 AND key = $2", scope, key, status, header, body)
+	return err
+}
+
+// Release forgets a claim so the request can be retried, for outcomes that shouldn't be replayed
+func Release(ctx context.Context, scope, key string, db *pgxpool.Pool) error {
+	_, err := db.Exec(ctx, "DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND status IS NULL", scope, key)
+	return err
+}
+
+// PurgeExpired deletes expired records
+func PurgeExpired(ctx context.Context, db *pgxpool.Pool) (int64, error) {
+	tag, err := db.Exec(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= now()")
+
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
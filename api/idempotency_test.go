@@ -0,0 +1,37 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api"
+)
+
+func TestIdempotencyKeyIsOptOut(t *testing.T) {
+	handler := api.IdempotencyMiddleware(nil, api.IdempotencyOptions{})(http.HandlerFunc(okHandler))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/orgs", strings.NewReader("{}")))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected request without a key to pass through, got %d", rec.Code)
+	}
+}
+
+func TestIdempotencyKeyValidation(t *testing.T) {
+	handler := api.IdempotencyMiddleware(nil, api.IdempotencyOptions{Required: true})(http.HandlerFunc(okHandler))
+
+	for _, key := range []string{"", strings.Repeat("k", 300)} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/orgs", strings.NewReader("{}"))
+		req.Header.Set(api.IdempotencyKeyHeader, key)
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected key of length %d to be rejected, got %d", len(key), rec.Code)
+		}
+	}
+}
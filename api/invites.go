@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/invites"
+	"github.com/maybemaby/oapibase/api/orgs"
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+type InviteHandler struct {
+	jwtManager *auth.JwtManager
+	invites    *invites.Manager
+	pool       *pgxpool.Pool
+}
+
+type InvitePath struct {
+	InviteId int `path:"inviteId" json:"-"`
+}
+
+type OrgInvitePath struct {
+	OrgId    int `path:"orgId" json:"-"`
+	InviteId int `path:"inviteId" json:"-"`
+}
+
+type CreateInviteBody struct {
+	Email string `json:"email" format:"email" required:"true" example:"email@site.com"`
+	// Role is the global role granted on acceptance
+	Role *string `json:"role,omitempty" enum:"user,admin"`
+}
+
+type CreateOrgInviteBody struct {
+	OrgPath
+	Email string    `json:"email" format:"email" required:"true" example:"email@site.com"`
+	Role  orgs.Role `json:"role" enum:"owner,admin,member" required:"true"`
+}
+
+type AcceptInviteBody struct {
+	Token string `json:"token" required:"true"`
+}
+
+// verifyInvite checks that the token was issued for email and that its invite is still usable
+func verifyInvite(ctx context.Context, manager *invites.Manager, token, email string, db *pgxpool.Pool) (invites.Invite, error) {
+	claims, err := manager.CheckToken(token, email)
+
+	if err != nil {
+		return invites.Invite{}, err
+	}
+
+	inv, err := invites.GetInvite(ctx, claims.InviteId, db)
+
+	if err != nil {
+		return invites.Invite{}, err
+	}
+
+	return inv, inv.Usable(time.Now())
+}
+
+// inviteUnusable tells whether AcceptInvite failed because the invite can no longer be accepted
+func inviteUnusable(err error) bool {
+	return errors.Is(err, invites.ErrInviteNotFound) || errors.Is(err, invites.ErrInviteAccepted) ||
+		errors.Is(err, invites.ErrInviteRevoked) || errors.Is(err, invites.ErrInviteExpired)
+}
+
+// invitedSession grants sessData the role and org of an invite the user just accepted
+func invitedSession(sessData auth.SessionData, inv invites.Invite) auth.SessionData {
+	if inv.Role != nil {
+		sessData.Role = *inv.Role
+	}
+
+	if inv.OrganizationId != nil {
+		sessData.OrgId = *inv.OrganizationId
+	}
+
+	return sessData
+}
+
+// create inserts and delivers an invite, an undelivered invite is rolled back so a retry doesn't leave a duplicate
+func (h *InviteHandler) create(ctx context.Context, insert invites.InviteInsert) (invites.Invite, error) {
+	tx, err := h.pool.Begin(ctx)
+
+	if err != nil {
+		return invites.Invite{}, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	inv, err := invites.CreateInvite(ctx, insert, tx)
+
+	if err != nil {
+		return inv, err
+	}
+
+	if err := h.invites.Deliver(ctx, inv); err != nil {
+		return inv, fmt.Errorf("delivering invite %d: %w", inv.ID, err)
+	}
+
+	return inv, tx.Commit(ctx)
+}
+
+// CreateInvite invites an email to the app, optionally with a global role
+func (h *InviteHandler) CreateInvite(ctx context.Context, data CreateInviteBody) (invites.Invite, error) {
+	sess, _ := auth.ContextUser(ctx)
+
+	return h.create(ctx, invites.InviteInsert{
+		Email:     data.Email,
+		Role:      data.Role,
+		InvitedBy: sess.UserId,
+		ExpiresAt: h.invites.ExpiresAt(),
+	})
+}
+
+// CreateOrgInvite invites an email to the organization resolved by orgs.RequireMembership
+func (h *InviteHandler) CreateOrgInvite(ctx context.Context, data CreateOrgInviteBody) (invites.Invite, error) {
+	membership, _ := orgs.ContextMembership(ctx)
+
+	// Only owners can hand out ownership
+	if data.Role == orgs.RoleOwner && membership.Role != orgs.RoleOwner {
+		return invites.Invite{}, utils.Forbidden()
+	}
+
+	orgRole := string(data.Role)
+
+	return h.create(ctx, invites.InviteInsert{
+		Email:          data.Email,
+		OrganizationId: &membership.OrganizationId,
+		OrgRole:        &orgRole,
+		InvitedBy:      membership.UserId,
+		ExpiresAt:      h.invites.ExpiresAt(),
+	})
+}
+
+// requestInviteScope returns the organization the invite routes are scoped to, nil for app wide invites
+func requestInviteScope(ctx context.Context) *int {
+	membership, err := orgs.ContextMembership(ctx)
+
+	if err != nil {
+		return nil
+	}
+
+	return &membership.OrganizationId
+}
+
+func (h *InviteHandler) ListInvites(w http.ResponseWriter, r *http.Request) {
+	logger := RequestLogger(r)
+
+	q, err := invites.PendingList.Parse(r)
+
+	if err != nil {
+		writeOpError(w, r, err)
+		return
+	}
+
+	page, err := invites.ListPendingInvites(r.Context(), requestInviteScope(r.Context()), q, h.pool)
+
+	if err != nil {
+		logger.Error("Error listing invites", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	page.SetLinkHeader(w.Header())
+
+	if err := utils.WriteResponse(w, r, http.StatusOK, page); err != nil {
+		logger.Error("Error encoding response", slog.Any("err", err))
+	}
+}
+
+func (h *InviteHandler) RevokeInvite(ctx context.Context, data InvitePath) (Empty, error) {
+	err := invites.RevokeInvite(ctx, data.InviteId, requestInviteScope(ctx), h.pool)
+
+	if err == invites.ErrInviteNotFound {
+		return Empty{}, utils.NotFound("Invite not found")
+	}
+
+	return Empty{}, err
+}
+
+// RevokeOrgInvite is RevokeInvite for the invites of the organization resolved by orgs.RequireMembership
+func (h *InviteHandler) RevokeOrgInvite(ctx context.Context, data OrgInvitePath) (Empty, error) {
+	return h.RevokeInvite(ctx, InvitePath{InviteId: data.InviteId})
+}
+
+// AcceptInvite applies an invite to the current user and issues tokens carrying the granted role and org
+func (h *InviteHandler) AcceptInvite(ctx context.Context, data AcceptInviteBody) (LoginJwtResponse, error) {
+	sess, _ := auth.ContextUser(ctx)
+
+	user, err := auth.GetUserById(ctx, sess.UserId, h.pool)
+
+	if err != nil || user.Email == nil {
+		return LoginJwtResponse{}, utils.Unauthorized()
+	}
+
+	inv, err := verifyInvite(ctx, h.invites, data.Token, *user.Email, h.pool)
+
+	if err != nil {
+		return LoginJwtResponse{}, utils.BadRequest(utils.CodeInvalidInvite, "Invalid invite")
+	}
+
+	inv, err = invites.AcceptInvite(ctx, inv.ID, user.ID, h.pool)
+
+	if inviteUnusable(err) {
+		return LoginJwtResponse{}, utils.BadRequest(utils.CodeInvalidInvite, "Invalid invite")
+	}
+
+	if err != nil {
+		return LoginJwtResponse{}, err
+	}
+
+	// Accepting an invite isn't logging in, the session keeps its auth_time
+	return issueTokens(h.jwtManager, invitedSession(auth.SessionData{UserId: user.ID, Role: user.Role, AuthTime: sess.AuthTime}, inv))
+}
@@ -0,0 +1,227 @@
+package invites
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/maybemaby/oapibase/api/paginate"
+	"github.com/maybemaby/oapibase/api/userdata"
+)
+
+func init() {
+	userdata.Register("invitations", exportInvites)
+}
+
+var ErrInviteNotFound = errors.New("invite not found")
+var ErrInviteExpired = errors.New("invite expired")
+var ErrInviteRevoked = errors.New("invite revoked")
+var ErrInviteAccepted = errors.New("invite already accepted")
+var ErrInviteEmailMismatch = errors.New("invite was issued for a different email")
+
+type Invite struct {
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+	// Role is the global user role granted on acceptance, nil keeps the default
+	Role           *string    `json:"role"`
+	OrganizationId *int       `json:"organizationId"`
+	OrgRole        *string    `json:"organizationRole"`
+	InvitedBy      *int       `json:"invitedBy"`
+	ExpiresAt      time.Time  `json:"expiresAt"`
+	RevokedAt      *time.Time `json:"revokedAt"`
+	AcceptedAt     *time.Time `json:"acceptedAt"`
+	CreatedAt      time.Time  `json:"createdAt"`
+}
+
+type InviteInsert struct {
+	Email          string
+	Role           *string
+	OrganizationId *int
+	OrgRole        *string
+	InvitedBy      int
+	ExpiresAt      time.Time
+}
+
+const inviteColumns = "id, email, role, organization_id, organization_role, invited_by, expires_at, revoked_at, accepted_at, created_at"
+
+func scanInvite(row pgx.Row) (Invite, error) {
+	var inv Invite
+
+	err := row.Scan(&inv.ID, &inv.Email, &inv.Role, &inv.OrganizationId, &inv.OrgRole, &inv.InvitedBy,
+		&inv.ExpiresAt, &inv.RevokedAt, &inv.AcceptedAt, &inv.CreatedAt)
+
+	return inv, err
+}
+
+// Usable checks that the invite can still be accepted
+func (inv Invite) Usable(now time.Time) error {
+	if inv.AcceptedAt != nil {
+		return ErrInviteAccepted
+	}
+	if inv.RevokedAt != nil {
+		return ErrInviteRevoked
+	}
+	if now.After(inv.ExpiresAt) {
+		return ErrInviteExpired
+	}
+	return nil
+}
+
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Querier runs a query on a pool or inside a transaction
+type Querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// CreateInvite inserts an invite. Pass a pgx.Tx to only keep it once the caller delivered it
+func CreateInvite(ctx context.Context, insert InviteInsert, db Querier) (Invite, error) {
+	row := db.QueryRow(ctx, `INSERT INTO invitations (email, role, organization_id, organization_role, invited_by, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING `+inviteColumns,
+		NormalizeEmail(insert.Email), insert.Role, insert.OrganizationId, insert.OrgRole, insert.InvitedBy, insert.ExpiresAt)
+
+	return scanInvite(row)
+}
+
+func GetInvite(ctx context.Context, id int, db *pgxpool.Pool) (Invite, error) {
+	inv, err := scanInvite(db.QueryRow(ctx, "SELECT "+inviteColumns+" FROM invitations WHERE id = $1", id))
+
+	if err == pgx.ErrNoRows {
+		return Invite{}, ErrInviteNotFound
+	}
+
+	return inv, err
+}
+
+// PendingList is how pending invites are paginated, sorted and filtered
+var PendingList = &paginate.List{
+	Columns: []paginate.Column{
+		{Name: "id", SQL: "id", Type: paginate.Integer, Sortable: true},
+		{Name: "email", SQL: "email", Type: paginate.String, Sortable: true, Filters: []paginate.Operator{paginate.Eq}},
+		{Name: "role", SQL: "role", Type: paginate.String, Filters: []paginate.Operator{paginate.Eq}},
+		{Name: "createdAt", SQL: "created_at", Type: paginate.Time, Sortable: true,
+			Filters: []paginate.Operator{paginate.Gte, paginate.Lt}},
+		{Name: "expiresAt", SQL: "expires_at", Type: paginate.Time, Sortable: true,
+			Filters: []paginate.Operator{paginate.Gte, paginate.Lt}},
+	},
+	Sort: "-createdAt",
+	Key:  "id",
+}
+
+// ListPendingInvites lists a page of the invites that are neither accepted nor revoked, see PendingList.
+// A nil orgId lists invites that are not tied to an organization
+func ListPendingInvites(ctx context.Context, orgId *int, q *paginate.Query, db *pgxpool.Pool) (paginate.Page[Invite], error) {
+	return paginate.Fetch(ctx, db, q, func(row pgx.CollectableRow) (Invite, error) { return scanInvite(row) },
+		"SELECT "+inviteColumns+` FROM invitations
+	WHERE organization_id IS NOT DISTINCT FROM $1 AND accepted_at IS NULL AND revoked_at IS NULL`, orgId)
+}
+
+// RevokeInvite marks a pending invite as revoked. orgId scopes the lookup the same way as ListPendingInvites
+func RevokeInvite(ctx context.Context, id int, orgId *int, db *pgxpool.Pool) error {
+	tag, err := db.Exec(ctx, `UPDATE invitations SET revoked_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND organization_id IS NOT DISTINCT FROM $2 AND accepted_at IS NULL AND revoked_at IS NULL`, id, orgId)
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrInviteNotFound
+	}
+
+	return nil
+}
+
+// exportInvites returns the invites the user sent or accepted
+func exportInvites(ctx context.Context, userId int, db *pgxpool.Pool) (any, error) {
+	rows, err := db.Query(ctx, "SELECT "+inviteColumns+` FROM invitations
+	WHERE invited_by = $1 OR accepted_by = $1
+	ORDER BY created_at`, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	invites := []Invite{}
+
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		invites = append(invites, inv)
+	}
+
+	return invites, rows.Err()
+}
+
+// Beginner starts transactions, *pgxpool.Pool does and so does pgx.Tx with a savepoint
+type Beginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// AcceptInvite applies the invited role and organization membership to the user and marks the invite as accepted.
+// The invite row is locked so concurrent acceptances of the same invite can't both succeed.
+// Pass a pgx.Tx to accept it along with the caller's writes, e.g. creating the user
+func AcceptInvite(ctx context.Context, id int, userId int, db Beginner) (Invite, error) {
+	tx, err := db.Begin(ctx)
+
+	if err != nil {
+		return Invite{}, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	inv, err := scanInvite(tx.QueryRow(ctx, "SELECT "+inviteColumns+" FROM invitations WHERE id = $1 FOR UPDATE", id))
+
+	if err == pgx.ErrNoRows {
+		return Invite{}, ErrInviteNotFound
+	}
+
+	if err != nil {
+		return Invite{}, err
+	}
+
+	if err := inv.Usable(time.Now()); err != nil {
+		return Invite{}, err
+	}
+
+	if inv.Role != nil {
+		if _, err := tx.Exec(ctx, "UPDATE users SET role = $1 WHERE id = $2", *inv.Role, userId); err != nil {
+			return Invite{}, err
+		}
+	}
+
+	if inv.OrganizationId != nil {
+		// Existing members keep their current role, an invite never demotes
+		_, err := tx.Exec(ctx, `INSERT INTO memberships (organization_id, user_id, role) VALUES ($1, $2, COALESCE($3, 'member'))
+		ON CONFLICT (organization_id, user_id) DO NOTHING`, *inv.OrganizationId, userId, inv.OrgRole)
+
+		if err != nil {
+			return Invite{}, err
+		}
+	}
+
+	err = tx.QueryRow(ctx, "UPDATE invitations SET accepted_at = CURRENT_TIMESTAMP, accepted_by = $2 WHERE id = $1 RETURNING accepted_at", id, userId).
+		Scan(&inv.AcceptedAt)
+
+	if err != nil {
+		return Invite{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return Invite{}, err
+	}
+
+	return inv, nil
+}
@@ -0,0 +1,122 @@
+package invites
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/maybemaby/oapibase/api/mail"
+)
+
+type InviteTokenClaims struct {
+	InviteId int    `json:"invite_id"`
+	Email    string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+type Manager struct {
+	TokenSecret []byte
+	Lifetime    time.Duration
+	// AcceptURL is the frontend page receiving the token in its "invite" query parameter
+	AcceptURL string
+	Mailer    mail.Mailer
+	// InviteOnly rejects signups without a valid invite
+	InviteOnly bool
+	// AllowedDomains lets emails on these domains sign up without an invite when InviteOnly is set
+	AllowedDomains []string
+}
+
+// EncodeToken signs a token for the invite, expiring along with it.
+// The token only proves possession, revocation and acceptance are tracked on the invite row
+func (m *Manager) EncodeToken(inv Invite) (string, error) {
+	claims := InviteTokenClaims{
+		InviteId: inv.ID,
+		Email:    inv.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(inv.ExpiresAt),
+			Subject:   strconv.Itoa(inv.ID),
+			Issuer:    "go-auth-snippets",
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	return token.SignedString(m.TokenSecret)
+}
+
+func (m *Manager) ValidateToken(tokenString string) (*InviteTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &InviteTokenClaims{}, func(token *jwt.Token) (any, error) {
+		return m.TokenSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+
+	if err != nil || !token.Valid {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*InviteTokenClaims)
+
+	if !ok {
+		return nil, jwt.ErrTokenMalformed
+	}
+
+	return claims, nil
+}
+
+// CheckToken validates the token and that it was issued for email
+func (m *Manager) CheckToken(tokenString, email string) (*InviteTokenClaims, error) {
+	claims, err := m.ValidateToken(tokenString)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Email != NormalizeEmail(email) {
+		return nil, ErrInviteEmailMismatch
+	}
+
+	return claims, nil
+}
+
+func (m *Manager) ExpiresAt() time.Time {
+	return time.Now().Add(m.Lifetime)
+}
+
+// Deliver sends the invite link to the invited email
+func (m *Manager) Deliver(ctx context.Context, inv Invite) error {
+	token, err := m.EncodeToken(inv)
+
+	if err != nil {
+		return err
+	}
+
+	link := m.AcceptURL
+
+	if strings.Contains(link, "?") {
+		link += "&invite=" + url.QueryEscape(token)
+	} else {
+		link += "?invite=" + url.QueryEscape(token)
+	}
+
+	return m.Mailer.Send(ctx, mail.Message{
+		To:      inv.Email,
+		Subject: "You have been invited",
+		Text: fmt.Sprintf("You have been invited to join. Accept the invite before %s:\n\n%s\n",
+			inv.ExpiresAt.Format(time.RFC1123), link),
+	})
+}
+
+// SignupAllowed reports whether email may register without an invite
+func (m *Manager) SignupAllowed(email string) bool {
+	if !m.InviteOnly {
+		return true
+	}
+
+	_, domain, ok := strings.Cut(NormalizeEmail(email), "@")
+
+	return ok && slices.Contains(m.AllowedDomains, domain)
+}
@@ -0,0 +1,77 @@
+package invites_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/maybemaby/oapibase/api/invites"
+)
+
+func bootstrapManager() *invites.Manager {
+	return &invites.Manager{
+		TokenSecret:    []byte("very-long-invite-secret"),
+		Lifetime:       time.Hour,
+		InviteOnly:     true,
+		AllowedDomains: []string{"site.com"},
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	manager := bootstrapManager()
+
+	token, err := manager.EncodeToken(invites.Invite{
+		ID:        4,
+		Email:     "email@site.com",
+		ExpiresAt: manager.ExpiresAt(),
+	})
+
+	if err != nil {
+		t.Fatalf("Failed to encode token: %v", err)
+	}
+
+	claims, err := manager.CheckToken(token, " Email@Site.com")
+
+	if err != nil {
+		t.Fatalf("Expected token to be valid, got %v", err)
+	}
+
+	if claims.InviteId != 4 {
+		t.Errorf("Expected invite id 4, got %d", claims.InviteId)
+	}
+
+	if _, err := manager.CheckToken(token, "other@site.com"); err != invites.ErrInviteEmailMismatch {
+		t.Errorf("Expected ErrInviteEmailMismatch, got %v", err)
+	}
+}
+
+func TestCheckTokenExpired(t *testing.T) {
+	manager := bootstrapManager()
+
+	token, _ := manager.EncodeToken(invites.Invite{
+		ID:        1,
+		Email:     "email@site.com",
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+
+	if _, err := manager.CheckToken(token, "email@site.com"); err == nil {
+		t.Error("Expected expired token to be rejected")
+	}
+}
+
+func TestSignupAllowed(t *testing.T) {
+	manager := bootstrapManager()
+
+	if !manager.SignupAllowed("someone@SITE.com") {
+		t.Error("Expected allowlisted domain to be allowed")
+	}
+
+	if manager.SignupAllowed("someone@other.com") {
+		t.Error("Expected other domain to be rejected in invite only mode")
+	}
+
+	manager.InviteOnly = false
+
+	if !manager.SignupAllowed("someone@other.com") {
+		t.Error("Expected any domain to be allowed when not invite only")
+	}
+}
@@ -1,70 +1,153 @@
 package api
 
 import (
+	"bufio"
 	"context"
 	"log/slog"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/justinas/alice"
-	"github.com/unrolled/secure"
+	"github.com/maybemaby/oapibase/api/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var RequestIdHeader = "X-Request-Id"
 
+// maxRequestIdLength caps accepted incoming request IDs, longer ones are replaced
+const maxRequestIdLength = 128
+
 type RequestLoggerContextKey string
+type RequestIdContextKey string
 
 const RequestLoggerKey RequestLoggerContextKey = "logger"
+const RequestIdKey RequestIdContextKey = "request_id"
 
 type statusRecorder struct {
 	http.ResponseWriter
-	status int
+	status      int
+	wroteHeader bool
 }
 
 func (r *statusRecorder) WriteHeader(status int) {
-	r.status = status
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+
 	r.ResponseWriter.WriteHeader(status)
 }
 
-func CorsMiddleware(origin string) alice.Constructor {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
 
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-User-Agent, Cache-Control")
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
 
-			if r.Method == "OPTIONS" {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		r.wroteHeader = true
+		flusher.Flush()
+	}
+}
 
-			next.ServeHTTP(w, r)
-		})
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, http.ErrNotSupported
 	}
+
+	return hijacker.Hijack()
 }
 
+// validRequestId accepts short IDs made of characters safe to log and echo back
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+
+	for _, c := range id {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+
+		if !isAlnum && !strings.ContainsRune("-_.:", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RequestIdMiddleware keeps a valid incoming X-Request-Id or generates one,
+// echoes it in the response and stores it in the request context
 func RequestIdMiddleware() alice.Constructor {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestId := r.Header.Get(RequestIdHeader)
+
+			if !validRequestId(requestId) {
+				requestId = uuid.New().String()
+				r.Header.Set(RequestIdHeader, requestId)
+			}
+
+			w.Header().Set(RequestIdHeader, requestId)
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request_id", requestId))
 
-			r.Header.Set(RequestIdHeader, uuid.New().String())
-			next.ServeHTTP(w, r)
+			ctx := context.WithValue(r.Context(), RequestIdKey, requestId)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+func init() {
+	// Problems carry the request ID so clients can quote it to support
+	utils.RequestIdFunc = RequestId
+}
+
+// RequestId returns the ID assigned by RequestIdMiddleware, empty if it hasn't run
+func RequestId(r *http.Request) string {
+	requestId, _ := r.Context().Value(RequestIdKey).(string)
+	return requestId
+}
+
+// TraceIds returns the OTel trace and span IDs of the request, empty when it isn't traced
+func TraceIds(r *http.Request) (traceId string, spanId string) {
+	spanCtx := trace.SpanContextFromContext(r.Context())
+
+	if !spanCtx.IsValid() {
+		return "", ""
+	}
+
+	return spanCtx.TraceID().String(), spanCtx.SpanID().String()
+}
+
 func LoggingMiddleware(logger *slog.Logger) alice.Constructor {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			rec := &statusRecorder{w, http.StatusOK}
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
 			url := r.URL.String()
-			requestId := r.Header.Get(RequestIdHeader)
+			requestId := RequestId(r)
 			method := r.Method
 
-			_logger := logger.WithGroup("request").With(slog.String("url", url), slog.String("method", method), slog.String("request_id", requestId))
+			attrs := []any{slog.String("url", url), slog.String("method", method), slog.String("request_id", requestId)}
+
+			if ip := ClientIP(r); ip.IsValid() {
+				attrs = append(attrs, slog.String("client_ip", ip.String()))
+			}
+
+			if traceId, spanId := TraceIds(r); traceId != "" {
+				attrs = append(attrs, slog.String("trace_id", traceId), slog.String("span_id", spanId))
+			}
+
+			_logger := logger.WithGroup("request").With(attrs...)
 
 			_logger.Info("Request received")
 
@@ -78,20 +161,46 @@ func LoggingMiddleware(logger *slog.Logger) alice.Constructor {
 	}
 }
 
+// RequestLogger returns the logger set by LoggingMiddleware, falling back to slog.Default outside of it
 func RequestLogger(request *http.Request) *slog.Logger {
-	return request.Context().Value(RequestLoggerKey).(*slog.Logger)
+	return ContextLogger(request.Context())
+}
+
+// ContextLogger is RequestLogger for code that only has the request context, like an OpFunc
+func ContextLogger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(RequestLoggerKey).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
 }
 
+// MiddlewareConfig configures RootMiddleware. CORS and security headers are not part of the chain,
+// see CorsMiddleware and SecurityHeadersMiddleware
 type MiddlewareConfig struct {
-	CorsOrigin string
+	// MaxBodyBytes is the default decoded body size, routes can change it with BodyLimit
+	MaxBodyBytes int64
+	// HandlerTimeout bounds every route, zero leaves requests unbounded
+	HandlerTimeout time.Duration
+	// WriteTimeout replaces the server's write deadline for the chain's routes, see WriteDeadline
+	WriteTimeout time.Duration
 }
 
 func RootMiddleware(logger *slog.Logger, cfg MiddlewareConfig) alice.Chain {
 
-	secureMw := secure.New(secure.Options{
-		AllowedHosts:      []string{},
-		HostsProxyHeaders: []string{"X-Forwarded-Host"},
-	})
+	chain := alice.New(RequestIdMiddleware(), LoggingMiddleware(logger), RecoveryMiddleware())
+
+	if cfg.MaxBodyBytes > 0 {
+		chain = chain.Append(BodyLimit(cfg.MaxBodyBytes))
+	}
+
+	if cfg.HandlerTimeout > 0 {
+		chain = chain.Append(HandlerTimeout(cfg.HandlerTimeout))
+	}
+
+	if cfg.WriteTimeout > 0 {
+		chain = chain.Append(WriteDeadline(cfg.WriteTimeout))
+	}
 
-	return alice.New(RequestIdMiddleware(), LoggingMiddleware(logger), CorsMiddleware(cfg.CorsOrigin), secureMw.Handler)
+	return chain
 }
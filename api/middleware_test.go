@@ -0,0 +1,85 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api"
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+func requestIdHandler(seen *string) http.Handler {
+	return api.RequestIdMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*seen = api.RequestId(r)
+	}))
+}
+
+func TestRequestIdKeepsValidIncomingId(t *testing.T) {
+	var seen string
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(api.RequestIdHeader, "client-abc_123")
+
+	requestIdHandler(&seen).ServeHTTP(rec, req)
+
+	if seen != "client-abc_123" {
+		t.Errorf("Expected incoming id in context, got %q", seen)
+	}
+
+	if got := rec.Header().Get(api.RequestIdHeader); got != "client-abc_123" {
+		t.Errorf("Expected incoming id to be echoed, got %q", got)
+	}
+}
+
+func TestRequestIdReplacesInvalidId(t *testing.T) {
+	for _, incoming := range []string{"", "bad id\nwith newline", strings.Repeat("a", 200)} {
+		var seen string
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(api.RequestIdHeader, incoming)
+
+		requestIdHandler(&seen).ServeHTTP(rec, req)
+
+		if seen == "" || seen == incoming {
+			t.Errorf("Expected %q to be replaced, got %q", incoming, seen)
+		}
+
+		if got := rec.Header().Get(api.RequestIdHeader); got != seen {
+			t.Errorf("Expected generated id %q to be echoed, got %q", seen, got)
+		}
+	}
+}
+
+func TestRecoveryWritesServerError(t *testing.T) {
+	handler := api.RecoveryMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status %d, got %d", http.StatusInternalServerError, rec.Code)
+	}
+
+	if rec.Header().Get("Content-Type") != utils.ProblemContentType {
+		t.Errorf("Expected a problem body, got %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestRecoveryAbortsStartedResponse(t *testing.T) {
+	handler := api.RecoveryMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic("boom")
+	}))
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("Expected ErrAbortHandler, got %v", recovered)
+		}
+	}()
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
@@ -1,46 +1,134 @@
 package api
 
-import "github.com/oaswrap/spec/option"
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
 
-func Responses(responses map[int]any) option.OperationOption {
+	"github.com/maybemaby/oapibase/api/utils"
+	"github.com/oaswrap/spec/option"
+	"github.com/swaggest/openapi-go"
+	"github.com/swaggest/openapi-go/openapi3"
+	"github.com/swaggest/openapi-go/openapi31"
+)
 
-	return func(oc *option.OperationConfig) {
-		for code, schema := range responses {
-			option.Response(code, schema)(oc)
+// encoded documents a schema under several media types. The reflector only writes the
+// application/json entry, the others get a copy of it since every codec reads the json tags
+type encoded struct {
+	structure  any
+	mediaTypes []string
+}
+
+func (e encoded) SetupContentUnit(cu *openapi.ContentUnit) {
+	cu.Structure = e.structure
+	cu.Customize = func(cor openapi.ContentOrReference) {
+		switch content := cor.(type) {
+		case *openapi3.RequestBodyOrRef:
+			if content.RequestBody != nil {
+				shareContent(content.RequestBody.Content, e.mediaTypes)
+			}
+		case *openapi3.ResponseOrRef:
+			if content.Response != nil {
+				shareContent(content.Response.Content, e.mediaTypes)
+			}
+		case *openapi31.RequestBodyOrReference:
+			if content.RequestBody != nil {
+				shareContent(content.RequestBody.Content, e.mediaTypes)
+			}
+		case *openapi31.ResponseOrReference:
+			if content.Response != nil {
+				shareContent(content.Response.Content, e.mediaTypes)
+			}
 		}
 	}
+}
 
+func shareContent[MediaType any](content map[string]MediaType, mediaTypes []string) {
+	entry, ok := content["application/json"]
+
+	if !ok {
+		return
+	}
+
+	for _, mediaType := range mediaTypes {
+		content[mediaType] = entry
+	}
+
+	if !slices.Contains(mediaTypes, "application/json") {
+		delete(content, "application/json")
+	}
 }
 
-func ResponsesWithDefault(responses map[int]any) option.OperationOption {
+// Encoded wraps a request or response schema so it is documented under mediaTypes,
+// by default every media type of utils.Codecs
+func Encoded(structure any, mediaTypes ...string) any {
+	if len(mediaTypes) == 0 {
+		mediaTypes = utils.Codecs.MediaTypes()
+	}
+
+	return encoded{structure: structure, mediaTypes: mediaTypes}
+}
+
+// Request documents the parameters and body of an operation, see Encoded for the body media types
+func Request(structure any, mediaTypes ...string) option.OperationOption {
+	return option.Request(Encoded(structure, mediaTypes...))
+}
+
+// ProblemResponse documents an error response of an operation as problem details
+func ProblemResponse(status int, description string) option.OperationOption {
+	return option.Response(status, new(utils.Problem),
+		option.ContentType(utils.ProblemContentType),
+		option.ContentDescription(description),
+	)
+}
+
+// Responses documents the responses of an operation. A string documents an error response as problem
+// details with the string as its description, nil a response without a body. Other schemas are
+// documented in every negotiable media type, with the 406, unless already wrapped by Encoded
+func Responses(responses map[int]any) option.OperationOption {
+
 	return func(oc *option.OperationConfig) {
-		option.Response(500, new(ServerErrorResponse))(oc)
+		negotiated := false
+
 		for code, schema := range responses {
+			if description, ok := schema.(string); ok {
+				ProblemResponse(code, description)(oc)
+				continue
+			}
+
+			if _, ok := schema.(encoded); !ok && schema != nil {
+				schema = Encoded(schema)
+				negotiated = true
+			}
+
 			option.Response(code, schema)(oc)
 		}
+
+		if _, ok := responses[http.StatusNotAcceptable]; negotiated && !ok {
+			ProblemResponse(http.StatusNotAcceptable, "Not acceptable")(oc)
+		}
 	}
-}
 
-type ServerErrorResponse struct {
-	Message string `json:"message" example:"Internal Server Error" required:"true"`
-	Status  int    `json:"status" enum:"500" required:"true"`
 }
 
-func DefaultServerErrorResponse() ServerErrorResponse {
-	return ServerErrorResponse{
-		Message: "Internal Server Error",
-		Status:  500,
+// ResponsesWithDefault is Responses plus the 500 every operation can return
+func ResponsesWithDefault(responses map[int]any) option.OperationOption {
+	return func(oc *option.OperationConfig) {
+		ProblemResponse(http.StatusInternalServerError, "Internal Server Error")(oc)
+		Responses(responses)(oc)
 	}
 }
 
-type AuthErrorResponse struct {
-	Message string `json:"message" example:"Unauthorized" required:"true"`
-	Status  int    `json:"status" enum:"401" required:"true"`
+// ServerError writes a 500 problem, or a 503 when the request ran out of time
+func ServerError(w http.ResponseWriter, r *http.Request) {
+	utils.WriteProblem(w, r, serverProblem(r))
 }
 
-func DefaultAuthErrorResponse() AuthErrorResponse {
-	return AuthErrorResponse{
-		Message: "Unauthorized",
-		Status:  401,
+func serverProblem(r *http.Request) *utils.Problem {
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		return utils.NewProblem(http.StatusServiceUnavailable, utils.CodeTimeout, "Request timed out")
 	}
+
+	return utils.NewProblem(http.StatusInternalServerError, utils.CodeInternal, "")
 }
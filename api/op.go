@@ -0,0 +1,431 @@
+package api
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/justinas/alice"
+	"github.com/maybemaby/oapibase/api/utils"
+	"github.com/maybemaby/oapibase/api/validate"
+	"github.com/oaswrap/spec/adapter/httpopenapi"
+	"github.com/oaswrap/spec/option"
+)
+
+// Empty is the request of operations without parameters or body, and the response of those answering 204
+type Empty struct{}
+
+// Validatable requests are checked after their jsonschema tags, for rules the tags can't express.
+// Field errors are answered with a 422
+type Validatable interface {
+	Validate() []utils.FieldError
+}
+
+// OpFunc handles a bound and validated request. Errors that are a *utils.Problem are written as is,
+// pgx.ErrNoRows becomes a 404 and anything else a 500
+type OpFunc[Req, Resp any] func(ctx context.Context, req Req) (Resp, error)
+
+// Operation adapts an OpFunc to an http.Handler and documents it from its request and response types
+type Operation[Req, Resp any] struct {
+	fn      OpFunc[Req, Resp]
+	status  int
+	decode  utils.DecodeOptions
+	request requestBinding
+	headers []responseHeader
+	// validates is set when Req has jsonschema rules or is Validatable
+	validates bool
+}
+
+// Op binds the path, query, header and cookie parameters of Req from their tags, and its json fields
+// from the body, then validates it. Resp is written in the negotiated encoding with a 200, or as a 204 when it is Empty.
+// It panics when the validation tags of Req can't be parsed
+func Op[Req, Resp any](fn OpFunc[Req, Resp]) *Operation[Req, Resp] {
+	status := http.StatusOK
+	validates, err := validate.Prepare(reflect.TypeFor[Req]())
+
+	if err != nil {
+		panic(err)
+	}
+
+	if _, ok := any(new(Req)).(Validatable); ok {
+		validates = true
+	}
+
+	if reflect.TypeFor[Resp]() == reflect.TypeFor[Empty]() {
+		status = http.StatusNoContent
+	}
+
+	return &Operation[Req, Resp]{
+		fn:        fn,
+		status:    status,
+		request:   bindingFor(reflect.TypeFor[Req]()),
+		headers:   responseHeadersFor(reflect.TypeFor[Resp]()),
+		validates: validates,
+	}
+}
+
+// Status sets the status of successful responses, e.g. 201 for creations
+func (op *Operation[Req, Resp]) Status(status int) *Operation[Req, Resp] {
+	op.status = status
+	return op
+}
+
+// Decode sets the options the body is decoded with, the max size comes from BodyLimit unless set
+func (op *Operation[Req, Resp]) Decode(opts utils.DecodeOptions) *Operation[Req, Resp] {
+	op.decode = opts
+	return op
+}
+
+// Mount registers the operation on router behind chain and documents its request and responses.
+// Options for other responses, Cacheable and Idempotent go in With on the returned route
+func (op *Operation[Req, Resp]) Mount(router httpopenapi.Router, pattern string, chain alice.Chain) httpopenapi.Route {
+	return router.Handle(pattern, chain.Then(op)).With(op.options()...)
+}
+
+func (op *Operation[Req, Resp]) options() []option.OperationOption {
+	opts := []option.OperationOption{}
+	responses := map[int]any{op.status: new(Resp)}
+
+	if op.status == http.StatusNoContent {
+		responses[op.status] = nil
+	}
+
+	if op.request.body || len(op.request.params) > 0 {
+		opts = append(opts, Request(new(Req)))
+		responses[http.StatusBadRequest] = "Invalid request"
+	}
+
+	if op.request.body {
+		responses[http.StatusRequestEntityTooLarge] = "Request body too large"
+		responses[http.StatusUnsupportedMediaType] = "Unsupported content type"
+	}
+
+	if op.validates {
+		responses[http.StatusUnprocessableEntity] = "Validation failed"
+	}
+
+	return append(opts, ResponsesWithDefault(responses))
+}
+
+func (op *Operation[Req, Resp]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req Req
+	var codec utils.Codec
+
+	// Negotiated first so unacceptable requests don't run the operation
+	if op.status != http.StatusNoContent {
+		var ok bool
+
+		if codec, ok = utils.Codecs.Negotiate(r.Header.Get("Accept")); !ok {
+			utils.WriteProblem(w, r, utils.NotAcceptable())
+			return
+		}
+	}
+
+	if op.request.body && !readBody(w, r, &req, op.decode) {
+		return
+	}
+
+	// Parameters are bound after the body so it can't override them
+	if errs := op.request.bind(r, reflect.ValueOf(&req).Elem()); len(errs) > 0 {
+		utils.WriteProblem(w, r, utils.BadRequest(utils.CodeBadRequest, "Invalid parameters").WithErrors(errs...))
+		return
+	}
+
+	if !validateRequest(w, r, &req) {
+		return
+	}
+
+	resp, err := op.fn(r.Context(), req)
+
+	if err != nil {
+		writeOpError(w, r, err)
+		return
+	}
+
+	if op.status == http.StatusNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	value := reflect.ValueOf(&resp).Elem()
+
+	for _, header := range op.headers {
+		if text, ok := headerValue(value.FieldByIndex(header.index)); ok {
+			w.Header().Set(header.name, text)
+		}
+	}
+
+	w.Header().Set("Content-Type", codec.MediaType())
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(op.status)
+
+	if err := codec.Encode(w, resp); err != nil {
+		RequestLogger(r).Error("Error encoding response", slog.Any("err", err))
+	}
+}
+
+func writeOpError(w http.ResponseWriter, r *http.Request, err error) {
+	utils.WriteProblem(w, r, errorProblem(r, err))
+}
+
+// errorProblem maps an error returned by a handler to the problem answering it, logging unexpected errors
+func errorProblem(r *http.Request, err error) *utils.Problem {
+	var problem *utils.Problem
+
+	switch {
+	case errors.As(err, &problem):
+		// Problems may be shared values, the request IDs are set on a copy
+		copied := *problem
+		return &copied
+	case errors.Is(err, pgx.ErrNoRows):
+		return utils.NotFound("")
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return serverProblem(r)
+	default:
+		RequestLogger(r).Error("Error handling request", slog.Any("err", err))
+		return serverProblem(r)
+	}
+}
+
+// paramField is a request field bound from the path, query, a header or a cookie
+type paramField struct {
+	index    []int
+	in       string
+	name     string
+	required bool
+}
+
+type requestBinding struct {
+	params []paramField
+	// body is set when the request has json fields, or isn't a struct at all
+	body bool
+}
+
+var paramLocations = []string{"path", "query", "header", "cookie"}
+
+func bindingFor(t reflect.Type) requestBinding {
+	if t.Kind() != reflect.Struct {
+		return requestBinding{body: true}
+	}
+
+	binding := requestBinding{}
+	collectParams(t, nil, &binding)
+
+	return binding
+}
+
+// collectParams walks t and the structs embedded in it, like the schema reflector does
+func collectParams(t reflect.Type, parent []int, binding *requestBinding) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		index := append(append([]int{}, parent...), i)
+		jsonTag, hasJSON := field.Tag.Lookup("json")
+
+		// Embedded structs are walked even when unexported, like encoding/json does
+		if field.Anonymous && !hasJSON && field.Type.Kind() == reflect.Struct {
+			collectParams(field.Type, index, binding)
+			continue
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		param := false
+
+		for _, in := range paramLocations {
+			if name, ok := field.Tag.Lookup(in); ok {
+				binding.params = append(binding.params, paramField{
+					index:    index,
+					in:       in,
+					name:     name,
+					required: in == "path" || field.Tag.Get("required") == "true",
+				})
+				param = true
+			}
+		}
+
+		if param {
+			continue
+		}
+
+		if jsonTag != "-" {
+			binding.body = true
+		}
+	}
+}
+
+func (b requestBinding) bind(r *http.Request, target reflect.Value) []utils.FieldError {
+	errs := []utils.FieldError{}
+
+	for _, param := range b.params {
+		var values []string
+
+		switch param.in {
+		case "path":
+			if value := r.PathValue(param.name); value != "" {
+				values = []string{value}
+			}
+		case "query":
+			values = r.URL.Query()[param.name]
+		case "header":
+			values = r.Header.Values(param.name)
+		case "cookie":
+			if cookie, err := r.Cookie(param.name); err == nil {
+				values = []string{cookie.Value}
+			}
+		}
+
+		if len(values) == 0 {
+			if param.required {
+				errs = append(errs, utils.FieldError{Field: param.name, Message: "is required"})
+			}
+
+			continue
+		}
+
+		if message := setParam(target.FieldByIndex(param.index), values); message != "" {
+			errs = append(errs, utils.FieldError{Field: param.name, Message: message})
+		}
+	}
+
+	return errs
+}
+
+// setParam parses values into field, returning a message for the client when they don't fit
+func setParam(field reflect.Value, values []string) string {
+	if field.Kind() == reflect.Pointer {
+		elem := reflect.New(field.Type().Elem())
+
+		if message := setParam(elem.Elem(), values); message != "" {
+			return message
+		}
+
+		field.Set(elem)
+		return ""
+	}
+
+	if unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := unmarshaler.UnmarshalText([]byte(values[0])); err != nil {
+			return "is invalid"
+		}
+
+		return ""
+	}
+
+	if field.Kind() == reflect.Slice {
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+
+		for i, value := range values {
+			if message := setParam(slice.Index(i), []string{value}); message != "" {
+				return message
+			}
+		}
+
+		field.Set(slice)
+		return ""
+	}
+
+	value := strings.TrimSpace(values[0])
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(values[0])
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return "must be a boolean"
+		}
+
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, field.Type().Bits())
+
+		if err != nil {
+			return "must be an integer"
+		}
+
+		field.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(value, 10, field.Type().Bits())
+
+		if err != nil {
+			return "must be a positive integer"
+		}
+
+		field.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, field.Type().Bits())
+
+		if err != nil {
+			return "must be a number"
+		}
+
+		field.SetFloat(parsed)
+	default:
+		return "is not supported"
+	}
+
+	return ""
+}
+
+// responseHeader is a response field sent as a header, documented by its header tag
+type responseHeader struct {
+	index []int
+	name  string
+}
+
+// headerValue formats a response header field, following pointers and using its text form when it has one.
+// Zero values leave the header unset, unless a pointer sets them explicitly
+func headerValue(field reflect.Value) (string, bool) {
+	if field.Kind() != reflect.Pointer && field.IsZero() {
+		return "", false
+	}
+
+	for field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			return "", false
+		}
+
+		field = field.Elem()
+	}
+
+	// Elements of pointers are addressable, so pointer receivers are found too
+	if field.CanAddr() {
+		field = field.Addr()
+	}
+
+	switch v := field.Interface().(type) {
+	case encoding.TextMarshaler:
+		text, err := v.MarshalText()
+		return string(text), err == nil
+	case fmt.Stringer:
+		return v.String(), true
+	}
+
+	return fmt.Sprint(reflect.Indirect(field).Interface()), true
+}
+
+func responseHeadersFor(t reflect.Type) []responseHeader {
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	headers := []responseHeader{}
+
+	for _, field := range reflect.VisibleFields(t) {
+		if name, ok := field.Tag.Lookup("header"); ok && field.IsExported() {
+			headers = append(headers, responseHeader{index: field.Index, name: name})
+		}
+	}
+
+	return headers
+}
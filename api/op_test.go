@@ -0,0 +1,138 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api"
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+type itemPath struct {
+	Id int `path:"id" json:"-"`
+}
+
+type updateItem struct {
+	itemPath
+	Tags    []string `query:"tag" json:"-"`
+	IfMatch string   `header:"If-Match" json:"-"`
+	Name    string   `json:"name"`
+}
+
+func (u *updateItem) Validate() []utils.FieldError {
+	if u.Name == "" {
+		return []utils.FieldError{{Field: "name", Message: "is required"}}
+	}
+
+	return nil
+}
+
+type itemResponse struct {
+	Id      int      `json:"id"`
+	Name    string   `json:"name"`
+	Tags    []string `json:"tags"`
+	IfMatch string   `json:"ifMatch"`
+	ETag    string   `header:"ETag" json:"-"`
+}
+
+func serveOp(handler http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.Handle(method+" /items/{id}", handler)
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"v1"`)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestOpBindsAndWritesResponse(t *testing.T) {
+	op := api.Op(func(ctx context.Context, req updateItem) (itemResponse, error) {
+		return itemResponse{Id: req.Id, Name: req.Name, Tags: req.Tags, IfMatch: req.IfMatch, ETag: `"v2"`}, nil
+	})
+
+	rec := serveOp(op, http.MethodPut, "/items/7?tag=a&tag=b", `{"name": "box"}`)
+
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"v2"` {
+		t.Fatalf("Expected 200 with the ETag header, got %d %v", rec.Code, rec.Header())
+	}
+
+	var got itemResponse
+
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Id != 7 || got.Name != "box" || strings.Join(got.Tags, ",") != "a,b" || got.IfMatch != `"v1"` {
+		t.Errorf("Expected every parameter to be bound, got %+v", got)
+	}
+}
+
+func TestOpRejectsInvalidRequests(t *testing.T) {
+	op := api.Op(func(ctx context.Context, req updateItem) (api.Empty, error) {
+		return api.Empty{}, nil
+	})
+
+	for name, tc := range map[string]struct {
+		target string
+		body   string
+		status int
+	}{
+		"bad path":   {"/items/seven", `{"name": "box"}`, http.StatusBadRequest},
+		"bad body":   {"/items/7", `{"name": 1}`, http.StatusBadRequest},
+		"validation": {"/items/7", `{"name": ""}`, http.StatusUnprocessableEntity},
+		"no content": {"/items/7", `{"name": "box"}`, http.StatusNoContent},
+	} {
+		if rec := serveOp(op, http.MethodPut, tc.target, tc.body); rec.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d: %s", name, tc.status, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestOpWritesProblemErrors(t *testing.T) {
+	op := api.Op(func(ctx context.Context, req itemPath) (itemResponse, error) {
+		return itemResponse{}, utils.Conflict(utils.CodeConflict, "Item is locked")
+	})
+
+	rec := serveOp(op, http.MethodGet, "/items/7", "")
+
+	if rec.Code != http.StatusConflict || rec.Header().Get("Content-Type") != utils.ProblemContentType {
+		t.Errorf("Expected the problem to be written, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+type headersResponse struct {
+	RetryAfter *int       `header:"Retry-After" json:"-"`
+	Client     netip.Addr `header:"X-Client" json:"-"`
+	Missing    *string    `header:"X-Missing" json:"-"`
+}
+
+func TestOpFormatsResponseHeaders(t *testing.T) {
+	retryAfter := 0
+
+	op := api.Op(func(ctx context.Context, req itemPath) (headersResponse, error) {
+		return headersResponse{RetryAfter: &retryAfter, Client: netip.MustParseAddr("198.51.100.7")}, nil
+	})
+
+	rec := serveOp(op, http.MethodGet, "/items/7", "")
+
+	if got := rec.Header().Get("Retry-After"); got != "0" {
+		t.Errorf("Expected the pointed to value, got %q", got)
+	}
+
+	if got := rec.Header().Get("X-Client"); got != "198.51.100.7" {
+		t.Errorf("Expected the text form, got %q", got)
+	}
+
+	if _, ok := rec.Header()["X-Missing"]; ok {
+		t.Error("Expected nil pointers to leave the header unset")
+	}
+}
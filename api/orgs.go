@@ -0,0 +1,216 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/orgs"
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+type OrgHandler struct {
+	jwtManager *auth.JwtManager
+	pool       *pgxpool.Pool
+}
+
+type OrgPath struct {
+	OrgId int `path:"orgId" json:"-"`
+}
+
+type MemberPath struct {
+	OrgId  int `path:"orgId" json:"-"`
+	UserId int `path:"userId" json:"-"`
+}
+
+type CreateOrgBody struct {
+	Name string `json:"name" minLength:"1" required:"true" example:"Acme"`
+	Slug string `json:"slug" pattern:"^[a-z0-9]+(?:-[a-z0-9]+)*$" required:"true" example:"acme"`
+}
+
+type UpdateOrgBody struct {
+	OrgPath
+	Name string `json:"name" minLength:"1" required:"true" example:"Acme"`
+	// IfMatch makes the update conditional on the ETag of GET /orgs/{orgId}
+	IfMatch string `header:"If-Match" json:"-"`
+}
+
+type AddMemberBody struct {
+	OrgPath
+	UserId int       `json:"userId" required:"true"`
+	Role   orgs.Role `json:"role" enum:"owner,admin,member" required:"true"`
+}
+
+type UpdateMemberBody struct {
+	MemberPath
+	Role orgs.Role `json:"role" enum:"owner,admin,member" required:"true"`
+}
+
+// isUniqueViolation reports whether err is a postgres unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func (h *OrgHandler) CreateOrg(ctx context.Context, data CreateOrgBody) (orgs.Organization, error) {
+	sess, _ := auth.ContextUser(ctx)
+
+	org, err := orgs.CreateOrganization(ctx, data.Name, data.Slug, sess.UserId, h.pool)
+
+	if isUniqueViolation(err) {
+		return org, utils.Conflict(utils.CodeSlugTaken, "Slug is already taken")
+	}
+
+	return org, err
+}
+
+func (h *OrgHandler) ListOrgs(ctx context.Context, _ Empty) ([]orgs.UserOrganization, error) {
+	sess, _ := auth.ContextUser(ctx)
+
+	return orgs.ListUserOrganizations(ctx, sess.UserId, h.pool)
+}
+
+func (h *OrgHandler) GetOrg(ctx context.Context, _ OrgPath) (orgs.UserOrganization, error) {
+	membership, _ := orgs.ContextMembership(ctx)
+
+	org, err := orgs.GetOrganization(ctx, membership.OrganizationId, h.pool)
+
+	return orgs.UserOrganization{
+		Organization: org,
+		Role:         membership.Role,
+	}, err
+}
+
+func (h *OrgHandler) UpdateOrg(ctx context.Context, data UpdateOrgBody) (orgs.Organization, error) {
+	membership, _ := orgs.ContextMembership(ctx)
+
+	current, err := orgs.GetOrganization(ctx, membership.OrganizationId, h.pool)
+
+	if err != nil {
+		return current, err
+	}
+
+	if err := ifMatchError(data.IfMatch, orgs.UserOrganization{Organization: current, Role: membership.Role}); err != nil {
+		return current, err
+	}
+
+	return orgs.UpdateOrganization(ctx, membership.OrganizationId, data.Name, h.pool)
+}
+
+func (h *OrgHandler) DeleteOrg(ctx context.Context, _ OrgPath) (Empty, error) {
+	membership, _ := orgs.ContextMembership(ctx)
+
+	err := orgs.DeleteOrganization(ctx, membership.OrganizationId, h.pool)
+
+	if err == pgx.ErrNoRows {
+		return Empty{}, nil
+	}
+
+	return Empty{}, err
+}
+
+func (h *OrgHandler) ListMembers(ctx context.Context, _ OrgPath) ([]orgs.Member, error) {
+	membership, _ := orgs.ContextMembership(ctx)
+
+	return orgs.ListMembers(ctx, membership.OrganizationId, h.pool)
+}
+
+func (h *OrgHandler) AddMember(ctx context.Context, data AddMemberBody) (orgs.Membership, error) {
+	membership, _ := orgs.ContextMembership(ctx)
+
+	// Only owners can hand out ownership
+	if data.Role == orgs.RoleOwner && membership.Role != orgs.RoleOwner {
+		return orgs.Membership{}, utils.Forbidden()
+	}
+
+	added, err := orgs.AddMember(ctx, membership.OrganizationId, data.UserId, data.Role, h.pool)
+
+	if err == orgs.ErrAlreadyMember {
+		return added, utils.Conflict(utils.CodeAlreadyMember, "User is already a member, change their role instead")
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return added, utils.NotFound("User not found")
+	}
+
+	return added, err
+}
+
+// memberToManage returns the membership of userId in the organization, or a 404 problem
+func (h *OrgHandler) memberToManage(ctx context.Context, orgId, userId int) (orgs.Membership, error) {
+	existing, err := orgs.GetMembership(ctx, orgId, userId, h.pool)
+
+	if err == pgx.ErrNoRows {
+		return existing, utils.NotFound("Member not found")
+	}
+
+	return existing, err
+}
+
+func (h *OrgHandler) UpdateMember(ctx context.Context, data UpdateMemberBody) (orgs.Membership, error) {
+	membership, _ := orgs.ContextMembership(ctx)
+
+	existing, err := h.memberToManage(ctx, membership.OrganizationId, data.UserId)
+
+	if err != nil {
+		return existing, err
+	}
+
+	// Admins can manage members and admins, only owners can touch ownership
+	if (data.Role == orgs.RoleOwner || existing.Role == orgs.RoleOwner) && membership.Role != orgs.RoleOwner {
+		return existing, utils.Forbidden()
+	}
+
+	updated, err := orgs.UpdateMemberRole(ctx, membership.OrganizationId, data.UserId, data.Role, h.pool)
+
+	if err == orgs.ErrLastOwner {
+		return updated, utils.Conflict(utils.CodeLastOwner, err.Error())
+	}
+
+	return updated, err
+}
+
+// RemoveMember lets admins remove members and any member leave the organization
+func (h *OrgHandler) RemoveMember(ctx context.Context, data MemberPath) (Empty, error) {
+	membership, _ := orgs.ContextMembership(ctx)
+
+	if data.UserId != membership.UserId {
+		existing, err := h.memberToManage(ctx, membership.OrganizationId, data.UserId)
+
+		if err != nil {
+			return Empty{}, err
+		}
+
+		if !membership.Role.AtLeast(orgs.RoleAdmin) || (existing.Role == orgs.RoleOwner && membership.Role != orgs.RoleOwner) {
+			return Empty{}, utils.Forbidden()
+		}
+	}
+
+	err := orgs.RemoveMember(ctx, membership.OrganizationId, data.UserId, h.pool)
+
+	switch {
+	case err == pgx.ErrNoRows:
+		return Empty{}, utils.NotFound("Member not found")
+	case err == orgs.ErrLastOwner:
+		return Empty{}, utils.Conflict(utils.CodeLastOwner, err.Error())
+	}
+
+	return Empty{}, err
+}
+
+// SwitchOrg issues new tokens with the organization as the active org claim
+func (h *OrgHandler) SwitchOrg(ctx context.Context, _ OrgPath) (LoginJwtResponse, error) {
+	sess, _ := auth.ContextUser(ctx)
+	membership, _ := orgs.ContextMembership(ctx)
+
+	return issueTokens(h.jwtManager, auth.SessionData{
+		UserId:   sess.UserId,
+		Role:     sess.Role,
+		OrgId:    membership.OrganizationId,
+		AuthTime: sess.AuthTime,
+	})
+}
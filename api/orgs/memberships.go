@@ -0,0 +1,214 @@
+package orgs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleAdmin  Role = "admin"
+	RoleMember Role = "member"
+)
+
+var roleRanks = map[Role]int{
+	RoleMember: 1,
+	RoleAdmin:  2,
+	RoleOwner:  3,
+}
+
+var ErrInvalidRole = errors.New("invalid role")
+var ErrLastOwner = errors.New("organization must keep at least one owner")
+var ErrAlreadyMember = errors.New("user is already a member")
+
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// AtLeast reports whether r grants at least the permissions of min
+func (r Role) AtLeast(min Role) bool {
+	return roleRanks[r] >= roleRanks[min]
+}
+
+type Membership struct {
+	OrganizationId int       `json:"organizationId"`
+	UserId         int       `json:"userId"`
+	Role           Role      `json:"role"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// Member is a membership joined with the member's user details
+type Member struct {
+	Membership
+	Email *string `json:"email"`
+}
+
+func GetMembership(ctx context.Context, orgId, userId int, db *pgxpool.Pool) (Membership, error) {
+	var m Membership
+
+	err := db.QueryRow(ctx, "SELECT organization_id, user_id, role, created_at FROM memberships WHERE organization_id = $1 AND user_id = $2", orgId, userId).
+		Scan(&m.OrganizationId, &m.UserId, &m.Role, &m.CreatedAt)
+
+	if err != nil {
+		return Membership{}, err
+	}
+
+	return m, nil
+}
+
+func ListMembers(ctx context.Context, orgId int, db *pgxpool.Pool) ([]Member, error) {
+	rows, err := db.Query(ctx, `SELECT m.organization_id, m.user_id, m.role, m.created_at, u.email
+	FROM memberships m
+	JOIN users u ON u.id = m.user_id
+	WHERE m.organization_id = $1
+	ORDER BY m.created_at, m.user_id`, orgId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	members := []Member{}
+
+	for rows.Next() {
+		var m Member
+
+		if err := rows.Scan(&m.OrganizationId, &m.UserId, &m.Role, &m.CreatedAt, &m.Email); err != nil {
+			return nil, err
+		}
+
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+// AddMember adds the user to the organization, returns ErrAlreadyMember when they are one.
+// Roles of existing members change through UpdateMemberRole, which keeps an owner
+func AddMember(ctx context.Context, orgId, userId int, role Role, db *pgxpool.Pool) (Membership, error) {
+	if !role.Valid() {
+		return Membership{}, ErrInvalidRole
+	}
+
+	m := Membership{
+		OrganizationId: orgId,
+		UserId:         userId,
+		Role:           role,
+	}
+
+	err := db.QueryRow(ctx, `INSERT INTO memberships (organization_id, user_id, role) VALUES ($1, $2, $3)
+	ON CONFLICT (organization_id, user_id) DO NOTHING
+	RETURNING created_at`, orgId, userId, role).Scan(&m.CreatedAt)
+
+	if err == pgx.ErrNoRows {
+		return Membership{}, ErrAlreadyMember
+	}
+
+	if err != nil {
+		return Membership{}, err
+	}
+
+	return m, nil
+}
+
+// UpdateMemberRole changes the role of an existing member, returns ErrLastOwner when it would demote the only owner
+func UpdateMemberRole(ctx context.Context, orgId, userId int, role Role, db *pgxpool.Pool) (Membership, error) {
+	if !role.Valid() {
+		return Membership{}, ErrInvalidRole
+	}
+
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+
+	if err != nil {
+		return Membership{}, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	if err := lockOrganization(ctx, orgId, tx); err != nil {
+		return Membership{}, err
+	}
+
+	var m Membership
+
+	err = tx.QueryRow(ctx, `UPDATE memberships SET role = $3 WHERE organization_id = $1 AND user_id = $2
+	RETURNING organization_id, user_id, role, created_at`, orgId, userId, role).
+		Scan(&m.OrganizationId, &m.UserId, &m.Role, &m.CreatedAt)
+
+	if err != nil {
+		return Membership{}, err
+	}
+
+	if err := ensureOwner(ctx, orgId, tx); err != nil {
+		return Membership{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return Membership{}, err
+	}
+
+	return m, nil
+}
+
+// RemoveMember deletes the membership, returns ErrLastOwner when it would remove the only owner
+func RemoveMember(ctx context.Context, orgId, userId int, db *pgxpool.Pool) error {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	if err := lockOrganization(ctx, orgId, tx); err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(ctx, "DELETE FROM memberships WHERE organization_id = $1 AND user_id = $2", orgId, userId)
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	if err := ensureOwner(ctx, orgId, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// lockOrganization serializes the membership changes of an organization until tx ends.
+// Without it two owners demoting each other could both see the other as the remaining owner
+func lockOrganization(ctx context.Context, orgId int, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, "SELECT 1 FROM organizations WHERE id = $1 FOR UPDATE", orgId)
+	return err
+}
+
+// ensureOwner fails with ErrLastOwner when the organization has no owner left, tx must hold lockOrganization
+func ensureOwner(ctx context.Context, orgId int, tx pgx.Tx) error {
+	var owners int
+
+	err := tx.QueryRow(ctx, "SELECT count(*) FROM memberships WHERE organization_id = $1 AND role = $2", orgId, RoleOwner).Scan(&owners)
+
+	if err != nil {
+		return err
+	}
+
+	if owners == 0 {
+		return ErrLastOwner
+	}
+
+	return nil
+}
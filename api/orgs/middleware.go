@@ -0,0 +1,114 @@
+package orgs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+// OrgIdPathValue is the path wildcard name used by org scoped routes, e.g. /orgs/{orgId}
+const OrgIdPathValue = "orgId"
+
+// OrgIdHeader selects the organization for routes that don't carry it in the path
+const OrgIdHeader = "X-Org-Id"
+
+type MembershipContextKey string
+
+var MembershipKey MembershipContextKey = "membership"
+
+var ErrNoOrganization = errors.New("no organization selected")
+
+// ResolveOrgId finds the organization a request targets.
+// The path value takes precedence over the OrgIdHeader, which takes precedence over the active org claim of the session
+func ResolveOrgId(r *http.Request) (int, error) {
+	if value := r.PathValue(OrgIdPathValue); value != "" {
+		return strconv.Atoi(value)
+	}
+
+	if value := r.Header.Get(OrgIdHeader); value != "" {
+		return strconv.Atoi(value)
+	}
+
+	sess, err := auth.RequestUser(r)
+
+	if err != nil || sess.OrgId == 0 {
+		return 0, ErrNoOrganization
+	}
+
+	return sess.OrgId, nil
+}
+
+// RequireMembership resolves the target organization and rejects users who are not members of it.
+// Must run after auth.RequireAccessToken
+func RequireMembership(db *pgxpool.Pool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sess, err := auth.RequestUser(r)
+
+			if err != nil {
+				utils.WriteProblem(w, r, utils.Unauthorized())
+				return
+			}
+
+			orgId, err := ResolveOrgId(r)
+
+			if err != nil {
+				utils.WriteProblem(w, r, utils.BadRequest(utils.CodeBadRequest, "Invalid organization"))
+				return
+			}
+
+			membership, err := GetMembership(r.Context(), orgId, sess.UserId, db)
+
+			if err == pgx.ErrNoRows {
+				utils.WriteProblem(w, r, utils.Forbidden())
+				return
+			}
+
+			if err != nil {
+				utils.WriteProblem(w, r, utils.NewProblem(http.StatusInternalServerError, utils.CodeInternal, ""))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), MembershipKey, membership)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireRole rejects members whose role in the organization is below min.
+// Must run after RequireMembership
+func RequireRole(min Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			membership, err := RequestMembership(r)
+
+			if err != nil || !membership.Role.AtLeast(min) {
+				utils.WriteProblem(w, r, utils.Forbidden())
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func RequestMembership(r *http.Request) (Membership, error) {
+	return ContextMembership(r.Context())
+}
+
+// ContextMembership is RequestMembership for code that only has the request context
+func ContextMembership(ctx context.Context) (Membership, error) {
+	membership, ok := ctx.Value(MembershipKey).(Membership)
+
+	if !ok {
+		return Membership{}, ErrNoOrganization
+	}
+
+	return membership, nil
+}
@@ -0,0 +1,87 @@
+package orgs_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/orgs"
+)
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestResolveOrgIdPrecedence(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/orgs/3", nil)
+	req.SetPathValue(orgs.OrgIdPathValue, "3")
+	req.Header.Set(orgs.OrgIdHeader, "2")
+
+	ctx := context.WithValue(req.Context(), auth.SessionUserIdKey, 1)
+	ctx = context.WithValue(ctx, auth.SessionRoleKey, "user")
+	ctx = context.WithValue(ctx, auth.SessionOrgIdKey, 1)
+	req = req.WithContext(ctx)
+
+	orgId, err := orgs.ResolveOrgId(req)
+
+	if err != nil || orgId != 3 {
+		t.Errorf("Expected path org 3, got %d (%v)", orgId, err)
+	}
+
+	req.SetPathValue(orgs.OrgIdPathValue, "")
+
+	if orgId, _ := orgs.ResolveOrgId(req); orgId != 2 {
+		t.Errorf("Expected header org 2, got %d", orgId)
+	}
+
+	req.Header.Del(orgs.OrgIdHeader)
+
+	if orgId, _ := orgs.ResolveOrgId(req); orgId != 1 {
+		t.Errorf("Expected session org 1, got %d", orgId)
+	}
+}
+
+func TestResolveOrgIdMissing(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if _, err := orgs.ResolveOrgId(req); err != orgs.ErrNoOrganization {
+		t.Errorf("Expected ErrNoOrganization, got %v", err)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	handler := orgs.RequireRole(orgs.RoleAdmin)(http.HandlerFunc(okHandler))
+
+	cases := map[orgs.Role]int{
+		orgs.RoleMember: http.StatusForbidden,
+		orgs.RoleAdmin:  http.StatusOK,
+		orgs.RoleOwner:  http.StatusOK,
+	}
+
+	for role, expected := range cases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), orgs.MembershipKey, orgs.Membership{Role: role}))
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != expected {
+			t.Errorf("Role %s: expected status %d, got %d", role, expected, rec.Code)
+		}
+	}
+}
+
+func TestRequireRoleNoMembership(t *testing.T) {
+	handler := orgs.RequireRole(orgs.RoleMember)(http.HandlerFunc(okHandler))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+}
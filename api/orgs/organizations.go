@@ -0,0 +1,165 @@
+package orgs
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/maybemaby/oapibase/api/userdata"
+)
+
+func init() {
+	userdata.Register("organizations", func(ctx context.Context, userId int, db *pgxpool.Pool) (any, error) {
+		return ListUserOrganizations(ctx, userId, db)
+	})
+}
+
+type Organization struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UserOrganization is an organization along with the role the user holds in it
+type UserOrganization struct {
+	Organization
+	Role Role `json:"role"`
+}
+
+// CreateOrganization inserts a new organization and makes ownerId its owner in a single transaction
+func CreateOrganization(ctx context.Context, name, slug string, ownerId int, db *pgxpool.Pool) (Organization, error) {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+
+	if err != nil {
+		return Organization{}, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	org := Organization{
+		Name: name,
+		Slug: slug,
+	}
+
+	err = tx.QueryRow(ctx, "INSERT INTO organizations (name, slug) VALUES ($1, $2) RETURNING id, created_at", name, slug).
+		Scan(&org.ID, &org.CreatedAt)
+
+	if err != nil {
+		return Organization{}, err
+	}
+
+	_, err = tx.Exec(ctx, "INSERT INTO memberships (organization_id, user_id, role) VALUES ($1, $2, $3)", org.ID, ownerId, RoleOwner)
+
+	if err != nil {
+		return Organization{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return Organization{}, err
+	}
+
+	return org, nil
+}
+
+func GetOrganization(ctx context.Context, id int, db *pgxpool.Pool) (Organization, error) {
+	var org Organization
+
+	err := db.QueryRow(ctx, "SELECT id, name, slug, created_at FROM organizations WHERE id = $1", id).
+		Scan(&org.ID, &org.Name, &org.Slug, &org.CreatedAt)
+
+	if err != nil {
+		return Organization{}, err
+	}
+
+	return org, nil
+}
+
+// ListUserOrganizations returns every organization the user is a member of, oldest membership first
+func ListUserOrganizations(ctx context.Context, userId int, db *pgxpool.Pool) ([]UserOrganization, error) {
+	rows, err := db.Query(ctx, `SELECT o.id, o.name, o.slug, o.created_at, m.role
+	FROM organizations o
+	JOIN memberships m ON o.id = m.organization_id
+	WHERE m.user_id = $1
+	ORDER BY m.created_at, o.id`, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	orgs := []UserOrganization{}
+
+	for rows.Next() {
+		var org UserOrganization
+
+		if err := rows.Scan(&org.ID, &org.Name, &org.Slug, &org.CreatedAt, &org.Role); err != nil {
+			return nil, err
+		}
+
+		orgs = append(orgs, org)
+	}
+
+	return orgs, rows.Err()
+}
+
+// SoleOwnedOrganizations returns the organizations where the user is the only owner among other members,
+// they would be left without an owner if the user went away
+func SoleOwnedOrganizations(ctx context.Context, userId int, db *pgxpool.Pool) ([]Organization, error) {
+	rows, err := db.Query(ctx, `SELECT o.id, o.name, o.slug, o.created_at
+	FROM organizations o
+	JOIN memberships m ON o.id = m.organization_id AND m.user_id = $1 AND m.role = $2
+	WHERE NOT EXISTS (SELECT 1 FROM memberships other WHERE other.organization_id = o.id AND other.user_id <> $1 AND other.role = $2)
+	AND EXISTS (SELECT 1 FROM memberships other WHERE other.organization_id = o.id AND other.user_id <> $1)
+	ORDER BY o.id`, userId, RoleOwner)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	orgs := []Organization{}
+
+	for rows.Next() {
+		var org Organization
+
+		if err := rows.Scan(&org.ID, &org.Name, &org.Slug, &org.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		orgs = append(orgs, org)
+	}
+
+	return orgs, rows.Err()
+}
+
+func UpdateOrganization(ctx context.Context, id int, name string, db *pgxpool.Pool) (Organization, error) {
+	var org Organization
+
+	err := db.QueryRow(ctx, "UPDATE organizations SET name = $1 WHERE id = $2 RETURNING id, name, slug, created_at", name, id).
+		Scan(&org.ID, &org.Name, &org.Slug, &org.CreatedAt)
+
+	if err != nil {
+		return Organization{}, err
+	}
+
+	return org, nil
+}
+
+// DeleteOrganization removes the organization, memberships are removed by the cascade
+func DeleteOrganization(ctx context.Context, id int, db *pgxpool.Pool) error {
+	tag, err := db.Exec(ctx, "DELETE FROM organizations WHERE id = $1", id)
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package paginate
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("paginate: invalid cursor")
+
+// Signer signs cursors so clients can't forge positions, they stay opaque but aren't encrypted
+type Signer struct {
+	secret []byte
+}
+
+func NewSigner(secret []byte) *Signer {
+	return &Signer{secret: secret}
+}
+
+// DefaultSigner signs the cursors of lists without their own Signer. Its key is random until the server
+// sets one from CURSOR_SECRET, which production requires, cursors then only work on the instance that issued them
+var DefaultSigner = NewSigner([]byte(rand.Text()))
+
+// cursor is a position in a list, between the row whose sort values it holds and the next one
+type cursor struct {
+	// Before points to the page ending at the position instead of the one starting there
+	Before bool `json:"b,omitempty"`
+	// Values are the sort column values of the row, as text
+	Values []string `json:"v"`
+	// Fingerprint identifies the sort and filters the cursor was issued for
+	Fingerprint string `json:"f"`
+}
+
+func (s *Signer) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+func (s *Signer) encode(c cursor) string {
+	payload, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload))
+}
+
+func (s *Signer) decode(token string) (cursor, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+
+	if !ok {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	signature, signatureErr := base64.RawURLEncoding.DecodeString(encodedSignature)
+
+	if errors.Join(err, signatureErr) != nil || !hmac.Equal(signature, s.sign(payload)) {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	var c cursor
+
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
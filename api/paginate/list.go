@@ -0,0 +1,444 @@
+// Package paginate serves lists a page at a time with keyset pagination. A List declares the columns
+// clients may sort and filter on, Parse reads a page request from the query string and Fetch runs it,
+// returning a Page with signed cursors to its neighbours.
+package paginate
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+// Type is the type of a column's values, it decides how filters and cursors are parsed and documented
+type Type int
+
+const (
+	String Type = iota
+	Integer
+	Boolean
+	Time
+)
+
+func (t Type) parse(value string) (any, string) {
+	switch t {
+	case Integer:
+		if parsed, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+			return parsed, ""
+		}
+
+		return nil, "must be an integer"
+	case Boolean:
+		if parsed, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+			return parsed, ""
+		}
+
+		return nil, "must be a boolean"
+	case Time:
+		if parsed, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(value)); err == nil {
+			return parsed, ""
+		}
+
+		return nil, "must be a valid date-time"
+	default:
+		return value, ""
+	}
+}
+
+// formatValue writes a value scanned from a row as the text Type.parse reads back
+func formatValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), nil
+	case int16:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case int:
+		return strconv.Itoa(v), nil
+	}
+
+	return "", fmt.Errorf("paginate: can't use %T as a cursor value", value)
+}
+
+// Operator compares a column to a filter value
+type Operator string
+
+const (
+	Eq  Operator = "eq"
+	Ne  Operator = "ne"
+	Gt  Operator = "gt"
+	Gte Operator = "gte"
+	Lt  Operator = "lt"
+	Lte Operator = "lte"
+)
+
+var operatorSQL = map[Operator]string{Eq: "=", Ne: "<>", Gt: ">", Gte: ">=", Lt: "<", Lte: "<="}
+
+// Column is a column of a list clients may sort or filter on
+type Column struct {
+	// Name is the column in query parameters, e.g. createdAt
+	Name string
+	// SQL is the column selected by the list's query, e.g. created_at. Sortable columns must not be NULL
+	SQL      string
+	Type     Type
+	Sortable bool
+	// Filters are the operators clients may filter with, Eq as ?name=value and the others as ?name[op]=value
+	Filters []Operator
+	// Enum restricts the values of string filters
+	Enum []string
+}
+
+func (c Column) param(op Operator) string {
+	if op == Eq {
+		return c.Name
+	}
+
+	return c.Name + "[" + string(op) + "]"
+}
+
+// List declares a paginated list, usually as a package variable next to its query.
+// Only its columns ever reach the SQL, whatever the client sends
+type List struct {
+	Columns []Column
+	// Sort is the default sort, in the syntax of the sort parameter, e.g. -createdAt
+	Sort string
+	// Key names a unique column ending every sort so rows are totally ordered, e.g. id
+	Key string
+	// DefaultLimit defaults to 20 and MaxLimit to 100
+	DefaultLimit int
+	MaxLimit     int
+	// Signer defaults to DefaultSigner
+	Signer *Signer
+}
+
+func (l *List) limits() (int, int) {
+	defaultLimit, maxLimit := l.DefaultLimit, l.MaxLimit
+
+	if maxLimit <= 0 {
+		maxLimit = 100
+	}
+
+	if defaultLimit <= 0 {
+		defaultLimit = min(20, maxLimit)
+	}
+
+	return defaultLimit, maxLimit
+}
+
+func (l *List) signer() *Signer {
+	if l.Signer != nil {
+		return l.Signer
+	}
+
+	return DefaultSigner
+}
+
+func (l *List) column(name string) (*Column, bool) {
+	index := slices.IndexFunc(l.Columns, func(c Column) bool { return c.Name == name })
+
+	if index < 0 {
+		return nil, false
+	}
+
+	return &l.Columns[index], true
+}
+
+func (l *List) sortable() []string {
+	names := []string{}
+
+	for _, c := range l.Columns {
+		if c.Sortable {
+			names = append(names, c.Name)
+		}
+	}
+
+	return names
+}
+
+type sortKey struct {
+	column *Column
+	desc   bool
+}
+
+type filter struct {
+	column *Column
+	op     Operator
+	value  any
+}
+
+// Query is a parsed page request, run it with Fetch
+type Query struct {
+	Limit   int
+	list    *List
+	url     url.URL
+	sort    []sortKey
+	filters []filter
+	// fingerprint identifies the sort and filters, cursors only apply to the query they came from
+	fingerprint string
+	before      bool
+	// position holds the parsed cursor values, nil on the first page
+	position []any
+}
+
+// Parse reads the limit, cursor, sort and filter parameters from the query string of r.
+// Invalid parameters are answered with a 400 *utils.Problem listing them.
+// It panics when the list's Key or default Sort aren't sortable columns
+func (l *List) Parse(r *http.Request) (*Query, error) {
+	params := r.URL.Query()
+	defaultLimit, maxLimit := l.limits()
+	errs := []utils.FieldError{}
+
+	q := &Query{
+		Limit: defaultLimit,
+		list:  l,
+		url:   url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery},
+	}
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+
+		if err != nil || limit < 1 || limit > maxLimit {
+			errs = append(errs, utils.FieldError{Field: "limit", Message: fmt.Sprintf("must be an integer between 1 and %d", maxLimit)})
+		}
+
+		q.Limit = limit
+	}
+
+	if key, ok := l.column(l.Key); !ok || !key.Sortable {
+		panic(fmt.Sprintf("paginate: key %q isn't a sortable column", l.Key))
+	}
+
+	if _, message := l.parseSort(l.Sort); message != "" {
+		panic(fmt.Sprintf("paginate: default sort %q: %s", l.Sort, message))
+	}
+
+	sort := l.Sort
+
+	if params.Has("sort") {
+		sort = params.Get("sort")
+	}
+
+	keys, message := l.parseSort(sort)
+
+	if message != "" {
+		errs = append(errs, utils.FieldError{Field: "sort", Message: message})
+	}
+
+	q.sort = keys
+
+	for i := range l.Columns {
+		column := &l.Columns[i]
+
+		for _, op := range column.Filters {
+			name := column.param(op)
+			values := params[name]
+
+			if len(values) == 0 {
+				continue
+			}
+
+			value, message := column.Type.parse(values[0])
+
+			switch {
+			case len(values) > 1:
+				message = "must be given once"
+			case message == "" && len(column.Enum) > 0 && !slices.Contains(column.Enum, values[0]):
+				message = "must be one of " + strings.Join(column.Enum, ", ")
+			}
+
+			if message != "" {
+				errs = append(errs, utils.FieldError{Field: name, Message: message})
+				continue
+			}
+
+			q.filters = append(q.filters, filter{column: column, op: op, value: value})
+		}
+	}
+
+	q.fingerprint = q.fingerprintOf()
+
+	if token := params.Get("cursor"); token != "" {
+		if message := q.parseCursor(token); message != "" {
+			errs = append(errs, utils.FieldError{Field: "cursor", Message: message})
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, utils.BadRequest(utils.CodeBadRequest, "Invalid pagination parameters").WithErrors(errs...)
+	}
+
+	return q, nil
+}
+
+// parseSort reads a comma separated list of columns prefixed with - for descending order, the key comes last
+func (l *List) parseSort(sort string) ([]sortKey, string) {
+	keys := []sortKey{}
+
+	for name := range strings.SplitSeq(sort, ",") {
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			continue
+		}
+
+		desc := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		column, ok := l.column(name)
+
+		if !ok || !column.Sortable {
+			return nil, "can only sort by " + strings.Join(l.sortable(), ", ")
+		}
+
+		if slices.ContainsFunc(keys, func(k sortKey) bool { return k.column == column }) {
+			return nil, "must not repeat " + name
+		}
+
+		keys = append(keys, sortKey{column: column, desc: desc})
+	}
+
+	key, ok := l.column(l.Key)
+
+	if ok && !slices.ContainsFunc(keys, func(k sortKey) bool { return k.column == key }) {
+		keys = append(keys, sortKey{column: key})
+	}
+
+	return keys, ""
+}
+
+func (q *Query) fingerprintOf() string {
+	var b strings.Builder
+
+	for _, key := range q.sort {
+		fmt.Fprintf(&b, "%s:%t;", key.column.Name, key.desc)
+	}
+
+	for _, f := range q.filters {
+		fmt.Fprintf(&b, "%s:%s:%v;", f.column.Name, f.op, f.value)
+	}
+
+	sum := sha256.Sum256([]byte(b.String()))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+func (q *Query) parseCursor(token string) string {
+	c, err := q.list.signer().decode(token)
+
+	if err != nil {
+		return "is invalid"
+	}
+
+	if c.Fingerprint != q.fingerprint || len(c.Values) != len(q.sort) {
+		return "was issued for a different sort or filters"
+	}
+
+	position := make([]any, len(c.Values))
+
+	for i, value := range c.Values {
+		parsed, message := q.sort[i].column.Type.parse(value)
+
+		if message != "" {
+			return "is invalid"
+		}
+
+		position[i] = parsed
+	}
+
+	q.before = c.Before
+	q.position = position
+
+	return ""
+}
+
+// Build wraps base, a query using args, in the filters, keyset condition, order and limit of q.
+// Column SQL refers to the columns base selects. One row past the limit is fetched to detect the next page
+func (q *Query) Build(base string, args ...any) (string, []any) {
+	args = slices.Clone(args)
+	conditions := []string{}
+
+	placeholder := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	for _, f := range q.filters {
+		conditions = append(conditions, f.column.SQL+" "+operatorSQL[f.op]+" "+placeholder(f.value))
+	}
+
+	if q.position != nil {
+		values := []string{}
+
+		for _, value := range q.position {
+			values = append(values, placeholder(value))
+		}
+
+		// Rows past the position: greater on the first key, or equal on it and past it on the next keys
+		alternatives := []string{}
+
+		for i, key := range q.sort {
+			terms := []string{}
+
+			for j := range i {
+				terms = append(terms, q.sort[j].column.SQL+" = "+values[j])
+			}
+
+			op := ">"
+
+			if key.desc != q.before {
+				op = "<"
+			}
+
+			terms = append(terms, key.column.SQL+" "+op+" "+values[i])
+			alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+		}
+
+		conditions = append(conditions, "("+strings.Join(alternatives, " OR ")+")")
+	}
+
+	order := []string{}
+
+	for _, key := range q.sort {
+		direction := "ASC"
+
+		if key.desc != q.before {
+			direction = "DESC"
+		}
+
+		order = append(order, key.column.SQL+" "+direction)
+	}
+
+	sql := "SELECT * FROM (" + base + ") AS page"
+
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	sql += " ORDER BY " + strings.Join(order, ", ") + " LIMIT " + strconv.Itoa(q.Limit+1)
+
+	return sql, args
+}
+
+// link is the URL of the request with its cursor replaced
+func (q *Query) link(c cursor) string {
+	c.Fingerprint = q.fingerprint
+	link := q.url
+	params := link.Query()
+	params.Set("cursor", q.list.signer().encode(c))
+	link.RawQuery = params.Encode()
+
+	return link.String()
+}
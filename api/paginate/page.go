@@ -0,0 +1,209 @@
+package paginate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/oaswrap/spec/option"
+)
+
+// Page is a window of a list with links to the pages around it
+type Page[T any] struct {
+	Items []T `json:"items" required:"true"`
+	// Next and Prev are relative links to the adjacent pages, empty at either end of the list
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+	// Link holds the same links as a Link header (RFC 8288)
+	Link string `header:"Link" json:"-"`
+}
+
+// SetLinkHeader sends the page links in the Link header of h, handlers that aren't an Op call it before writing the page
+func (p Page[T]) SetLinkHeader(h http.Header) {
+	if p.Link != "" {
+		h.Set("Link", p.Link)
+	}
+}
+
+// Querier runs the paginated query, *pgxpool.Pool, *pgx.Conn and pgx.Tx satisfy it
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// Fetch runs base with args paginated by q and scans the page with scan, e.g. pgx.RowToStructByName[T].
+// base is wrapped in a subquery, it may filter and join but must not order or limit
+func Fetch[T any](ctx context.Context, db Querier, q *Query, scan pgx.RowToFunc[T], base string, args ...any) (Page[T], error) {
+	sql, args := q.Build(base, args...)
+	rows, err := db.Query(ctx, sql, args...)
+
+	if err != nil {
+		return Page[T]{}, err
+	}
+
+	defer rows.Close()
+
+	// Where the sort columns are in the rows, to read the cursor values of the page's ends
+	indexes := []int{}
+
+	for _, key := range q.sort {
+		index := slices.IndexFunc(rows.FieldDescriptions(), func(f pgconn.FieldDescription) bool { return f.Name == key.column.SQL })
+
+		if index < 0 {
+			return Page[T]{}, fmt.Errorf("paginate: the query doesn't select the sort column %s", key.column.SQL)
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	items := []T{}
+	positions := [][]string{}
+	more := false
+
+	for rows.Next() {
+		if len(items) == q.Limit {
+			more = true
+			break
+		}
+
+		values, err := rows.Values()
+
+		if err != nil {
+			return Page[T]{}, err
+		}
+
+		position := []string{}
+
+		for _, index := range indexes {
+			value, err := formatValue(values[index])
+
+			if err != nil {
+				return Page[T]{}, err
+			}
+
+			position = append(position, value)
+		}
+
+		item, err := scan(rows)
+
+		if err != nil {
+			return Page[T]{}, err
+		}
+
+		items = append(items, item)
+		positions = append(positions, position)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return Page[T]{}, err
+	}
+
+	// Pages before a cursor are read backwards
+	if q.before {
+		slices.Reverse(items)
+		slices.Reverse(positions)
+	}
+
+	return newPage(q, items, positions, more), nil
+}
+
+// newPage links the neighbours of items, more tells whether rows were left past them in the read direction
+func newPage[T any](q *Query, items []T, positions [][]string, more bool) Page[T] {
+	page := Page[T]{Items: items}
+
+	if len(items) == 0 {
+		return page
+	}
+
+	// Reading forward, rows before the page exist when it started at a cursor. Reading backward,
+	// rows after it always do since the cursor came from one of them
+	hasNext, hasPrev := more, q.position != nil
+
+	if q.before {
+		hasNext, hasPrev = true, more
+	}
+
+	links := []string{}
+
+	if hasNext {
+		page.Next = q.link(cursor{Values: positions[len(positions)-1]})
+		links = append(links, "<"+page.Next+`>; rel="next"`)
+	}
+
+	if hasPrev {
+		page.Prev = q.link(cursor{Before: true, Values: positions[0]})
+		links = append(links, "<"+page.Prev+`>; rel="prev"`)
+	}
+
+	page.Link = strings.Join(links, ", ")
+
+	return page
+}
+
+var paramTypes = map[Type]reflect.Type{
+	String:  reflect.TypeFor[string](),
+	Integer: reflect.TypeFor[int64](),
+	Boolean: reflect.TypeFor[bool](),
+	Time:    reflect.TypeFor[time.Time](),
+}
+
+// Parameters documents the limit, cursor, sort and filter query parameters of the list
+func (l *List) Parameters() option.OperationOption {
+	defaultLimit, maxLimit := l.limits()
+	sortDescription := "Comma separated columns to sort by, prefixed with - for descending order: " + strings.Join(l.sortable(), ", ")
+
+	fields := []reflect.StructField{
+		{
+			Name: "Limit",
+			Type: reflect.TypeFor[int](),
+			Tag: reflect.StructTag(fmt.Sprintf(`query:"limit" minimum:"1" maximum:"%d" default:"%d" description:"Items per page"`,
+				maxLimit, defaultLimit)),
+		},
+		{
+			Name: "Cursor",
+			Type: reflect.TypeFor[string](),
+			Tag:  `query:"cursor" description:"Opaque cursor taken from the next or prev link of a page"`,
+		},
+		{
+			Name: "Sort",
+			Type: reflect.TypeFor[string](),
+			Tag:  reflect.StructTag(fmt.Sprintf(`query:"sort" default:%s description:%s`, strconv.Quote(l.Sort), strconv.Quote(sortDescription))),
+		},
+	}
+
+	for _, column := range l.Columns {
+		for _, op := range column.Filters {
+			tag := fmt.Sprintf(`query:%s description:%s`, strconv.Quote(column.param(op)),
+				strconv.Quote(fmt.Sprintf("Only items whose %s is %s the value", column.Name, operatorDescriptions[op])))
+
+			if len(column.Enum) > 0 {
+				tag += fmt.Sprintf(` enum:%s`, strconv.Quote(strings.Join(column.Enum, ",")))
+			}
+
+			fields = append(fields, reflect.StructField{
+				Name: "Filter" + strconv.Itoa(len(fields)),
+				Type: paramTypes[column.Type],
+				Tag:  reflect.StructTag(tag),
+			})
+		}
+	}
+
+	return option.Request(reflect.New(reflect.StructOf(fields)).Interface())
+}
+
+var operatorDescriptions = map[Operator]string{
+	Eq:  "equal to",
+	Ne:  "not equal to",
+	Gt:  "greater than",
+	Gte: "greater than or equal to",
+	Lt:  "less than",
+	Lte: "less than or equal to",
+}
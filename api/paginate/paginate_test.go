@@ -0,0 +1,199 @@
+package paginate_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/maybemaby/oapibase/api/paginate"
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+var list = &paginate.List{
+	Columns: []paginate.Column{
+		{Name: "id", SQL: "id", Type: paginate.Integer, Sortable: true},
+		{Name: "createdAt", SQL: "created_at", Type: paginate.Time, Sortable: true, Filters: []paginate.Operator{paginate.Gte}},
+		{Name: "role", SQL: "role", Type: paginate.String, Filters: []paginate.Operator{paginate.Eq}, Enum: []string{"admin", "member"}},
+	},
+	Sort:     "-createdAt",
+	Key:      "id",
+	MaxLimit: 50,
+	Signer:   paginate.NewSigner([]byte("secret")),
+}
+
+func parse(t *testing.T, target string) *paginate.Query {
+	t.Helper()
+
+	q, err := list.Parse(httptest.NewRequest("GET", target, nil))
+
+	if err != nil {
+		t.Fatalf("Parsing %s: %v", target, err)
+	}
+
+	return q
+}
+
+func TestParseRejectsInvalidParameters(t *testing.T) {
+	cases := map[string]string{
+		"/items?limit=0":                   "limit",
+		"/items?limit=51":                  "limit",
+		"/items?sort=email":                "sort",
+		"/items?sort=id,-id":               "sort",
+		"/items?role=owner":                "role",
+		"/items?createdAt[gte]=yesterday":  "createdAt[gte]",
+		"/items?cursor=eyJ2IjpbXX0.forged": "cursor",
+		"/items?role=admin&role=member":    "role",
+	}
+
+	for target, field := range cases {
+		_, err := list.Parse(httptest.NewRequest("GET", target, nil))
+
+		var problem *utils.Problem
+
+		if !errors.As(err, &problem) || problem.Status != 400 || len(problem.Errors) != 1 || problem.Errors[0].Field != field {
+			t.Errorf("%s: expected a 400 on %s, got %v", target, field, err)
+		}
+	}
+}
+
+func TestBuildFirstPage(t *testing.T) {
+	q := parse(t, "/items?limit=10&role=admin&createdAt[gte]=2025-01-01T00:00:00Z")
+	sql, args := q.Build("SELECT * FROM items WHERE org_id = $1", 7)
+
+	expected := "SELECT * FROM (SELECT * FROM items WHERE org_id = $1) AS page WHERE created_at >= $2 AND role = $3 " +
+		"ORDER BY created_at DESC, id ASC LIMIT 11"
+
+	if sql != expected || len(args) != 3 || args[0] != 7 || args[2] != "admin" {
+		t.Errorf("Unexpected query %q with %v", sql, args)
+	}
+}
+
+type item struct {
+	Id        int64
+	CreatedAt time.Time
+}
+
+// fakeRows serves values in memory, items are scanned from Values
+type fakeRows struct {
+	pgx.Rows
+	values [][]any
+	index  int
+}
+
+func (r *fakeRows) Close()     {}
+func (r *fakeRows) Err() error { return nil }
+
+func (r *fakeRows) FieldDescriptions() []pgconn.FieldDescription {
+	return []pgconn.FieldDescription{{Name: "id"}, {Name: "created_at"}}
+}
+
+func (r *fakeRows) Next() bool {
+	r.index++
+	return r.index <= len(r.values)
+}
+
+func (r *fakeRows) Values() ([]any, error) {
+	return r.values[r.index-1], nil
+}
+
+type fakeDB struct {
+	rows [][]any
+	sql  string
+	args []any
+}
+
+func (db *fakeDB) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	db.sql, db.args = sql, args
+	return &fakeRows{values: db.rows}, nil
+}
+
+func scanItem(row pgx.CollectableRow) (item, error) {
+	values, err := row.Values()
+
+	if err != nil {
+		return item{}, err
+	}
+
+	return item{Id: values[0].(int64), CreatedAt: values[1].(time.Time)}, nil
+}
+
+func rowsFrom(ids ...int64) [][]any {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := [][]any{}
+
+	for _, id := range ids {
+		rows = append(rows, []any{id, base.Add(-time.Duration(id) * time.Hour)})
+	}
+
+	return rows
+}
+
+func cursorOf(t *testing.T, link string) string {
+	t.Helper()
+
+	parsed, err := url.Parse(link)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.Query().Get("cursor")
+}
+
+func TestFetchLinksPages(t *testing.T) {
+	db := &fakeDB{rows: rowsFrom(1, 2, 3)}
+	page, err := paginate.Fetch(context.Background(), db, parse(t, "/items?limit=2&role=admin"), scanItem, "SELECT id, created_at FROM items")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Items) != 2 || page.Prev != "" || !strings.HasPrefix(page.Next, "/items?") {
+		t.Fatalf("Expected 2 items and a next link, got %+v", page)
+	}
+
+	if page.Link != "<"+page.Next+`>; rel="next"` {
+		t.Errorf("Unexpected Link header %q", page.Link)
+	}
+
+	// The next page continues after the last item, keeping the filters
+	db.rows = rowsFrom(3)
+	page, err = paginate.Fetch(context.Background(), db, parse(t, page.Next), scanItem, "SELECT id, created_at FROM items")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(db.sql, "((created_at < $2) OR (created_at = $2 AND id > $3))") || db.args[2] != int64(2) {
+		t.Errorf("Expected a keyset condition after item 2, got %q with %v", db.sql, db.args)
+	}
+
+	if len(page.Items) != 1 || page.Next != "" || page.Prev == "" {
+		t.Fatalf("Expected the last page with a prev link, got %+v", page)
+	}
+
+	// Going back reads before the first item in reverse order
+	db.rows = rowsFrom(2, 1)
+	page, err = paginate.Fetch(context.Background(), db, parse(t, page.Prev), scanItem, "SELECT id, created_at FROM items")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(db.sql, "ORDER BY created_at ASC, id DESC") || page.Items[0].Id != 1 || page.Prev != "" || page.Next == "" {
+		t.Errorf("Expected the first page read backwards, got %q and %+v", db.sql, page)
+	}
+
+	// Cursors only apply to the sort and filters they were issued for
+	_, err = list.Parse(httptest.NewRequest("GET", "/items?role=member&cursor="+cursorOf(t, page.Next), nil))
+
+	if err == nil {
+		t.Error("Expected a cursor reused with other filters to be rejected")
+	}
+}
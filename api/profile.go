@@ -0,0 +1,294 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/invites"
+	"github.com/maybemaby/oapibase/api/mail"
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+const maxProfileFieldLength = 200
+
+// patchableProfileFields are the PatchMeBody members besides email
+var patchableProfileFields = []string{"name", "givenName", "familyName", "picture", "locale"}
+
+type MeResponse struct {
+	auth.Profile
+}
+
+// PatchMeBody documents the JSON Merge Patch (RFC 7396) PatchAuthMe applies, which reads the members
+// itself to tell omitted ones from null. Omitted members are left unchanged and null clears a member
+type PatchMeBody struct {
+	_ struct{} `additionalProperties:"false"`
+	// Email starts an email change, the new email only applies once verified. It can't be removed
+	Email      *string `json:"email,omitempty" format:"email" nullable:"false"`
+	Name       *string `json:"name,omitempty" pattern:"\\S" maxLength:"200"`
+	GivenName  *string `json:"givenName,omitempty" pattern:"\\S" maxLength:"200"`
+	FamilyName *string `json:"familyName,omitempty" pattern:"\\S" maxLength:"200"`
+	Picture    *string `json:"picture,omitempty" format:"uri" pattern:"^https?://" maxLength:"2048"`
+	Locale     *string `json:"locale,omitempty" pattern:"^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$" example:"en-US"`
+	// IfMatch makes the update conditional on the ETag of GET /auth/me
+	IfMatch string `header:"If-Match" json:"-"`
+}
+
+type VerifyEmailBody struct {
+	Token string `json:"token" required:"true"`
+}
+
+func (h *AuthHandler) GetAuthMe(w http.ResponseWriter, r *http.Request) {
+	logger := RequestLogger(r)
+	sess, _ := auth.RequestUser(r)
+
+	profile, err := auth.GetProfile(r.Context(), sess.UserId, h.pool)
+
+	if err != nil {
+		logger.Error("Error getting profile", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	err = utils.WriteResponse(w, r, http.StatusOK, MeResponse{Profile: profile})
+
+	if err != nil {
+		ServerError(w, r)
+		return
+	}
+}
+
+// validateProfileField checks a non null profile value, returning a message for invalid ones
+func validateProfileField(field, value string) string {
+	switch field {
+	case "picture":
+		u, err := url.Parse(value)
+
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(value) > 2048 {
+			return "must be an http(s) URL"
+		}
+	case "locale":
+		if !localePattern.MatchString(value) {
+			return "must be a BCP 47 language tag"
+		}
+	default:
+		if strings.TrimSpace(value) == "" {
+			return "must not be blank"
+		}
+
+		if utf8.RuneCountInString(value) > maxProfileFieldLength {
+			return fmt.Sprintf("must be at most %d characters", maxProfileFieldLength)
+		}
+	}
+
+	return ""
+}
+
+// PatchAuthMe applies a JSON Merge Patch to the current user's profile
+func (h *AuthHandler) PatchAuthMe(w http.ResponseWriter, r *http.Request) {
+	logger := RequestLogger(r)
+	sess, _ := auth.RequestUser(r)
+
+	var members map[string]json.RawMessage
+
+	if !decodeBody(w, r, &members, utils.DecodeOptions{ContentTypes: []string{"application/merge-patch+json", "application/json"}}) {
+		return
+	}
+
+	if members == nil {
+		utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidBody, "Request body must be an object"))
+		return
+	}
+
+	fieldErrors := []utils.FieldError{}
+	changes := map[string]*string{}
+	var email *string
+
+	for field, raw := range members {
+		known := field == "email" || slices.Contains(patchableProfileFields, field)
+
+		var value *string
+
+		switch {
+		case !known:
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: field, Message: "unknown field"})
+		case json.Unmarshal(raw, &value) != nil:
+			fieldErrors = append(fieldErrors, utils.FieldError{Field: field, Message: "must be a string or null"})
+		case field == "email":
+			if value == nil {
+				fieldErrors = append(fieldErrors, utils.FieldError{Field: field, Message: "cannot be removed"})
+			} else if _, err := netmail.ParseAddress(*value); err != nil {
+				fieldErrors = append(fieldErrors, utils.FieldError{Field: field, Message: "must be a valid email"})
+			} else {
+				email = value
+			}
+		case value == nil:
+			changes[field] = nil
+		default:
+			if msg := validateProfileField(field, *value); msg != "" {
+				fieldErrors = append(fieldErrors, utils.FieldError{Field: field, Message: msg})
+			} else {
+				changes[field] = value
+			}
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		problem := utils.ValidationFailed(fieldErrors...)
+		problem.Detail = "Invalid profile"
+		utils.WriteProblem(w, r, problem)
+		return
+	}
+
+	current, err := auth.GetProfile(r.Context(), sess.UserId, h.pool)
+
+	if err != nil {
+		logger.Error("Error getting profile", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	if !checkIfMatch(w, r, MeResponse{Profile: current}) {
+		return
+	}
+
+	// The email change is checked up front, nothing is written until the whole patch is known to apply
+	var pending *string
+	var emailToken string
+
+	if email != nil {
+		var ok bool
+
+		if pending, emailToken, ok = h.checkEmailChange(w, r, sess.UserId, *email); !ok {
+			return
+		}
+	}
+
+	tx, err := h.pool.Begin(r.Context())
+
+	if err != nil {
+		logger.Error("Error updating profile", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	defer tx.Rollback(r.Context())
+
+	if email != nil {
+		err = auth.SetPendingEmail(r.Context(), sess.UserId, pending, tx)
+	}
+
+	if err == nil {
+		err = auth.UpdateProfile(r.Context(), sess.UserId, changes, tx)
+	}
+
+	if err == nil {
+		err = tx.Commit(r.Context())
+	}
+
+	if err != nil {
+		logger.Error("Error updating profile", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	// Mailed once the change is stored. Should delivery fail, patching the same email again resends it
+	if pending != nil {
+		err := h.mailer.Send(r.Context(), mail.Message{
+			To:      *pending,
+			Subject: "Verify your email",
+			Text:    fmt.Sprintf("Confirm your new email by opening this link:\n\n%s?token=%s\n", h.emailVerifyURL, url.QueryEscape(emailToken)),
+		})
+
+		if err != nil {
+			logger.Error("Error sending email verification", slog.Any("err", err))
+			ServerError(w, r)
+			return
+		}
+	}
+
+	h.GetAuthMe(w, r)
+}
+
+// checkEmailChange returns the pending email to store for a change to email along with its verification token,
+// nil when it is the current email and any pending change is dropped.
+// It writes the error response and returns false when the change can't be requested
+func (h *AuthHandler) checkEmailChange(w http.ResponseWriter, r *http.Request, userId int, email string) (*string, string, bool) {
+	logger := RequestLogger(r)
+	email = invites.NormalizeEmail(email)
+
+	existing, err := auth.GetUserByEmail(r.Context(), email, h.pool)
+
+	if err == nil && existing.ID == userId {
+		return nil, "", true
+	}
+
+	if err == nil {
+		utils.WriteProblem(w, r, utils.Conflict(utils.CodeEmailTaken, "Email is already in use"))
+		return nil, "", false
+	}
+
+	if err != pgx.ErrNoRows {
+		logger.Error("Error checking email", slog.Any("err", err))
+		ServerError(w, r)
+		return nil, "", false
+	}
+
+	token, err := h.jwtManager.EncodeEmailToken(userId, email)
+
+	if err != nil {
+		logger.Error("Error encoding email token", slog.Any("err", err))
+		ServerError(w, r)
+		return nil, "", false
+	}
+
+	return &email, token, true
+}
+
+// VerifyEmail confirms a pending email change with the token sent to the new email
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data VerifyEmailBody
+	logger := RequestLogger(r)
+
+	if !decodeBody(w, r, &data, utils.DecodeOptions{}) {
+		return
+	}
+
+	claims, err := h.jwtManager.ValidateEmailToken(data.Token)
+
+	if err != nil {
+		utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidToken, "Invalid token"))
+		return
+	}
+
+	err = auth.ConfirmPendingEmail(r.Context(), claims.UserId, claims.Email, h.pool)
+
+	if err == pgx.ErrNoRows {
+		utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidToken, "Invalid token"))
+		return
+	}
+
+	if isUniqueViolation(err) {
+		utils.WriteProblem(w, r, utils.Conflict(utils.CodeEmailTaken, "Email is already in use"))
+		return
+	}
+
+	if err != nil {
+		logger.Error("Error confirming email", slog.Any("err", err))
+		ServerError(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
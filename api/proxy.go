@@ -0,0 +1,329 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/justinas/alice"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type ClientOriginContextKey string
+
+const ClientOriginKey ClientOriginContextKey = "client_origin"
+
+// ClientOrigin is where a request really came from once trusted proxies are accounted for
+type ClientOrigin struct {
+	IP     netip.Addr
+	Scheme string
+	Host   string
+}
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or single IPs, like the TRUSTED_PROXIES env var
+func ParseTrustedProxies(list string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+
+	for entry := range strings.SplitSeq(list, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseNode reads an IP from a forwarding header, with or without port and IPv6 brackets.
+// Obfuscated identifiers and "unknown" are not IPs
+func parseNode(node string) (netip.Addr, bool) {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")); err == nil {
+		return addr.Unmap(), true
+	}
+
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+
+	return netip.Addr{}, false
+}
+
+// validHost accepts a host[:port] that is safe to build URLs from
+func validHost(host string) bool {
+	if host == "" || len(host) > 255 {
+		return false
+	}
+
+	return !strings.ContainsAny(host, " \t/\\@?#\"'<>")
+}
+
+func validScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+// forwardedElement is one hop of a Forwarded header (RFC 7239)
+type forwardedElement struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+// splitOutsideQuotes splits s on sep, ignoring separators in quoted strings
+func splitOutsideQuotes(s string, sep rune) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+func parseForwarded(values []string) []forwardedElement {
+	elements := []forwardedElement{}
+
+	for _, value := range values {
+		for _, element := range splitOutsideQuotes(value, ',') {
+			var parsed forwardedElement
+
+			for _, pair := range splitOutsideQuotes(element, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+
+				if !ok {
+					continue
+				}
+
+				value = strings.Trim(value, `"`)
+
+				switch strings.ToLower(key) {
+				case "for":
+					parsed.For = value
+				case "proto":
+					parsed.Proto = strings.ToLower(value)
+				case "host":
+					parsed.Host = value
+				}
+			}
+
+			elements = append(elements, parsed)
+		}
+	}
+
+	return elements
+}
+
+// clientHop walks the hops right to left, from the proxy closest to us, skipping trusted proxies.
+// The first untrusted hop is the client, anything left of it was sent by the client and can be spoofed.
+// It returns the hop's index, or -1 when the rightmost hop is unusable
+func clientHop(hops []string, trusted []netip.Prefix) (int, netip.Addr) {
+	index, client := -1, netip.Addr{}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseNode(hops[i])
+
+		// An unknown or garbled hop ends the chain, the last good hop is as far as it can be trusted
+		if !ok {
+			break
+		}
+
+		index, client = i, addr
+
+		if !isTrusted(addr, trusted) {
+			break
+		}
+	}
+
+	return index, client
+}
+
+func headerList(h http.Header, name string) []string {
+	list := []string{}
+
+	for _, value := range h.Values(name) {
+		for item := range strings.SplitSeq(value, ",") {
+			list = append(list, strings.TrimSpace(item))
+		}
+	}
+
+	return list
+}
+
+// forwardedItem picks the entry of an X-Forwarded-Proto/Host list for the client hop of X-Forwarded-For.
+// When the lists don't line up, the rightmost entry, set by the trusted proxy in front of us, is used.
+// Leftmost entries may come from the client
+func forwardedItem(h http.Header, name string, hops, index int) string {
+	list := headerList(h, name)
+
+	if len(list) == 0 {
+		return ""
+	}
+
+	if index >= 0 && len(list) == hops {
+		return list[index]
+	}
+
+	return list[len(list)-1]
+}
+
+// resolveClientOrigin applies the forwarding headers only when the direct peer is a trusted proxy.
+// Forwarded wins over X-Forwarded-For, which wins over X-Real-IP
+func resolveClientOrigin(r *http.Request, trusted []netip.Prefix) ClientOrigin {
+	origin := ClientOrigin{Scheme: "http", Host: r.Host}
+
+	if r.TLS != nil {
+		origin.Scheme = "https"
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer, ok := parseNode(host)
+
+	if !ok {
+		return origin
+	}
+
+	origin.IP = peer
+
+	if !isTrusted(peer, trusted) {
+		return origin
+	}
+
+	if forwarded := parseForwarded(r.Header.Values("Forwarded")); len(forwarded) > 0 {
+		hops := make([]string, len(forwarded))
+
+		for i, element := range forwarded {
+			hops[i] = element.For
+		}
+
+		index, client := clientHop(hops, trusted)
+
+		if index < 0 {
+			return origin
+		}
+
+		origin.IP = client
+
+		// proto and host describe the request the proxy at that hop received
+		if validScheme(forwarded[index].Proto) {
+			origin.Scheme = forwarded[index].Proto
+		}
+
+		if validHost(forwarded[index].Host) {
+			origin.Host = forwarded[index].Host
+		}
+
+		return origin
+	}
+
+	hops := headerList(r.Header, "X-Forwarded-For")
+	index := -1
+
+	if len(hops) > 0 {
+		var client netip.Addr
+
+		if index, client = clientHop(hops, trusted); index >= 0 {
+			origin.IP = client
+		}
+	} else if client, ok := parseNode(r.Header.Get("X-Real-IP")); ok {
+		origin.IP = client
+	}
+
+	if proto := strings.ToLower(forwardedItem(r.Header, "X-Forwarded-Proto", len(hops), index)); validScheme(proto) {
+		origin.Scheme = proto
+	}
+
+	if host := forwardedItem(r.Header, "X-Forwarded-Host", len(hops), index); validHost(host) {
+		origin.Host = host
+	}
+
+	return origin
+}
+
+// ClientOriginMiddleware resolves the client IP, scheme and host of every request, honoring forwarding
+// headers only from the trusted proxies. Without trusted proxies the headers are ignored entirely
+func ClientOriginMiddleware(trusted []netip.Prefix) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := resolveClientOrigin(r, trusted)
+
+			if origin.IP.IsValid() {
+				trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("client.address", origin.IP.String()))
+			}
+
+			ctx := context.WithValue(r.Context(), ClientOriginKey, origin)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequestClientOrigin returns the origin resolved by ClientOriginMiddleware, falling back to the direct peer outside of it
+func RequestClientOrigin(r *http.Request) ClientOrigin {
+	if origin, ok := r.Context().Value(ClientOriginKey).(ClientOrigin); ok {
+		return origin
+	}
+
+	return resolveClientOrigin(r, nil)
+}
+
+// ClientIP returns the real client IP, invalid if RemoteAddr isn't an IP
+func ClientIP(r *http.Request) netip.Addr {
+	return RequestClientOrigin(r).IP
+}
+
+// RequestScheme returns the scheme the client used, http or https
+func RequestScheme(r *http.Request) string {
+	return RequestClientOrigin(r).Scheme
+}
+
+// RequestHost returns the host the client asked for
+func RequestHost(r *http.Request) string {
+	return RequestClientOrigin(r).Host
+}
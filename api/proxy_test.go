@@ -0,0 +1,103 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api"
+)
+
+func resolveOrigin(t *testing.T, trusted string, remoteAddr string, headers map[string]string) api.ClientOrigin {
+	t.Helper()
+
+	proxies, err := api.ParseTrustedProxies(trusted)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var origin api.ClientOrigin
+
+	handler := api.ClientOriginMiddleware(proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin = api.RequestClientOrigin(r)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://api.internal/", nil)
+	req.RemoteAddr = remoteAddr
+
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	return origin
+}
+
+func TestClientOriginIgnoresHeadersFromUntrustedPeers(t *testing.T) {
+	origin := resolveOrigin(t, "10.0.0.0/8", "203.0.113.9:5555", map[string]string{
+		"X-Forwarded-For":   "198.51.100.1",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "evil.example",
+	})
+
+	if origin.IP.String() != "203.0.113.9" || origin.Scheme != "http" || origin.Host != "api.internal" {
+		t.Errorf("Expected the direct peer, got %+v", origin)
+	}
+}
+
+func TestClientOriginSkipsTrustedHopsAndSpoofedEntries(t *testing.T) {
+	origin := resolveOrigin(t, "10.0.0.0/8", "10.0.0.2:5555", map[string]string{
+		// The client prepended 1.1.1.1 itself, the edge proxy at 10.0.0.1 appended the real peer
+		"X-Forwarded-For":   "1.1.1.1, 198.51.100.7, 10.0.0.1",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "app.example.com",
+	})
+
+	if origin.IP.String() != "198.51.100.7" || origin.Scheme != "https" || origin.Host != "app.example.com" {
+		t.Errorf("Expected the first untrusted hop, got %+v", origin)
+	}
+}
+
+func TestClientOriginIgnoresClientSentForwardedHosts(t *testing.T) {
+	origin := resolveOrigin(t, "10.0.0.0/8", "10.0.0.1:5555", map[string]string{
+		// The client sent the leftmost proto and host, the edge proxy appended its own
+		"X-Forwarded-For":   "198.51.100.7",
+		"X-Forwarded-Proto": "http, https",
+		"X-Forwarded-Host":  "evil.example, app.example.com",
+	})
+
+	if origin.Scheme != "https" || origin.Host != "app.example.com" {
+		t.Errorf("Expected the values appended by the trusted proxy, got %+v", origin)
+	}
+}
+
+func TestClientOriginPrefersForwarded(t *testing.T) {
+	origin := resolveOrigin(t, "10.0.0.1, 2001:db8::/32", "[2001:db8::1]:443", map[string]string{
+		"Forwarded":       `for=unknown, for="[2001:db8:cafe::17]:4711";proto=https;host=app.example.com, for=10.0.0.1`,
+		"X-Forwarded-For": "192.0.2.1",
+	})
+
+	if origin.IP.String() != "2001:db8:cafe::17" {
+		t.Errorf("Expected trusted hops to be walked through, got %+v", origin)
+	}
+
+	origin = resolveOrigin(t, "10.0.0.0/8", "10.0.0.2:5555", map[string]string{
+		"Forwarded": `for=192.0.2.60;proto=https;host="app.example.com", for=_hidden`,
+	})
+
+	if origin.IP.String() != "10.0.0.2" || origin.Scheme != "http" {
+		t.Errorf("Expected an obfuscated hop to stop the walk at the peer, got %+v", origin)
+	}
+}
+
+func TestClientOriginFallsBackToXRealIP(t *testing.T) {
+	origin := resolveOrigin(t, "127.0.0.1", "127.0.0.1:5555", map[string]string{
+		"X-Real-IP": "198.51.100.3",
+	})
+
+	if origin.IP.String() != "198.51.100.3" {
+		t.Errorf("Expected X-Real-IP, got %+v", origin)
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/ratelimit"
+	"github.com/maybemaby/oapibase/api/utils"
+	"github.com/oaswrap/spec/adapter/httpopenapi"
+	"github.com/oaswrap/spec/option"
+)
+
+// RateLimitKey identifies who a request is counted against, an empty key skips limiting
+type RateLimitKey func(r *http.Request) string
+
+// RateLimitByIP counts requests against the client IP resolved by ClientOriginMiddleware
+func RateLimitByIP(r *http.Request) string {
+	ip := ClientIP(r)
+
+	if !ip.IsValid() {
+		return ""
+	}
+
+	return "ip:" + ip.String()
+}
+
+// RateLimitByUser counts requests against the session user, it must run after auth.RequireAccessToken
+func RateLimitByUser(r *http.Request) string {
+	sess, err := auth.RequestUser(r)
+
+	if err != nil {
+		return ""
+	}
+
+	return "user:" + strconv.Itoa(sess.UserId)
+}
+
+// RateLimitByAPIKey counts requests against the API key sent in header. Keys are hashed so they never hit the store
+func RateLimitByAPIKey(header string) RateLimitKey {
+	return func(r *http.Request) string {
+		key := r.Header.Get(header)
+
+		if key == "" {
+			return ""
+		}
+
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:])
+	}
+}
+
+// RateLimitFirst uses the first of keys that identifies the request, e.g. the user and then the IP
+func RateLimitFirst(keys ...RateLimitKey) RateLimitKey {
+	return func(r *http.Request) string {
+		for _, key := range keys {
+			if k := key(r); k != "" {
+				return k
+			}
+		}
+
+		return ""
+	}
+}
+
+// RateLimitedResponse documents the headers sent along with the 429 problem
+type RateLimitedResponse struct {
+	utils.Problem
+
+	RetryAfterHeader int `header:"Retry-After" json:"-"`
+	LimitHeader      int `header:"RateLimit-Limit" json:"-"`
+	RemainingHeader  int `header:"RateLimit-Remaining" json:"-"`
+	ResetHeader      int `header:"RateLimit-Reset" json:"-"`
+}
+
+// RateLimit limits a route. Name scopes the quota, routes sharing a name share quotas
+type RateLimit struct {
+	Name  string
+	Limit ratelimit.Limit
+	Key   RateLimitKey
+	Store ratelimit.Store
+}
+
+// seconds rounds d up so clients never retry early
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func (l RateLimit) setHeaders(h http.Header, res ratelimit.Result) {
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(res.ResetAfter)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.Limit.Requests, seconds(l.Limit.Period)))
+}
+
+// Middleware rejects requests over the limit with a 429. Store errors let the request through
+func (l RateLimit) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := l.Key(r)
+
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res, err := l.Store.Take(r.Context(), l.Name+":"+key, l.Limit)
+
+		if err != nil {
+			RequestLogger(r).Error("Error checking rate limit", slog.Any("err", err), slog.String("limit", l.Name))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		l.setHeaders(w.Header(), res)
+
+		if !res.Allowed {
+			retryAfter := seconds(res.RetryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+			utils.WriteProblem(w, r, utils.NewProblem(http.StatusTooManyRequests, utils.CodeRateLimited,
+				fmt.Sprintf("Retry in %d seconds", retryAfter)))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimited documents the 429 response of a route limited by l
+func RateLimited(l RateLimit) option.OperationOption {
+	return option.Response(http.StatusTooManyRequests, new(RateLimitedResponse),
+		option.ContentType(utils.ProblemContentType),
+		option.ContentDescription(fmt.Sprintf("Rate limited to %d requests per %s", l.Limit.Requests, l.Limit.Period)),
+	)
+}
+
+// Handle registers handler behind chain and the rate limit, and documents the limit on the route
+func (l RateLimit) Handle(router httpopenapi.Router, pattern string, chain alice.Chain, handler http.HandlerFunc) httpopenapi.Route {
+	return router.Handle(pattern, chain.Append(l.Middleware).ThenFunc(handler)).With(RateLimited(l))
+}
@@ -0,0 +1,86 @@
+// Package ratelimit implements the generic cell rate algorithm (GCRA) on top of pluggable stores.
+// GCRA behaves like a token bucket but only needs a single timestamp per key, the theoretical
+// arrival time (TAT) of the next request
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Limit allows Requests per Period, with bursts of up to Burst requests. Burst defaults to Requests
+type Limit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+func PerSecond(requests int) Limit {
+	return Limit{Requests: requests, Period: time.Second}
+}
+
+func PerMinute(requests int) Limit {
+	return Limit{Requests: requests, Period: time.Minute}
+}
+
+func PerHour(requests int) Limit {
+	return Limit{Requests: requests, Period: time.Hour}
+}
+
+// interval is the time it takes to earn back a single request
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Requests)
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+
+	return l.Requests
+}
+
+// Result is the outcome of taking a request from a key's quota
+type Result struct {
+	Allowed bool
+	// Limit is the burst size, the most requests that can be made at once
+	Limit     int
+	Remaining int
+	// ResetAfter is how long until the quota is fully replenished
+	ResetAfter time.Duration
+	// RetryAfter is how long until the next request is allowed, zero when Allowed
+	RetryAfter time.Duration
+}
+
+// Store keeps the TAT of every key. Take must atomically check and update it
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// gcra decides whether a request arriving at now is allowed given the stored tat.
+// It returns the tat to store, which is unchanged when the request is denied
+func gcra(now, tat time.Time, limit Limit) (time.Time, Result) {
+	interval := limit.interval()
+	tolerance := interval * time.Duration(limit.burst())
+
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTat := tat.Add(interval)
+	allowAt := newTat.Add(-tolerance)
+
+	res := Result{Limit: limit.burst()}
+
+	if now.Before(allowAt) {
+		res.RetryAfter = allowAt.Sub(now)
+		res.ResetAfter = tat.Sub(now)
+		return tat, res
+	}
+
+	res.Allowed = true
+	res.ResetAfter = newTat.Sub(now)
+	res.Remaining = int((tolerance - res.ResetAfter) / interval)
+
+	return newTat, res
+}
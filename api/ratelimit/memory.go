@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many takes a shard serves between sweeps of its expired keys
+const sweepEvery = 1024
+
+type shard struct {
+	mu    sync.Mutex
+	tats  map[string]time.Time
+	takes int
+}
+
+// sweep drops keys whose quota is fully replenished, they behave exactly like missing keys
+func (s *shard) sweep(now time.Time) {
+	for key, tat := range s.tats {
+		if !tat.After(now) {
+			delete(s.tats, key)
+		}
+	}
+}
+
+// MemoryStore keeps TATs in process, split across shards to reduce lock contention.
+// Limits are per instance, use PostgresStore when running several
+type MemoryStore struct {
+	seed   maphash.Seed
+	shards []*shard
+	now    func() time.Time
+}
+
+// NewMemoryStore creates a store with the given number of shards, at least one
+func NewMemoryStore(shards int) *MemoryStore {
+	shards = max(shards, 1)
+
+	store := &MemoryStore{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*shard, shards),
+		now:    time.Now,
+	}
+
+	for i := range store.shards {
+		store.shards[i] = &shard{tats: map[string]time.Time{}}
+	}
+
+	return store
+}
+
+func (m *MemoryStore) shard(key string) *shard {
+	return m.shards[maphash.String(m.seed, key)%uint64(len(m.shards))]
+}
+
+func (m *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := m.now()
+	s := m.shard(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.takes++
+	if s.takes%sweepEvery == 0 {
+		s.sweep(now)
+	}
+
+	tat, res := gcra(now, s.tats[key], limit)
+	s.tats[key] = tat
+
+	return res, nil
+}
@@ -0,0 +1,40 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/maybemaby/oapibase/api/ratelimit"
+)
+
+func TestMemoryStoreAllowsBurstThenDenies(t *testing.T) {
+	store := ratelimit.NewMemoryStore(4)
+	limit := ratelimit.PerMinute(3)
+
+	for i := range 3 {
+		res, err := store.Take(context.Background(), "ip:1", limit)
+
+		if err != nil || !res.Allowed {
+			t.Fatalf("Expected request %d to be allowed, got %+v %v", i, res, err)
+		}
+
+		if res.Remaining != 2-i {
+			t.Errorf("Expected %d remaining, got %d", 2-i, res.Remaining)
+		}
+	}
+
+	res, _ := store.Take(context.Background(), "ip:1", limit)
+
+	if res.Allowed {
+		t.Fatal("Expected request over the burst to be denied")
+	}
+
+	if res.RetryAfter <= 0 || res.RetryAfter > 20*time.Second {
+		t.Errorf("Expected retry within one interval, got %s", res.RetryAfter)
+	}
+
+	if res, _ := store.Take(context.Background(), "ip:2", limit); !res.Allowed {
+		t.Error("Expected other keys to be unaffected")
+	}
+}
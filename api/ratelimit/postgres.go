@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore shares TATs between instances through the rate_limits table.
+// The database clock is used so instances with skewed clocks agree
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresStore(pool *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{pool: pool}
+}
+
+func (p *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	tx, err := p.pool.Begin(ctx)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "INSERT INTO rate_limits (key, tat) VALUES ($1, now()) ON CONFLICT (key) DO NOTHING", key)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	var stored, now time.Time
+
+	err = tx.QueryRow(ctx, "SELECT tat, now() FROM rate_limits WHERE key = $1 FOR UPDATE", key).Scan(&stored, &now)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	tat, res := gcra(now, stored, limit)
+
+	if res.Allowed {
+		_, err = tx.Exec(ctx, "UPDATE rate_limits SET tat = $2 WHERE key = $1", key, tat)
+
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	return res, tx.Commit(ctx)
+}
+
+// Purge deletes keys whose quota is fully replenished
+func (p *PostgresStore) Purge(ctx context.Context) (int64, error) {
+	tag, err := p.pool.Exec(ctx, "DELETE FROM rate_limits WHERE tat <= now()")
+
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
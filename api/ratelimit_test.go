@@ -0,0 +1,42 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api"
+	"github.com/maybemaby/oapibase/api/ratelimit"
+)
+
+func TestRateLimitRejectsOverLimit(t *testing.T) {
+	limit := api.RateLimit{
+		Name:  "test",
+		Limit: ratelimit.PerMinute(2),
+		Key:   api.RateLimitByIP,
+		Store: ratelimit.NewMemoryStore(1),
+	}
+
+	handler := limit.Middleware(http.HandlerFunc(okHandler))
+	codes := []int{}
+
+	for range 3 {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/auth/login", nil))
+		codes = append(codes, rec.Code)
+
+		if rec.Code == http.StatusTooManyRequests {
+			if rec.Header().Get("Retry-After") != "30" {
+				t.Errorf("Expected Retry-After 30, got %q", rec.Header().Get("Retry-After"))
+			}
+
+			if rec.Header().Get("RateLimit-Remaining") != "0" {
+				t.Errorf("Expected no remaining requests, got %q", rec.Header().Get("RateLimit-Remaining"))
+			}
+		}
+	}
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("Expected two allowed requests then a 429, got %v", codes)
+	}
+}
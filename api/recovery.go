@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/justinas/alice"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RecoveryMiddleware turns handler panics into a logged, traced and counted 500.
+// It should run after LoggingMiddleware so the stack trace is logged with the request context
+func RecoveryMiddleware() alice.Constructor {
+	panics, err := otel.Meter("api").Int64Counter(
+		"http.server.panics",
+		metric.WithDescription("Number of requests that panicked in a handler"),
+		metric.WithUnit("{panic}"),
+	)
+
+	if err != nil {
+		otel.Handle(err)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			defer func() {
+				recovered := recover()
+
+				if recovered == nil {
+					return
+				}
+
+				// The server uses ErrAbortHandler to cut a response short on purpose
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				err := fmt.Errorf("panic: %v", recovered)
+				stack := string(debug.Stack())
+
+				RequestLogger(r).Error("Recovered from panic", slog.Any("err", err), slog.String("stack", stack))
+
+				span := trace.SpanFromContext(r.Context())
+				span.RecordError(err, trace.WithAttributes(attribute.String("exception.stacktrace", stack)))
+				span.SetStatus(codes.Error, err.Error())
+
+				if panics != nil {
+					panics.Add(context.WithoutCancel(r.Context()), 1, metric.WithAttributes(
+						attribute.String("http.request.method", r.Method),
+						attribute.String("http.route", r.Pattern),
+					))
+				}
+
+				if rec.wroteHeader {
+					// Too late for a proper error, abort so the client sees a broken response rather than a truncated one
+					panic(http.ErrAbortHandler)
+				}
+
+				ServerError(rec, r)
+			}()
+
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
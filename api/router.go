@@ -1,12 +1,24 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"net/http"
 	"os"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/justinas/alice"
 	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/invites"
+	"github.com/maybemaby/oapibase/api/orgs"
+	"github.com/maybemaby/oapibase/api/paginate"
+	"github.com/maybemaby/oapibase/api/ratelimit"
 	"github.com/oaswrap/spec-ui/config"
 	"github.com/oaswrap/spec/adapter/httpopenapi"
 	"github.com/oaswrap/spec/option"
@@ -18,21 +30,71 @@ func httpSpanName(operation string, r *http.Request) string {
 }
 
 func (s *Server) MountRoutesOapi() {
+	mux, _ := s.routes()
 
+	handler := alice.New(
+		ClientOriginMiddleware(s.trustedProxies),
+		SecurityHeadersMiddleware(s.security),
+		CorsMiddleware(s.cors),
+		CompressMiddleware(CompressOptions{}),
+	).Then(mux)
+
+	// Probes come from the orchestrator by pod IP, they skip host checks and tracing
+	root := http.NewServeMux()
+	root.Handle("/", otelhttp.NewHandler(handler, "server", otelhttp.WithSpanNameFormatter(httpSpanName)))
+	s.mountHealthChecks(root)
+
+	s.srv = newHTTPServer(":"+s.port, root, s.httpConfig)
+}
+
+// routes registers every route of the API on a new mux along with its OpenAPI operation.
+// Nothing is connected to until a request comes in, so it also serves to generate the spec offline
+func (s *Server) routes() (*http.ServeMux, httpopenapi.Generator) {
 	mux := http.NewServeMux()
 
 	authHandler := &AuthHandler{
+		jwtManager:     s.jwtManager,
+		invites:        s.invites,
+		mailer:         s.mailer,
+		emailVerifyURL: os.Getenv("EMAIL_VERIFY_URL"),
+		pool:           s.pool,
+	}
+
+	orgHandler := &OrgHandler{
 		jwtManager: s.jwtManager,
 		pool:       s.pool,
 	}
 
-	googleHandler := NewGoogleHandler(s.pool, s.jwtManager)
+	inviteHandler := &InviteHandler{
+		jwtManager: s.jwtManager,
+		invites:    s.invites,
+		pool:       s.pool,
+	}
+
+	googleHandler := NewGoogleHandler(s.pool, s.jwtManager, s.invites)
 
 	rootMw := RootMiddleware(s.logger, MiddlewareConfig{
-		CorsOrigin: "http://localhost:3001",
+		MaxBodyBytes:   64 << 10,
+		HandlerTimeout: time.Second * 15,
+	})
+
+	// Streaming responses outlive the default handler and write timeouts
+	streamMw := RootMiddleware(s.logger, MiddlewareConfig{
+		WriteTimeout: time.Minute * 10,
 	})
 
 	authMw := rootMw.Append(auth.RequireAccessToken(s.jwtManager))
+	adminMw := authMw.Append(auth.RequireRole(auth.RoleAdmin))
+	idempotentMw := IdempotencyMiddleware(s.pool, IdempotencyOptions{})
+	signupIdempotentMw := IdempotencyMiddleware(s.pool, s.signupIdempotency)
+	orgMw := authMw.Append(orgs.RequireMembership(s.pool))
+	orgAdminMw := orgMw.Append(orgs.RequireRole(orgs.RoleAdmin))
+	orgOwnerMw := orgMw.Append(orgs.RequireRole(orgs.RoleOwner))
+
+	loginLimit := RateLimit{Name: "login", Limit: ratelimit.PerMinute(10), Key: RateLimitByIP, Store: s.rateLimits}
+	signupLimit := RateLimit{Name: "signup", Limit: ratelimit.PerHour(20), Key: RateLimitByIP, Store: s.rateLimits}
+	cspReportLimit := RateLimit{Name: "csp-report", Limit: ratelimit.PerMinute(60), Key: RateLimitByIP, Store: s.rateLimits}
+	tokenLimit := RateLimit{Name: "token", Limit: ratelimit.PerMinute(10), Key: RateLimitFirst(RateLimitByUser, RateLimitByIP), Store: s.rateLimits}
 
 	r := httpopenapi.NewGenerator(mux,
 		option.WithTitle("oapibase"),
@@ -55,7 +117,7 @@ func (s *Server) MountRoutesOapi() {
 			spec, err := r.MarshalJSON()
 
 			if err != nil {
-				http.Error(w, "Error generating OpenAPI spec", http.StatusInternalServerError)
+				ServerError(w, req)
 				return
 			}
 
@@ -66,77 +128,332 @@ func (s *Server) MountRoutesOapi() {
 
 	authRoute := r.Group("/auth").With(option.GroupTags("auth"))
 
-	authRoute.Handle("GET /me", authMw.ThenFunc(authHandler.GetAuthMe)).With(
-		option.Response(200, new(MeResponse)),
-		option.Response(401, "Unauthorized"),
+	authRoute.Handle("GET /me", authMw.Append(PrivateRevalidate.Middleware).ThenFunc(authHandler.GetAuthMe)).With(
+		ResponsesWithDefault(map[int]any{
+			200: new(MeResponse),
+			401: "Unauthorized",
+		}),
+		Cacheable(PrivateRevalidate),
+	)
+
+	authRoute.Handle("PATCH /me", authMw.ThenFunc(authHandler.PatchAuthMe)).With(
+		option.Summary("Update the current user's profile"),
+		option.Description("Applies a JSON Merge Patch, sent as application/merge-patch+json or application/json. Null clears a field. A changed email is only applied once verified."),
+		Request(new(PatchMeBody), "application/merge-patch+json", "application/json"),
+		ResponsesWithDefault(map[int]any{
+			200: new(MeResponse),
+			401: "Unauthorized",
+			409: "Email is already in use",
+			400: "Invalid request body",
+			412: "The resource changed since it was fetched",
+			413: "Request body too large",
+			415: "Unsupported content type",
+			422: "Invalid profile",
+		}),
+	)
+
+	tokenLimit.Handle(authRoute, "POST /me/email/verify", rootMw, authHandler.VerifyEmail).With(
+		option.Summary("Confirm an email change"),
+		Request(new(VerifyEmailBody)),
+		ResponsesWithDefault(map[int]any{
+			204: nil,
+			400: "Invalid token",
+			401: "Unauthorized",
+			409: "Email is already in use",
+			422: "Validation failed",
+		}),
+	)
+
+	authRoute.Handle("DELETE /me", authMw.ThenFunc(authHandler.DeleteAuthMe)).With(
+		option.Summary("Schedule the current user for deletion"),
+		option.Description("Requires the password, or a login within the last few minutes for users without one. Sole owners of organizations with other members must transfer ownership first. The account can be restored until deleteAfter."),
+		Request(new(DeleteMeBody)),
+		ResponsesWithDefault(map[int]any{
+			202: new(DeleteMeResponse),
+			400: "Invalid request body",
+			401: "Invalid password or recent login required",
+			409: "Sole owner of organizations with other members",
+		}),
+	)
+
+	authRoute.Handle("POST /me/restore", authMw.ThenFunc(authHandler.RestoreAuthMe)).With(
+		option.Summary("Cancel a pending deletion of the current user"),
+		ResponsesWithDefault(map[int]any{
+			204: nil,
+			401: "Unauthorized",
+		}),
+	)
+
+	authRoute.Handle("GET /me/export", streamMw.Append(auth.RequireAccessToken(s.jwtManager)).ThenFunc(authHandler.ExportAuthMe)).With(
+		option.Summary("Download everything stored about the current user"),
+		ResponsesWithDefault(map[int]any{
+			200: Encoded(new(UserExport), "application/json"),
+			401: "Unauthorized",
+		}),
+	)
+
+	// Idempotency runs inside the limit so retries count against it
+	signupLimit.Handle(authRoute, "POST /signup", rootMw, signupIdempotentMw(http.HandlerFunc(authHandler.SignupJWT)).ServeHTTP).With(
+		Request(new(PassSignupBody)),
+		ResponsesWithDefault(map[int]any{
+			201: new(LoginJwtResponse),
+			400: "Invalid request body",
+			403: "Signup is invite only",
+			422: "Validation failed",
+		}),
+		Idempotent(),
 	)
 
-	authRoute.Handle("POST /signup", rootMw.ThenFunc(authHandler.SignupJWT)).With(
-		option.Request(new(PassSignupBody)),
+	loginLimit.Handle(authRoute, "POST /login", rootMw, authHandler.LoginJWT).With(
+		Request(new(PassLoginBody)),
 		ResponsesWithDefault(map[int]any{
 			200: new(LoginJwtResponse),
+			400: "Invalid request body",
+			401: "Invalid email or password",
 		}),
 	)
 
-	authRoute.Handle("POST /login", rootMw.ThenFunc(authHandler.LoginJWT)).With(
-		option.Request(new(PassLoginBody)),
+	authRoute.Handle("GET /google", rootMw.ThenFunc(googleHandler.HandleAuth)).With(
+		Request(new(GoogleAuthQuery)),
+		ResponsesWithDefault(map[int]any{
+			302: nil,
+		}),
+	)
+	authRoute.Handle("GET /google/callback", rootMw.ThenFunc(googleHandler.HandleCallback)).With(
+		ResponsesWithDefault(map[int]any{
+			200: nil,
+			400: "Invalid state, unverified email or invalid invite",
+			403: "Signup is invite only",
+			409: "Email belongs to an account not linked to Google",
+		}),
+	)
+
+	Op(orgHandler.CreateOrg).Status(http.StatusCreated).Mount(r, "POST /orgs", authMw.Append(idempotentMw)).With(
+		option.Tags("orgs"),
+		option.Security("bearerAuth"),
+		option.Summary("Create an organization owned by the current user"),
 		Responses(map[int]any{
-			401: new(AuthErrorResponse),
-			200: new(LoginJwtResponse),
+			401: "Unauthorized",
+			409: "Slug is already taken",
 		}),
+		Idempotent(),
 	)
 
-	authRoute.Handle("GET /google", rootMw.ThenFunc(googleHandler.HandleAuth))
-	authRoute.Handle("GET /google/callback", rootMw.ThenFunc(googleHandler.HandleCallback))
-	
-	mux.Handle("/", rootMw.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
-			return
+	Op(orgHandler.ListOrgs).Mount(r, "GET /orgs", authMw.Append(PrivateRevalidate.Middleware)).With(
+		option.Tags("orgs"),
+		option.Security("bearerAuth"),
+		option.Summary("List the organizations the current user is a member of"),
+		Responses(map[int]any{
+			401: "Unauthorized",
+		}),
+		Cacheable(PrivateRevalidate),
+	)
+
+	orgRoute := r.Group("/orgs").With(option.GroupTags("orgs"), option.GroupSecurity("bearerAuth"))
+
+	Op(orgHandler.GetOrg).Mount(orgRoute, "GET /{orgId}", orgMw.Append(PrivateRevalidate.Middleware)).With(
+		Responses(map[int]any{
+			403: "Forbidden",
+		}),
+		Cacheable(PrivateRevalidate),
+	)
+
+	Op(orgHandler.UpdateOrg).Mount(orgRoute, "PATCH /{orgId}", orgAdminMw).With(
+		Responses(map[int]any{
+			403: "Forbidden",
+			412: "The resource changed since it was fetched",
+		}),
+	)
+
+	Op(orgHandler.DeleteOrg).Mount(orgRoute, "DELETE /{orgId}", orgOwnerMw).With(
+		Responses(map[int]any{
+			403: "Forbidden",
+		}),
+	)
+
+	Op(orgHandler.SwitchOrg).Mount(orgRoute, "POST /{orgId}/switch", orgMw).With(
+		option.Summary("Issue tokens with the organization as the active org"),
+		Responses(map[int]any{
+			403: "Forbidden",
+		}),
+	)
+
+	Op(orgHandler.ListMembers).Mount(orgRoute, "GET /{orgId}/members", orgMw.Append(PrivateRevalidate.Middleware)).With(
+		Responses(map[int]any{
+			403: "Forbidden",
+		}),
+		Cacheable(PrivateRevalidate),
+	)
+
+	Op(orgHandler.AddMember).Status(http.StatusCreated).Mount(orgRoute, "POST /{orgId}/members", orgAdminMw.Append(idempotentMw)).With(
+		Responses(map[int]any{
+			403: "Forbidden",
+			404: "User not found",
+			409: "User is already a member",
+		}),
+		Idempotent(),
+	)
+
+	Op(orgHandler.UpdateMember).Mount(orgRoute, "PATCH /{orgId}/members/{userId}", orgAdminMw).With(
+		Responses(map[int]any{
+			403: "Forbidden",
+			404: "Member not found",
+			409: "Organization must keep at least one owner",
+		}),
+	)
+
+	Op(orgHandler.RemoveMember).Mount(orgRoute, "DELETE /{orgId}/members/{userId}", orgMw).With(
+		option.Summary("Remove a member, or leave the organization when userId is the current user"),
+		Responses(map[int]any{
+			403: "Forbidden",
+			404: "Member not found",
+			409: "Organization must keep at least one owner",
+		}),
+	)
+
+	inviteRoute := r.Group("/invites").With(option.GroupTags("invites"), option.GroupSecurity("bearerAuth"))
+
+	Op(inviteHandler.AcceptInvite).Mount(inviteRoute, "POST /accept", authMw.Append(tokenLimit.Middleware)).With(
+		option.Summary("Accept an invite as the current user"),
+		Responses(map[int]any{
+			400: "Invalid invite",
+		}),
+		RateLimited(tokenLimit),
+	)
+
+	Op(inviteHandler.RevokeInvite).Mount(inviteRoute, "DELETE /{inviteId}", adminMw).With(
+		Responses(map[int]any{
+			403: "Forbidden",
+			404: "Invite not found",
+		}),
+	)
+
+	Op(inviteHandler.CreateInvite).Status(http.StatusCreated).Mount(r, "POST /invites", adminMw.Append(idempotentMw)).With(
+		option.Tags("invites"),
+		option.Security("bearerAuth"),
+		option.Summary("Invite an email to the app"),
+		Responses(map[int]any{
+			403: "Forbidden",
+		}),
+		Idempotent(),
+	)
+
+	r.Handle("GET /invites", adminMw.ThenFunc(inviteHandler.ListInvites)).With(
+		option.Tags("invites"),
+		option.Security("bearerAuth"),
+		option.Summary("List pending app invites"),
+		invites.PendingList.Parameters(),
+		ResponsesWithDefault(map[int]any{
+			200: new(paginate.Page[invites.Invite]),
+			400: "Invalid pagination parameters",
+			403: "Forbidden",
+		}),
+	)
+
+	Op(inviteHandler.CreateOrgInvite).Status(http.StatusCreated).Mount(orgRoute, "POST /{orgId}/invites", orgAdminMw.Append(idempotentMw)).With(
+		option.Summary("Invite an email to the organization"),
+		Responses(map[int]any{
+			403: "Forbidden",
+		}),
+		Idempotent(),
+	)
+
+	orgRoute.Handle("GET /{orgId}/invites", orgAdminMw.ThenFunc(inviteHandler.ListInvites)).With(
+		Request(new(OrgPath)),
+		invites.PendingList.Parameters(),
+		ResponsesWithDefault(map[int]any{
+			200: new(paginate.Page[invites.Invite]),
+			400: "Invalid pagination parameters",
+			403: "Forbidden",
+		}),
+	)
+
+	Op(inviteHandler.RevokeOrgInvite).Mount(orgRoute, "DELETE /{orgId}/invites/{inviteId}", orgAdminMw).With(
+		Responses(map[int]any{
+			403: "Forbidden",
+			404: "Invite not found",
+		}),
+	)
+
+	mux.Handle("POST "+CSPReportPath, rootMw.Append(cspReportLimit.Middleware).ThenFunc(CSPReportHandler))
+
+	mux.Handle("/", rootMw.ThenFunc(http.NotFound))
+
+	return mux, r
+}
+
+// GenerateSpec builds the routes without a database or any configuration and writes the OpenAPI
+// document as json or yaml. The output only changes along with the routes
+func GenerateSpec(format string) ([]byte, error) {
+	s := &Server{logger: slog.New(slog.DiscardHandler), prod: true}
+	_, r := s.routes()
+
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "json":
+		spec, err := r.MarshalJSON()
+
+		if err != nil {
+			return nil, err
+		}
+
+		var out bytes.Buffer
+
+		if err := json.Indent(&out, spec, "", "  "); err != nil {
+			return nil, err
 		}
 
-		http.NotFound(w,r)
-	}))
+		out.WriteByte('\n')
 
-	srv := &http.Server{
-		Addr:    ":" + s.port,
-		Handler: otelhttp.NewHandler(mux, "server", otelhttp.WithSpanNameFormatter(httpSpanName)),
+		return out.Bytes(), nil
+	case "yaml":
+		return r.MarshalYAML()
 	}
 
-	s.srv = srv
+	return nil, fmt.Errorf("unsupported spec format %q, use json or yaml", format)
 }
 
+// MountSpa serves the SPA in filesys, unknown paths get index.html for client side routing.
+// index.html gets the request's CSP nonce in place of SpaNoncePlaceholder and is never cached
 func MountSpa(mux *http.ServeMux, pattern string, filesys fs.FS) {
 	fileServer := http.FileServer(http.FS(filesys))
 
 	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
-
-		// Try to open the requested file
-		file, err := filesys.Open(path)
-		if err == nil {
-			// File exists, close it and let the file server handle it
-			file.Close()
-			fileServer.ServeHTTP(w, r)
-			return
-		}
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
 
-		// File doesn't exist, check if it's a not found error
-		if os.IsNotExist(err) {
-			// Serve index.html as fallback for SPA routing
-			indexData, err := fs.ReadFile(filesys, "index.html")
-			if err != nil {
-				http.Error(w, "Index file not found", http.StatusInternalServerError)
+		if name != "" && name != "index.html" {
+			// Try to open the requested file
+			file, err := filesys.Open(name)
+
+			if err == nil {
+				// File exists, close it and let the file server handle it
+				file.Close()
+				fileServer.ServeHTTP(w, r)
+				return
+			}
+
+			if !errors.Is(err, fs.ErrNotExist) {
+				ServerError(w, r)
 				return
 			}
+		}
 
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-			w.Write(indexData)
+		// Serve index.html as fallback for SPA routing
+		indexData, err := fs.ReadFile(filesys, "index.html")
+
+		if err != nil {
+			ServerError(w, r)
 			return
 		}
 
-		// Other error occurred
-		http.Error(w, "Error accessing file", http.StatusInternalServerError)
+		indexData = bytes.ReplaceAll(indexData, []byte(SpaNoncePlaceholder), []byte(CSPNonce(r)))
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(indexData)
 	})
 }
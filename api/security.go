@@ -0,0 +1,289 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/justinas/alice"
+	"github.com/maybemaby/oapibase/api/utils"
+	"github.com/unrolled/secure"
+)
+
+// CSPReportPath receives Content-Security-Policy violation reports, see CSPReportHandler
+const CSPReportPath = "/csp-report"
+
+// SpaNoncePlaceholder is replaced with the request's CSP nonce in the SPA index.html.
+// The frontend build stamps it on its script and style tags through Vite's html.cspNonce
+const SpaNoncePlaceholder = "__CSP_NONCE__"
+
+// defaultContentSecurityPolicy suits the API and the SPA, inline styles are allowed for the UI libraries injecting them
+const defaultContentSecurityPolicy = "default-src 'self'; script-src 'self' $NONCE; style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data:; font-src 'self'; connect-src 'self'; object-src 'none'; base-uri 'self'; " +
+	"form-action 'self'; frame-ancestors 'none'"
+
+// SecurityConfig declares the security headers sent with every response and the hosts the server answers to
+type SecurityConfig struct {
+	// AllowedHosts are the hosts requests may be addressed to, exact or with a leading "*." wildcard.
+	// Entries without a port match any port. Empty allows every host
+	AllowedHosts []string
+	// HSTSMaxAge enables Strict-Transport-Security, browsers ignore it over plain HTTP
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+	// ContentSecurityPolicy may use $NONCE for a per request nonce, see CSPNonce
+	ContentSecurityPolicy string
+	// CSPReportOnly reports violations without enforcing the policy
+	CSPReportOnly bool
+	// CSPReportPath is added to the policy as report-uri and report-to when set
+	CSPReportPath           string
+	FrameOptions            string
+	ReferrerPolicy          string
+	PermissionsPolicy       string
+	CrossOriginOpenerPolicy string
+}
+
+// ProductionSecurity enforces the default policy and HSTS, and only answers to hosts
+func ProductionSecurity(hosts []string) SecurityConfig {
+	return SecurityConfig{
+		AllowedHosts:            hosts,
+		HSTSMaxAge:              time.Hour * 24 * 365,
+		HSTSIncludeSubdomains:   true,
+		ContentSecurityPolicy:   defaultContentSecurityPolicy,
+		CSPReportPath:           CSPReportPath,
+		FrameOptions:            "DENY",
+		ReferrerPolicy:          "strict-origin-when-cross-origin",
+		PermissionsPolicy:       "camera=(), microphone=(), geolocation=(), payment=()",
+		CrossOriginOpenerPolicy: "same-origin",
+	}
+}
+
+// DevelopmentSecurity only reports policy violations so local tooling keeps working, and skips HSTS and host checks
+func DevelopmentSecurity() SecurityConfig {
+	cfg := ProductionSecurity(nil)
+	cfg.HSTSMaxAge = 0
+	cfg.HSTSIncludeSubdomains = false
+	cfg.CSPReportOnly = true
+
+	return cfg
+}
+
+// defaultSecurityConfig picks the preset for the mode, production requires ALLOWED_HOSTS
+func defaultSecurityConfig(isProd bool) (SecurityConfig, error) {
+	if !isProd {
+		return DevelopmentSecurity(), nil
+	}
+
+	hosts := []string{}
+
+	for _, host := range strings.Split(os.Getenv("ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	if len(hosts) == 0 {
+		return SecurityConfig{}, errors.New("ALLOWED_HOSTS is required in production")
+	}
+
+	return ProductionSecurity(hosts), nil
+}
+
+// hostAllowed matches host, as sent by the client, against AllowedHosts entries
+func hostAllowed(host string, allowed []string) bool {
+	host = strings.ToLower(host)
+	hostname, _, err := net.SplitHostPort(host)
+
+	if err != nil {
+		hostname = host
+	}
+
+	for _, entry := range allowed {
+		candidate := host
+
+		if !strings.Contains(entry, ":") {
+			candidate = hostname
+		}
+
+		if suffix, ok := strings.CutPrefix(entry, "*"); ok {
+			if strings.HasSuffix(candidate, suffix) && len(candidate) > len(suffix) {
+				return true
+			}
+
+			continue
+		}
+
+		if candidate == entry {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SecurityHeadersMiddleware rejects requests for hosts outside AllowedHosts, checked against the host
+// resolved by ClientOriginMiddleware, and sets the configured security headers on every response
+func SecurityHeadersMiddleware(cfg SecurityConfig) alice.Constructor {
+	policy := cfg.ContentSecurityPolicy
+
+	if policy != "" && cfg.CSPReportPath != "" {
+		policy += "; report-uri " + cfg.CSPReportPath + "; report-to csp"
+	}
+
+	opts := secure.Options{
+		STSSeconds:           int64(cfg.HSTSMaxAge.Seconds()),
+		STSIncludeSubdomains: cfg.HSTSIncludeSubdomains,
+		STSPreload:           cfg.HSTSPreload,
+		// TLS may end at a proxy, and browsers ignore the header over plain HTTP anyway
+		ForceSTSHeader:          true,
+		ContentTypeNosniff:      true,
+		CustomFrameOptionsValue: cfg.FrameOptions,
+		ReferrerPolicy:          cfg.ReferrerPolicy,
+		PermissionsPolicy:       cfg.PermissionsPolicy,
+		CrossOriginOpenerPolicy: cfg.CrossOriginOpenerPolicy,
+	}
+
+	if cfg.CSPReportOnly {
+		opts.ContentSecurityPolicyReportOnly = policy
+	} else {
+		opts.ContentSecurityPolicy = policy
+	}
+
+	secureMw := secure.New(opts)
+
+	return func(next http.Handler) http.Handler {
+		withHeaders := secureMw.Handler(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(cfg.AllowedHosts) > 0 && !hostAllowed(RequestHost(r), cfg.AllowedHosts) {
+				utils.WriteProblem(w, r, utils.BadRequest(utils.CodeInvalidHost, "Invalid host"))
+				return
+			}
+
+			if policy != "" && cfg.CSPReportPath != "" {
+				w.Header().Set("Reporting-Endpoints", `csp="`+cfg.CSPReportPath+`"`)
+			}
+
+			withHeaders.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CSPNonce returns the request's nonce for $NONCE in the Content-Security-Policy, empty when the policy has none
+func CSPNonce(r *http.Request) string {
+	return secure.CSPNonce(r.Context())
+}
+
+// cspViolation holds the fields worth logging of either report format
+type cspViolation struct {
+	DocumentURL string `json:"documentURL"`
+	Directive   string `json:"effectiveDirective"`
+	BlockedURL  string `json:"blockedURL"`
+	SourceFile  string `json:"sourceFile"`
+	LineNumber  int    `json:"lineNumber"`
+	Disposition string `json:"disposition"`
+}
+
+// legacyCSPViolation is the body of a report-uri report
+type legacyCSPViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	BlockedURI         string `json:"blocked-uri"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+	Disposition        string `json:"disposition"`
+}
+
+func parseCSPReports(mediaType string, body []byte) ([]cspViolation, error) {
+	if mediaType == "application/reports+json" {
+		var batch []struct {
+			Type string       `json:"type"`
+			Body cspViolation `json:"body"`
+		}
+
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, err
+		}
+
+		violations := []cspViolation{}
+
+		for _, report := range batch {
+			if report.Type == "csp-violation" {
+				violations = append(violations, report.Body)
+			}
+		}
+
+		return violations, nil
+	}
+
+	var legacy struct {
+		Report legacyCSPViolation `json:"csp-report"`
+	}
+
+	if err := json.Unmarshal(body, &legacy); err != nil {
+		return nil, err
+	}
+
+	directive := legacy.Report.EffectiveDirective
+
+	if directive == "" {
+		directive = legacy.Report.ViolatedDirective
+	}
+
+	return []cspViolation{{
+		DocumentURL: legacy.Report.DocumentURI,
+		Directive:   directive,
+		BlockedURL:  legacy.Report.BlockedURI,
+		SourceFile:  legacy.Report.SourceFile,
+		LineNumber:  legacy.Report.LineNumber,
+		Disposition: legacy.Report.Disposition,
+	}}, nil
+}
+
+// CSPReportHandler logs Content-Security-Policy violations sent through report-uri or the Reporting API
+func CSPReportHandler(w http.ResponseWriter, r *http.Request) {
+	logger := RequestLogger(r)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/csp-report", "application/reports+json", "application/json":
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	violations, err := parseCSPReports(mediaType, body)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, violation := range violations {
+		logger.Warn("Content-Security-Policy violation",
+			slog.String("document_url", violation.DocumentURL),
+			slog.String("directive", violation.Directive),
+			slog.String("blocked_url", violation.BlockedURL),
+			slog.String("source_file", violation.SourceFile),
+			slog.Int("line", violation.LineNumber),
+			slog.String("disposition", violation.Disposition),
+		)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
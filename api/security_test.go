@@ -0,0 +1,96 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/maybemaby/oapibase/api"
+)
+
+func TestSecurityHeadersRejectsUnknownHosts(t *testing.T) {
+	handler := api.SecurityHeadersMiddleware(api.ProductionSecurity([]string{"app.example.com", "*.example.org"}))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	)
+
+	for host, want := range map[string]int{
+		"app.example.com":     http.StatusOK,
+		"app.example.com:443": http.StatusOK,
+		"eu.example.org":      http.StatusOK,
+		"example.org":         http.StatusBadRequest,
+		"evil.example.net":    http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != want {
+			t.Errorf("Expected %d for host %s, got %d", want, host, rec.Code)
+		}
+	}
+}
+
+func TestSpaIndexGetsCSPNonce(t *testing.T) {
+	mux := http.NewServeMux()
+	api.MountSpa(mux, "/", fstest.MapFS{
+		"index.html":  {Data: []byte(`<script nonce="` + api.SpaNoncePlaceholder + `" src="/app.js"></script>`)},
+		"app.js":      {Data: []byte("console.log(1)")},
+		"assets/a.js": {Data: []byte("")},
+	})
+
+	handler := api.SecurityHeadersMiddleware(api.ProductionSecurity(nil))(mux)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/orgs/1", nil))
+
+	policy := rec.Header().Get("Content-Security-Policy")
+	_, nonce, ok := strings.Cut(policy, "'nonce-")
+	nonce, _, _ = strings.Cut(nonce, "'")
+
+	if !ok || nonce == "" {
+		t.Fatalf("Expected a nonce in the policy, got %q", policy)
+	}
+
+	if body := rec.Body.String(); !strings.Contains(body, `nonce="`+nonce+`"`) {
+		t.Errorf("Expected the nonce in index.html, got %s", body)
+	}
+
+	if rec.Header().Get("Cache-Control") != "no-store" || rec.Header().Get("Strict-Transport-Security") == "" {
+		t.Errorf("Expected an uncached index with HSTS, got %v", rec.Header())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/app.js", nil))
+
+	if rec.Body.String() != "console.log(1)" {
+		t.Errorf("Expected static files to be served as is, got %q", rec.Body.String())
+	}
+}
+
+func TestCSPReportHandler(t *testing.T) {
+	for contentType, body := range map[string]string{
+		"application/csp-report":   `{"csp-report":{"document-uri":"https://app.example.com/","violated-directive":"script-src","blocked-uri":"inline"}}`,
+		"application/reports+json": `[{"type":"csp-violation","body":{"documentURL":"https://app.example.com/","effectiveDirective":"script-src-elem"}}]`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, api.CSPReportPath, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		api.CSPReportHandler(rec, req)
+
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("Expected 204 for %s, got %d", contentType, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, api.CSPReportPath, strings.NewReader("hi"))
+	req.Header.Set("Content-Type", "text/plain")
+	rec := httptest.NewRecorder()
+	api.CSPReportHandler(rec, req)
+
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for other content types, got %d", rec.Code)
+	}
+}
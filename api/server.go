@@ -3,15 +3,30 @@ package api
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/maybemaby/oapibase/api/auth"
+	"github.com/maybemaby/oapibase/api/health"
+	"github.com/maybemaby/oapibase/api/idempotency"
+	"github.com/maybemaby/oapibase/api/invites"
+	"github.com/maybemaby/oapibase/api/mail"
+	"github.com/maybemaby/oapibase/api/orgs"
+	"github.com/maybemaby/oapibase/api/paginate"
+	"github.com/maybemaby/oapibase/api/ratelimit"
 )
 
 type Server struct {
@@ -23,17 +38,66 @@ type Server struct {
 	pool       *pgxpool.Pool
 	services   *services
 	jwtManager *auth.JwtManager
-	prod       bool
+	invites    *invites.Manager
+	mailer     mail.Mailer
+	cors       CorsPolicy
+	security   SecurityConfig
+	rateLimits ratelimit.Store
+	// signupIdempotency seals the tokens signup responses are stored with
+	signupIdempotency IdempotencyOptions
+	httpConfig        ServerConfig
+	// trustedProxies may set forwarding headers, see ClientOriginMiddleware
+	trustedProxies []netip.Prefix
+	liveness       *health.Registry
+	readiness      *health.Registry
+	prod           bool
+
+	// ready is false until the server listens and again once it starts shutting down
+	ready           atomic.Bool
+	workers         sync.WaitGroup
+	shutdownTimeout time.Duration
+	shutdownDelay   time.Duration
+	shutdownHooks   []func(context.Context) error
 }
 
+// DefaultShutdownTimeout bounds how long in-flight requests get to finish on shutdown
+const DefaultShutdownTimeout = time.Second * 30
+
+const shutdownHookTimeout = time.Second * 5
+
 func NewServer(isProd bool) (*Server, error) {
 
 	server := &Server{
-		port: "8000",
-		prod: isProd,
+		port:            "8000",
+		prod:            isProd,
+		httpConfig:      DefaultServerConfig(isProd),
+		shutdownTimeout: DefaultShutdownTimeout,
 	}
 
 	server.WithLogger(isProd)
+	server.WithCors(CorsPolicy{
+		Default: defaultCorsOptions(isProd),
+	})
+
+	if err := server.cors.Validate(); err != nil {
+		return nil, fmt.Errorf("CORS_ALLOWED_ORIGINS: %w", err)
+	}
+
+	security, err := defaultSecurityConfig(isProd)
+
+	if err != nil {
+		return nil, err
+	}
+
+	server.security = security
+
+	signer, err := cursorSigner(isProd)
+
+	if err != nil {
+		return nil, err
+	}
+
+	paginate.DefaultSigner = signer
 
 	pool, err := NewPool(context.Background(), !isProd)
 
@@ -55,21 +119,287 @@ func NewServer(isProd bool) (*Server, error) {
 
 	server.jwtManager = jwtManager
 
+	seal, err := IdempotencySeal(jwtManager.RefreshTokenSecret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Replayed tokens are no use once the access token expired
+	server.signupIdempotency = IdempotencyOptions{Seal: seal, TTL: jwtManager.AccessTokenLifetime}
+
+	server.mailer = newMailer(server.logger)
+	server.invites = newInviteManager(server.mailer)
+	server.rateLimits = newRateLimitStore(pool)
+
 	services := newServices(pool, server.logger, jwtManager)
 	server.services = services
+	server.newHealthChecks()
 
 	return server, nil
 }
 
+// cursorSigner signs cursors with CURSOR_SECRET. Production requires it, cursors signed with the random
+// development key break across instances and restarts
+func cursorSigner(isProd bool) (*paginate.Signer, error) {
+	secret := os.Getenv("CURSOR_SECRET")
+
+	if secret != "" {
+		return paginate.NewSigner([]byte(secret)), nil
+	}
+
+	if isProd {
+		return nil, errors.New("CURSOR_SECRET is required in production")
+	}
+
+	return paginate.DefaultSigner, nil
+}
+
+// defaultCorsOptions allows the origins listed in CORS_ALLOWED_ORIGINS, falling back to the local frontend outside production
+func defaultCorsOptions(isProd bool) CorsOptions {
+	origins := []string{}
+
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	if len(origins) == 0 && !isProd {
+		origins = append(origins, "http://localhost:3001")
+	}
+
+	allowedHeaders := append(slices.Clone(DefaultCorsHeaders), orgs.OrgIdHeader, RequestIdHeader, IdempotencyKeyHeader,
+		"If-Match", "If-None-Match")
+
+	// Validators, replays, pagination links and rate limits are read by clients
+	exposedHeaders := []string{RequestIdHeader, IdempotentReplayedHeader, "ETag", "Link",
+		"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After"}
+
+	return CorsOptions{
+		AllowedOrigins:   origins,
+		AllowedMethods:   DefaultCorsMethods,
+		AllowedHeaders:   allowedHeaders,
+		ExposedHeaders:   exposedHeaders,
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	}
+}
+
+// newRateLimitStore shares limits through Postgres when RATE_LIMIT_STORE=postgres, otherwise they are per instance
+func newRateLimitStore(pool *pgxpool.Pool) ratelimit.Store {
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		return ratelimit.NewPostgresStore(pool)
+	}
+
+	return ratelimit.NewMemoryStore(runtime.GOMAXPROCS(0) * 4)
+}
+
+// newMailer delivers through SMTP when SMTP_ADDR is set, otherwise emails are only logged
+func newMailer(logger *slog.Logger) mail.Mailer {
+	addr := os.Getenv("SMTP_ADDR")
+
+	if addr == "" {
+		return &mail.LogMailer{Logger: logger.WithGroup("mail")}
+	}
+
+	return mail.NewSMTPMailer(addr, os.Getenv("SMTP_FROM"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+}
+
+func newInviteManager(mailer mail.Mailer) *invites.Manager {
+	domains := []string{}
+
+	for _, domain := range strings.Split(os.Getenv("INVITE_ALLOWED_DOMAINS"), ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+
+	return &invites.Manager{
+		TokenSecret:    []byte(os.Getenv("INVITE_TOKEN_SECRET")),
+		Lifetime:       time.Hour * 24 * 7,
+		AcceptURL:      os.Getenv("INVITE_ACCEPT_URL"),
+		Mailer:         mailer,
+		InviteOnly:     os.Getenv("INVITE_ONLY") == "true",
+		AllowedDomains: domains,
+	}
+}
+
+// Start serves until ctx is done, then shuts down gracefully: it turns unready, waits out the shutdown delay, drains in-flight requests
+// within the shutdown timeout, stops background workers, closes the database and runs the shutdown hooks
 func (s *Server) Start(ctx context.Context) error {
 
 	s.MountRoutesOapi()
 
-	s.logger.Info("Server started at http://localhost:" + s.port)
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+
+	s.goWorker(func() {
+		s.purgeEvery(workerCtx, time.Hour, "deleted users", func(ctx context.Context) (int64, error) {
+			return auth.PurgeDeletedUsers(ctx, s.pool)
+		})
+	})
+
+	s.goWorker(func() {
+		s.purgeEvery(workerCtx, time.Hour, "idempotency keys", func(ctx context.Context) (int64, error) {
+			return idempotency.PurgeExpired(ctx, s.pool)
+		})
+	})
+
+	if store, ok := s.rateLimits.(*ratelimit.PostgresStore); ok {
+		s.goWorker(func() {
+			s.purgeEvery(workerCtx, time.Minute*10, "rate limits", store.Purge)
+		})
+	}
+
+	scheme := "http"
+
+	if s.httpConfig.TLS != nil {
+		reloader, err := newTLSReloader(*s.httpConfig.TLS)
+
+		if err != nil {
+			return errors.Join(err, s.shutdown(stopWorkers))
+		}
+
+		scheme = "https"
+		s.srv.TLSConfig = reloader.serverConfig()
+
+		s.goWorker(func() {
+			reloader.watch(workerCtx, s.logger)
+		})
+	}
+
+	listener, err := net.Listen("tcp", s.srv.Addr)
+
+	if err != nil {
+		return errors.Join(fmt.Errorf("listening on %s: %w", s.srv.Addr, err), s.shutdown(stopWorkers))
+	}
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		if s.srv.TLSConfig != nil {
+			// Certificates come from TLSConfig, not files
+			serveErr <- s.srv.ServeTLS(listener, "", "")
+			return
+		}
+
+		serveErr <- s.srv.Serve(listener)
+	}()
+
+	s.ready.Store(true)
+
+	s.logger.Info("Server started at " + scheme + "://localhost:" + s.port)
 	s.logger.Info(fmt.Sprintf("Server is running in production mode: %t", s.prod))
 	s.logger.Debug("Server is running in debug mode")
 
-	return s.srv.ListenAndServe()
+	select {
+	case err := <-serveErr:
+		// Serve only returns early on failure
+		return errors.Join(fmt.Errorf("serving: %w", err), s.shutdown(stopWorkers))
+	case <-ctx.Done():
+		s.logger.Info("Shutting down", slog.Duration("timeout", s.shutdownTimeout))
+		return s.shutdown(stopWorkers)
+	}
+}
+
+// goWorker runs a background worker that shutdown waits for
+func (s *Server) goWorker(fn func()) {
+	s.workers.Add(1)
+
+	go func() {
+		defer s.workers.Done()
+		fn()
+	}()
+}
+
+// shutdown releases everything Start set up, in order, within the shutdown timeout
+func (s *Server) shutdown(stopWorkers context.CancelFunc) error {
+	s.ready.Store(false)
+
+	// Keep serving while the orchestrator notices /readyz failing and stops routing here
+	if s.shutdownDelay > 0 {
+		s.logger.Info("Waiting for traffic to drain", slog.Duration("delay", s.shutdownDelay))
+		time.Sleep(s.shutdownDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	var errs []error
+
+	if err := s.srv.Shutdown(ctx); err != nil {
+		// Connections still open past the deadline are cut off
+		errs = append(errs, fmt.Errorf("draining connections: %w", err), s.srv.Close())
+	}
+
+	stopWorkers()
+
+	workersDone := make(chan struct{})
+
+	go func() {
+		s.workers.Wait()
+		close(workersDone)
+	}()
+
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		errs = append(errs, errors.New("background workers did not stop in time"))
+	}
+
+	if s.db != nil {
+		errs = append(errs, s.db.Close())
+	}
+
+	if s.pool != nil {
+		s.pool.Close()
+	}
+
+	// Hooks get their own deadline so a slow drain doesn't leave telemetry unflushed
+	hookCtx, cancelHooks := context.WithTimeout(context.Background(), shutdownHookTimeout)
+	defer cancelHooks()
+
+	for _, hook := range s.shutdownHooks {
+		errs = append(errs, hook(hookCtx))
+	}
+
+	err := errors.Join(errs...)
+
+	if err == nil {
+		s.logger.Info("Server stopped")
+	}
+
+	return err
+}
+
+// Ready reports whether the server accepts traffic, it turns false as soon as shutdown starts
+func (s *Server) Ready() bool {
+	return s.ready.Load()
+}
+
+// purgeEvery runs purge every interval until ctx is done, logging how many rows of what it removed
+func (s *Server) purgeEvery(ctx context.Context, interval time.Duration, what string, purge func(ctx context.Context) (int64, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := purge(ctx)
+
+			if err != nil {
+				s.logger.Error("Error purging "+what, slog.Any("err", err))
+				continue
+			}
+
+			if purged > 0 {
+				s.logger.Info("Purged "+what, slog.Int64("count", purged))
+			}
+		}
+	}
 }
 
 func (s *Server) WithLogger(isProd bool) {
@@ -87,3 +417,39 @@ func (s *Server) WithLogger(isProd bool) {
 func (s *Server) WithPort(port string) {
 	s.port = port
 }
+
+// WithServerConfig replaces the timeouts and TLS setup of the http.Server, see DefaultServerConfig
+func (s *Server) WithServerConfig(cfg ServerConfig) {
+	s.httpConfig = cfg
+}
+
+// WithSecurity replaces the security headers and allowed hosts, see ProductionSecurity and DevelopmentSecurity
+func (s *Server) WithSecurity(cfg SecurityConfig) {
+	s.security = cfg
+}
+
+// WithTrustedProxies sets the proxies whose Forwarded, X-Forwarded-* and X-Real-IP headers are honored
+func (s *Server) WithTrustedProxies(proxies []netip.Prefix) {
+	s.trustedProxies = proxies
+}
+
+// WithShutdownTimeout sets how long shutdown waits for in-flight requests and workers
+func (s *Server) WithShutdownTimeout(timeout time.Duration) {
+	s.shutdownTimeout = timeout
+}
+
+// WithShutdownDelay keeps serving for delay after shutdown starts with /readyz failing,
+// giving load balancers time to stop sending traffic before connections are drained
+func (s *Server) WithShutdownDelay(delay time.Duration) {
+	s.shutdownDelay = delay
+}
+
+// OnShutdown registers hook to run last on shutdown, after the database is closed, e.g. to flush telemetry
+func (s *Server) OnShutdown(hook func(context.Context) error) {
+	s.shutdownHooks = append(s.shutdownHooks, hook)
+}
+
+// WithCors replaces the CORS policy, Groups can loosen or tighten it for route prefixes
+func (s *Server) WithCors(policy CorsPolicy) {
+	s.cors = policy
+}
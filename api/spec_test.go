@@ -0,0 +1,35 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api"
+)
+
+func TestGenerateSpecIsDeterministic(t *testing.T) {
+	first, err := api.GenerateSpec("json")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, _ := api.GenerateSpec("json")
+
+	if !bytes.Equal(first, second) {
+		t.Error("Expected the same spec on every generation")
+	}
+
+	var spec struct {
+		Paths map[string]any `json:"paths"`
+	}
+
+	if err := json.Unmarshal(first, &spec); err != nil || spec.Paths["/auth/me"] == nil {
+		t.Errorf("Expected a spec documenting /auth/me, got %v", err)
+	}
+
+	if _, err := api.GenerateSpec("toml"); err == nil {
+		t.Error("Expected an unsupported format to fail")
+	}
+}
@@ -0,0 +1,450 @@
+package specdiff
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// direction tells which way a schema's values travel. A schema accepting fewer values breaks
+// clients sending them, a schema producing more values breaks clients receiving them
+type direction int
+
+const (
+	request direction = iota
+	response
+)
+
+var methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+type differ struct {
+	base, revision *document
+	operation      string
+	// visited holds the pairs of refs being compared, recursive schemas stop at their first repetition
+	visited map[string]bool
+	changes []Change
+}
+
+func (d *differ) add(severity Severity, location, format string, args ...any) {
+	change := Change{Severity: severity, Operation: d.operation, Location: location, Message: fmt.Sprintf(format, args...)}
+
+	// Media types of a body usually share their schema, its changes are only reported once
+	if !slices.Contains(d.changes, change) {
+		d.changes = append(d.changes, change)
+	}
+}
+
+// narrowed reports a change letting fewer values through
+func (d *differ) narrowed(dir direction, location, format string, args ...any) {
+	if dir == request {
+		d.add(Breaking, location, format, args...)
+	} else {
+		d.add(NonBreaking, location, format, args...)
+	}
+}
+
+// widened reports a change letting more values through
+func (d *differ) widened(dir direction, location, format string, args ...any) {
+	if dir == response {
+		d.add(Breaking, location, format, args...)
+	} else {
+		d.add(NonBreaking, location, format, args...)
+	}
+}
+
+func (d *differ) comparePaths() {
+	before, after := mapOf(d.base.root["paths"]), mapOf(d.revision.root["paths"])
+
+	for _, path := range keys(before, after) {
+		beforeItem, afterItem := mapOf(before[path]), mapOf(after[path])
+
+		for _, method := range methods {
+			beforeOp, afterOp := mapOf(beforeItem[method]), mapOf(afterItem[method])
+			d.operation = strings.ToUpper(method) + " " + path
+
+			switch {
+			case beforeOp == nil && afterOp == nil:
+				continue
+			case afterOp == nil:
+				d.add(Breaking, "", "operation removed")
+			case beforeOp == nil:
+				d.add(NonBreaking, "", "operation added")
+			default:
+				d.compareOperation(beforeItem, beforeOp, afterItem, afterOp)
+			}
+		}
+	}
+}
+
+func (d *differ) compareOperation(beforeItem, beforeOp, afterItem, afterOp map[string]any) {
+	if afterOp["deprecated"] == true && beforeOp["deprecated"] != true {
+		d.add(NonBreaking, "", "operation deprecated")
+	}
+
+	d.compareSecurity(d.base.security(beforeOp), d.revision.security(afterOp))
+	d.compareParameters(d.base.parameters(beforeItem, beforeOp), d.revision.parameters(afterItem, afterOp))
+	d.compareRequestBody(mapOf(beforeOp["requestBody"]), mapOf(afterOp["requestBody"]))
+	d.compareResponses(mapOf(beforeOp["responses"]), mapOf(afterOp["responses"]))
+}
+
+func (d *differ) compareSecurity(before, after []string) {
+	public := func(alternatives []string) bool {
+		return len(alternatives) == 0 || slices.Contains(alternatives, "")
+	}
+
+	if public(before) && !public(after) {
+		d.add(Breaking, "security", "authentication became required")
+	}
+
+	for _, alternative := range before {
+		if alternative != "" && !slices.Contains(after, alternative) && !public(after) {
+			d.add(Breaking, "security", "scheme %s removed", alternative)
+		}
+	}
+
+	for _, alternative := range after {
+		if alternative != "" && !slices.Contains(before, alternative) && !public(before) {
+			d.add(NonBreaking, "security", "scheme %s added", alternative)
+		}
+	}
+}
+
+func (d *differ) compareParameters(before, after map[string]any) {
+	for _, location := range keys(before, after) {
+		b, a := mapOf(before[location]), mapOf(after[location])
+
+		switch {
+		case a == nil:
+			d.add(Breaking, location, "removed")
+		case b == nil && required(a):
+			d.add(Breaking, location, "added as required")
+		case b == nil:
+			d.add(NonBreaking, location, "added as optional")
+		default:
+			if required(a) && !required(b) {
+				d.add(Breaking, location, "became required")
+			}
+
+			if !required(a) && required(b) {
+				d.add(NonBreaking, location, "became optional")
+			}
+
+			d.compareSchema(request, location, mapOf(b["schema"]), mapOf(a["schema"]))
+		}
+	}
+}
+
+func (d *differ) compareRequestBody(beforeBody, afterBody map[string]any) {
+	before, _ := d.base.resolve(beforeBody)
+	after, _ := d.revision.resolve(afterBody)
+	location := "request body"
+
+	switch {
+	case before == nil && after == nil:
+		return
+	case after == nil:
+		d.add(Breaking, location, "removed")
+	case before == nil && required(after):
+		d.add(Breaking, location, "added as required")
+	case before == nil:
+		d.add(NonBreaking, location, "added as optional")
+	default:
+		if required(after) && !required(before) {
+			d.add(Breaking, location, "became required")
+		}
+
+		if !required(after) && required(before) {
+			d.add(NonBreaking, location, "became optional")
+		}
+
+		d.compareContent(request, location, mapOf(before["content"]), mapOf(after["content"]))
+	}
+}
+
+func (d *differ) compareResponses(before, after map[string]any) {
+	for _, status := range keys(before, after) {
+		b, _ := d.base.resolve(mapOf(before[status]))
+		a, _ := d.revision.resolve(mapOf(after[status]))
+		location := "response " + status
+
+		switch {
+		case a == nil:
+			d.add(Breaking, location, "removed")
+		case b == nil:
+			d.add(NonBreaking, location, "added")
+		default:
+			d.compareContent(response, location, mapOf(b["content"]), mapOf(a["content"]))
+			d.compareHeaders(location, mapOf(b["headers"]), mapOf(a["headers"]))
+		}
+	}
+}
+
+func (d *differ) compareContent(dir direction, location string, before, after map[string]any) {
+	for _, mediaType := range keys(before, after) {
+		b, a := mapOf(before[mediaType]), mapOf(after[mediaType])
+
+		switch {
+		case a == nil:
+			d.add(Breaking, location, "media type %s removed", mediaType)
+		case b == nil:
+			d.add(NonBreaking, location, "media type %s added", mediaType)
+		default:
+			d.compareSchema(dir, location, mapOf(b["schema"]), mapOf(a["schema"]))
+		}
+	}
+}
+
+func (d *differ) compareHeaders(location string, before, after map[string]any) {
+	for _, name := range keys(before, after) {
+		b, _ := d.base.resolve(mapOf(before[name]))
+		a, _ := d.revision.resolve(mapOf(after[name]))
+		header := location + " header " + name
+
+		switch {
+		case a == nil:
+			d.add(Breaking, header, "removed")
+		case b == nil:
+			d.add(NonBreaking, header, "added")
+		default:
+			d.compareSchema(response, header, mapOf(b["schema"]), mapOf(a["schema"]))
+		}
+	}
+}
+
+func (d *differ) compareSchema(dir direction, location string, before, after map[string]any) {
+	before, beforeRef := d.base.resolve(before)
+	after, afterRef := d.revision.resolve(after)
+
+	// Undocumented schemas can't be compared
+	if before == nil || after == nil {
+		return
+	}
+
+	if beforeRef != "" && afterRef != "" {
+		key := fmt.Sprint(dir, beforeRef, " ", afterRef)
+
+		if d.visited[key] {
+			return
+		}
+
+		d.visited[key] = true
+		defer delete(d.visited, key)
+	}
+
+	// Once the type changes, nothing else is comparable
+	if !d.compareTypes(dir, location, before, after) {
+		return
+	}
+
+	if nullable(before) && !nullable(after) {
+		d.narrowed(dir, location, "no longer nullable")
+	}
+
+	if !nullable(before) && nullable(after) {
+		d.widened(dir, location, "became nullable")
+	}
+
+	d.compareFormats(dir, location, before, after)
+	d.compareEnums(dir, location, before, after)
+
+	for _, keyword := range []string{"maxLength", "maximum", "maxItems", "maxProperties"} {
+		d.compareBound(dir, location, keyword, before, after, true)
+	}
+
+	for _, keyword := range []string{"minLength", "minimum", "minItems", "minProperties"} {
+		d.compareBound(dir, location, keyword, before, after, false)
+	}
+
+	beforePattern, _ := before["pattern"].(string)
+	afterPattern, _ := after["pattern"].(string)
+
+	switch {
+	case beforePattern == afterPattern:
+	case afterPattern == "":
+		d.widened(dir, location, "pattern %s removed", beforePattern)
+	default:
+		d.narrowed(dir, location, "pattern %s set", afterPattern)
+	}
+
+	d.compareProperties(dir, location, before, after)
+	d.compareSchema(dir, location+"[]", mapOf(before["items"]), mapOf(after["items"]))
+
+	allowed := func(schema map[string]any) bool { return schema["additionalProperties"] != false }
+
+	if allowed(before) && !allowed(after) {
+		d.narrowed(dir, location, "additional properties no longer allowed")
+	}
+
+	if !allowed(before) && allowed(after) {
+		d.widened(dir, location, "additional properties allowed")
+	}
+
+	d.compareSchema(dir, location+"{}", mapOf(before["additionalProperties"]), mapOf(after["additionalProperties"]))
+
+	for _, keyword := range []string{"allOf", "oneOf", "anyOf"} {
+		beforeSchemas, _ := before[keyword].([]any)
+		afterSchemas, _ := after[keyword].([]any)
+
+		switch {
+		case len(beforeSchemas) == len(afterSchemas):
+			for i := range beforeSchemas {
+				d.compareSchema(dir, location, mapOf(beforeSchemas[i]), mapOf(afterSchemas[i]))
+			}
+		// More schemas to match all of is narrower, more alternatives wider
+		case (len(afterSchemas) > len(beforeSchemas)) == (keyword == "allOf"):
+			d.narrowed(dir, location, "%s went from %d to %d schemas", keyword, len(beforeSchemas), len(afterSchemas))
+		default:
+			d.widened(dir, location, "%s went from %d to %d schemas", keyword, len(beforeSchemas), len(afterSchemas))
+		}
+	}
+}
+
+// compareTypes reports type changes and tells whether the schemas still have comparable types
+func (d *differ) compareTypes(dir direction, location string, before, after map[string]any) bool {
+	beforeTypes, afterTypes := types(before), types(after)
+
+	switch {
+	case slices.Equal(beforeTypes, afterTypes):
+		return true
+	case len(afterTypes) == 0:
+		d.widened(dir, location, "type %s removed", strings.Join(beforeTypes, ", "))
+		return true
+	case len(beforeTypes) == 0:
+		d.narrowed(dir, location, "type %s set", strings.Join(afterTypes, ", "))
+		return true
+	}
+
+	message := fmt.Sprintf("type changed from %s to %s", strings.Join(beforeTypes, ", "), strings.Join(afterTypes, ", "))
+
+	switch {
+	case covers(afterTypes, beforeTypes):
+		d.widened(dir, location, "%s", message)
+	case covers(beforeTypes, afterTypes):
+		d.narrowed(dir, location, "%s", message)
+	default:
+		d.add(Breaking, location, "%s", message)
+	}
+
+	return false
+}
+
+func (d *differ) compareFormats(dir direction, location string, before, after map[string]any) {
+	beforeFormat, _ := before["format"].(string)
+	afterFormat, _ := after["format"].(string)
+
+	switch {
+	case beforeFormat == afterFormat:
+	case beforeFormat == "":
+		d.narrowed(dir, location, "format %s set", afterFormat)
+	case afterFormat == "":
+		d.widened(dir, location, "format %s removed", beforeFormat)
+	default:
+		d.add(Breaking, location, "format changed from %s to %s", beforeFormat, afterFormat)
+	}
+}
+
+func (d *differ) compareEnums(dir direction, location string, before, after map[string]any) {
+	_, hadEnum := before["enum"]
+	_, hasEnum := after["enum"]
+	beforeValues, afterValues := stringsOf(before["enum"]), stringsOf(after["enum"])
+
+	switch {
+	case hadEnum && !hasEnum:
+		d.widened(dir, location, "enum removed")
+	case !hadEnum && hasEnum:
+		d.narrowed(dir, location, "enum %s set", strings.Join(afterValues, ", "))
+	case hadEnum:
+		for _, value := range beforeValues {
+			if !slices.Contains(afterValues, value) {
+				d.narrowed(dir, location, "enum value %s removed", value)
+			}
+		}
+
+		for _, value := range afterValues {
+			if !slices.Contains(beforeValues, value) {
+				d.widened(dir, location, "enum value %s added", value)
+			}
+		}
+	}
+}
+
+// compareBound reports changes of a maximum when upper is set, of a minimum otherwise
+func (d *differ) compareBound(dir direction, location, keyword string, before, after map[string]any, upper bool) {
+	b, hadBound := number(before[keyword])
+	a, hasBound := number(after[keyword])
+
+	switch {
+	case hadBound == hasBound && a == b:
+	case !hasBound:
+		d.widened(dir, location, "%s %v removed", keyword, b)
+	case !hadBound:
+		d.narrowed(dir, location, "%s %v set", keyword, a)
+	case (a < b) == upper:
+		d.narrowed(dir, location, "%s changed from %v to %v", keyword, b, a)
+	default:
+		d.widened(dir, location, "%s changed from %v to %v", keyword, b, a)
+	}
+}
+
+func (d *differ) compareProperties(dir direction, location string, before, after map[string]any) {
+	beforeProperties, afterProperties := mapOf(before["properties"]), mapOf(after["properties"])
+	beforeRequired, afterRequired := stringsOf(before["required"]), stringsOf(after["required"])
+
+	for _, name := range keys(beforeProperties, afterProperties) {
+		field := location + "." + name
+		b, a := beforeProperties[name], afterProperties[name]
+		wasRequired, isRequired := slices.Contains(beforeRequired, name), slices.Contains(afterRequired, name)
+
+		switch {
+		// Clients read it from responses, and requests sending it are rejected as unknown fields
+		case a == nil:
+			d.add(Breaking, field, "property removed")
+		case b == nil && isRequired:
+			d.narrowed(dir, field, "required property added")
+		case b == nil:
+			d.add(NonBreaking, field, "optional property added")
+		default:
+			if isRequired && !wasRequired {
+				d.narrowed(dir, field, "became required")
+			}
+
+			if !isRequired && wasRequired {
+				d.widened(dir, field, "became optional")
+			}
+
+			d.compareSchema(dir, field, mapOf(b), mapOf(a))
+		}
+	}
+}
+
+// types lists the types a schema allows besides null, sorted
+func types(schema map[string]any) []string {
+	list := []string{}
+
+	switch t := schema["type"].(type) {
+	case string:
+		list = append(list, t)
+	case []any:
+		list = stringsOf(t)
+	}
+
+	list = slices.DeleteFunc(list, func(t string) bool { return t == "null" })
+	slices.Sort(list)
+
+	return list
+}
+
+// covers tells whether every value of the inner types is one of the outer types
+func covers(outer, inner []string) bool {
+	for _, t := range inner {
+		if !slices.Contains(outer, t) && (t != "integer" || !slices.Contains(outer, "number")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func nullable(schema map[string]any) bool {
+	return schema["nullable"] == true || slices.Contains(stringsOf(schema["type"]), "null")
+}
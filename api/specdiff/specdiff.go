@@ -0,0 +1,258 @@
+// Package specdiff compares two versions of an OpenAPI 3 document and tells which changes break
+// existing clients, e.g. to check a release against the last published spec.
+package specdiff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Severity tells whether a change breaks clients written against the base spec
+type Severity string
+
+const (
+	Breaking    Severity = "breaking"
+	NonBreaking Severity = "non-breaking"
+)
+
+// Change is a difference between two specs
+type Change struct {
+	Severity Severity `json:"severity"`
+	// Operation is the method and path of the changed operation, e.g. GET /orgs/{orgId}
+	Operation string `json:"operation"`
+	// Location is where the change is in the operation, e.g. response 200.items[].role
+	Location string `json:"location,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (c Change) String() string {
+	location := c.Operation
+
+	if c.Location != "" {
+		location += " " + c.Location
+	}
+
+	return fmt.Sprintf("%-12s %s: %s", c.Severity, location, c.Message)
+}
+
+// Report lists the changes between two specs, operations in path order
+type Report struct {
+	Breaking int      `json:"breaking"`
+	Changes  []Change `json:"changes"`
+}
+
+// WriteText writes a change per line, followed by a summary
+func (r Report) WriteText(w io.Writer) error {
+	for _, change := range r.Changes {
+		if _, err := fmt.Fprintln(w, change); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%d breaking, %d non-breaking changes\n", r.Breaking, len(r.Changes)-r.Breaking)
+
+	return err
+}
+
+// Compare reads two OpenAPI 3 documents, as JSON or YAML, and classifies the changes from base to revision.
+// Schemas are compared structurally, renaming a component doesn't count as a change
+func Compare(base, revision []byte) (Report, error) {
+	before, err := parse(base)
+
+	if err != nil {
+		return Report{}, fmt.Errorf("specdiff: base spec: %w", err)
+	}
+
+	after, err := parse(revision)
+
+	if err != nil {
+		return Report{}, fmt.Errorf("specdiff: revision spec: %w", err)
+	}
+
+	d := &differ{base: before, revision: after, visited: map[string]bool{}}
+	d.comparePaths()
+
+	report := Report{Changes: d.changes}
+
+	if report.Changes == nil {
+		report.Changes = []Change{}
+	}
+
+	for _, change := range report.Changes {
+		if change.Severity == Breaking {
+			report.Breaking++
+		}
+	}
+
+	return report, nil
+}
+
+type document struct {
+	root map[string]any
+}
+
+func parse(data []byte) (*document, error) {
+	var root any
+
+	// JSON is YAML, one decoder reads both
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	doc := &document{root: mapOf(normalize(root))}
+
+	if _, ok := doc.root["openapi"]; !ok {
+		return nil, errors.New("not an OpenAPI 3 document")
+	}
+
+	return doc, nil
+}
+
+// normalize turns the maps yaml decodes with non string keys, e.g. unquoted status codes, into string keyed ones
+func normalize(node any) any {
+	switch n := node.(type) {
+	case map[string]any:
+		for key, value := range n {
+			n[key] = normalize(value)
+		}
+	case map[any]any:
+		m := map[string]any{}
+
+		for key, value := range n {
+			m[fmt.Sprint(key)] = normalize(value)
+		}
+
+		return m
+	case []any:
+		for i, value := range n {
+			n[i] = normalize(value)
+		}
+	}
+
+	return node
+}
+
+// resolve follows local $refs, returning the target and the last ref followed
+func (d *document) resolve(node map[string]any) (map[string]any, string) {
+	ref := ""
+
+	// Bounded in case refs point at each other
+	for range 32 {
+		target, ok := node["$ref"].(string)
+
+		if !ok {
+			return node, ref
+		}
+
+		ref = target
+		node = d.lookup(target)
+	}
+
+	return nil, ref
+}
+
+func (d *document) lookup(ref string) map[string]any {
+	pointer, ok := strings.CutPrefix(ref, "#/")
+
+	if !ok {
+		return nil
+	}
+
+	var node any = d.root
+	unescape := strings.NewReplacer("~1", "/", "~0", "~")
+
+	for token := range strings.SplitSeq(pointer, "/") {
+		node = mapOf(node)[unescape.Replace(token)]
+	}
+
+	return mapOf(node)
+}
+
+// parameters merges the parameters of a path item and its operation, keyed by location and name
+func (d *document) parameters(item, operation map[string]any) map[string]any {
+	parameters := map[string]any{}
+
+	for _, list := range []any{item["parameters"], operation["parameters"]} {
+		params, _ := list.([]any)
+
+		for _, param := range params {
+			resolved, _ := d.resolve(mapOf(param))
+
+			if resolved != nil {
+				parameters[fmt.Sprintf("%s parameter %s", resolved["in"], resolved["name"])] = resolved
+			}
+		}
+	}
+
+	return parameters
+}
+
+// security lists the alternative requirements of an operation as sorted scheme names joined by +,
+// an empty string allows anonymous requests
+func (d *document) security(operation map[string]any) []string {
+	requirements, ok := operation["security"].([]any)
+
+	if !ok {
+		requirements, _ = d.root["security"].([]any)
+	}
+
+	alternatives := []string{}
+
+	for _, requirement := range requirements {
+		alternatives = append(alternatives, strings.Join(slices.Sorted(maps.Keys(mapOf(requirement))), "+"))
+	}
+
+	return alternatives
+}
+
+func mapOf(node any) map[string]any {
+	m, _ := node.(map[string]any)
+	return m
+}
+
+// keys is the sorted union of the keys of a and b
+func keys(a, b map[string]any) []string {
+	union := slices.Collect(maps.Keys(a))
+
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			union = append(union, key)
+		}
+	}
+
+	slices.Sort(union)
+
+	return union
+}
+
+func stringsOf(node any) []string {
+	list, _ := node.([]any)
+	values := []string{}
+
+	for _, value := range list {
+		values = append(values, fmt.Sprint(value))
+	}
+
+	return values
+}
+
+func number(node any) (float64, bool) {
+	switch n := node.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+
+	return 0, false
+}
+
+func required(node map[string]any) bool {
+	return node["required"] == true
+}
@@ -0,0 +1,150 @@
+package specdiff_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api/specdiff"
+)
+
+const base = `
+openapi: 3.0.3
+paths:
+  /orgs:
+    get:
+      parameters:
+      - {in: query, name: limit, schema: {type: integer, maximum: 100}}
+      responses:
+        200:
+          content:
+            application/json:
+              schema: {$ref: '#/components/schemas/Org'}
+        404: {description: Not Found}
+    post:
+      requestBody:
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [name]
+              properties:
+                name: {type: string}
+                role: {type: string, enum: [admin, member, owner]}
+      responses:
+        201: {description: Created}
+  /orgs/{orgId}:
+    delete:
+      responses:
+        204: {description: No Content}
+components:
+  schemas:
+    Org:
+      type: object
+      required: [id, slug]
+      properties:
+        id: {type: integer}
+        slug: {type: string}
+        plan: {type: string, enum: [free, pro]}
+        parent: {$ref: '#/components/schemas/Org'}
+`
+
+// The revision renames the component, which doesn't count as a change
+const revision = `{
+  "openapi": "3.0.3",
+  "paths": {
+    "/orgs": {
+      "get": {
+        "parameters": [
+          {"in": "query", "name": "limit", "schema": {"type": "integer", "maximum": 50}},
+          {"in": "query", "name": "q", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Organization"}}}}
+        }
+      },
+      "post": {
+        "requestBody": {
+          "content": {"application/json": {"schema": {
+            "type": "object",
+            "required": ["name", "slug"],
+            "properties": {
+              "name": {"type": "string"},
+              "slug": {"type": "string"},
+              "role": {"type": "string", "enum": ["admin", "member"]}
+            }
+          }}}
+        },
+        "responses": {"201": {"description": "Created"}, "409": {"description": "Conflict"}}
+      }
+    }
+  },
+  "components": {"schemas": {"Organization": {
+    "type": "object",
+    "required": ["id", "slug"],
+    "properties": {
+      "id": {"type": "string"},
+      "slug": {"type": "string"},
+      "plan": {"type": "string", "enum": ["free", "pro", "enterprise"]},
+      "parent": {"$ref": "#/components/schemas/Organization"}
+    }
+  }}}
+}`
+
+func TestCompare(t *testing.T) {
+	report, err := specdiff.Compare([]byte(base), []byte(revision))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []specdiff.Change{
+		{specdiff.Breaking, "GET /orgs", "query parameter limit", "maximum changed from 100 to 50"},
+		{specdiff.NonBreaking, "GET /orgs", "query parameter q", "added as optional"},
+		{specdiff.Breaking, "GET /orgs", "response 200.id", "type changed from integer to string"},
+		{specdiff.Breaking, "GET /orgs", "response 200.plan", "enum value enterprise added"},
+		{specdiff.Breaking, "GET /orgs", "response 404", "removed"},
+		{specdiff.Breaking, "POST /orgs", "request body.role", "enum value owner removed"},
+		{specdiff.Breaking, "POST /orgs", "request body.slug", "required property added"},
+		{specdiff.NonBreaking, "POST /orgs", "response 409", "added"},
+		{specdiff.Breaking, "DELETE /orgs/{orgId}", "", "operation removed"},
+	}
+
+	for _, change := range expected {
+		if !slices.Contains(report.Changes, change) {
+			t.Errorf("Expected %s in %v", change, report.Changes)
+		}
+	}
+
+	if len(report.Changes) != len(expected) || report.Breaking != 7 {
+		t.Errorf("Expected %d changes, 7 breaking, got %d: %v", len(expected), report.Breaking, report.Changes)
+	}
+}
+
+func TestCompareDirections(t *testing.T) {
+	spec := func(schema string) []byte {
+		return []byte(`{"openapi": "3.0.3", "paths": {"/items": {"put": {
+			"requestBody": {"content": {"application/json": {"schema": ` + schema + `}}},
+			"responses": {"200": {"content": {"application/json": {"schema": ` + schema + `}}}}
+		}}}}`)
+	}
+
+	// Making a field optional only breaks clients reading it
+	report, err := specdiff.Compare(
+		spec(`{"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}}}`),
+		spec(`{"type": "object", "properties": {"name": {"type": "string", "nullable": true}}}`),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, change := range report.Changes {
+		if breaks := change.Location != "request body.name"; breaks != (change.Severity == specdiff.Breaking) {
+			t.Errorf("Unexpected severity of %s", change)
+		}
+	}
+
+	if len(report.Changes) != 4 || report.Breaking != 2 {
+		t.Errorf("Expected 4 changes, 2 breaking, got %v", report.Changes)
+	}
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/maybemaby/oapibase/api/utils"
+	"github.com/oaswrap/spec/option"
+)
+
+// StreamFormat frames the items of a stream, its value is the Content-Type of the response
+type StreamFormat string
+
+const (
+	// NDJSON writes one JSON value per line. A stream that fails ends with an {"error": problem} line
+	NDJSON StreamFormat = "application/x-ndjson"
+	// JSONArray writes the items as a single JSON array. A stream that fails is left unterminated,
+	// so clients can't mistake it for the complete result
+	JSONArray StreamFormat = "application/json"
+)
+
+// StreamErrorTrailer is the trailer carrying the problem code of a stream that failed after its first item
+const StreamErrorTrailer = "Stream-Error"
+
+// StreamOptions configures Stream. The zero value writes NDJSON
+type StreamOptions struct {
+	Format StreamFormat
+	// FlushEvery is how many items are written between flushes, defaults to 32
+	FlushEvery int
+}
+
+// streamError is the last line of an NDJSON stream that failed
+type streamError struct {
+	Error *utils.Problem `json:"error"`
+}
+
+// Stream writes the items of seq as they come, flushing every opts.FlushEvery items. An error before the
+// first item is answered with a problem like an OpFunc error. Later errors are reported in the
+// Stream-Error trailer and, for NDJSON, a final error line. A cancelled request context stops the stream.
+// The error that ended the stream is returned once the client has been told, unexpected ones are logged.
+// Streams must not be mounted behind CachePolicy.Middleware or HandlerTimeout, both buffer or cut them
+func Stream[T any](w http.ResponseWriter, r *http.Request, seq iter.Seq2[T, error], opts StreamOptions) error {
+	if opts.Format == "" {
+		opts.Format = NDJSON
+	}
+
+	if opts.FlushEvery <= 0 {
+		opts.FlushEvery = 32
+	}
+
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+	count := 0
+
+	start := func() {
+		w.Header().Set("Content-Type", string(opts.Format))
+		w.Header().Set("Trailer", StreamErrorTrailer)
+		w.WriteHeader(http.StatusOK)
+	}
+
+	fail := func(err error) error {
+		if count == 0 {
+			writeOpError(w, r, err)
+			return err
+		}
+
+		// The client is gone, there is no one left to tell
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+
+		problem := errorProblem(r, err).ForRequest(r)
+		w.Header().Set(StreamErrorTrailer, string(problem.Code))
+
+		if opts.Format == NDJSON {
+			_ = json.NewEncoder(w).Encode(streamError{Error: problem})
+		}
+
+		return err
+	}
+
+	for item, err := range seq {
+		if err == nil {
+			err = ctx.Err()
+		}
+
+		if err != nil {
+			return fail(err)
+		}
+
+		data, err := json.Marshal(item)
+
+		if err != nil {
+			return fail(fmt.Errorf("encoding stream item: %w", err))
+		}
+
+		prefix := ","
+
+		if count == 0 {
+			start()
+			prefix = "["
+		}
+
+		if opts.Format == NDJSON {
+			prefix = ""
+			data = append(data, '\n')
+		}
+
+		if _, err := io.WriteString(w, prefix); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+
+		count++
+
+		if count%opts.FlushEvery == 0 {
+			_ = rc.Flush()
+		}
+	}
+
+	if count == 0 {
+		start()
+
+		if opts.Format == JSONArray {
+			_, err := io.WriteString(w, "[]\n")
+			return err
+		}
+
+		return nil
+	}
+
+	if opts.Format == JSONArray {
+		if _, err := io.WriteString(w, "]\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rows iterates rows scanned with scan and closes them, any error ends the iteration
+func Rows[T any](rows pgx.Rows, scan pgx.RowToFunc[T]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		defer rows.Close()
+
+		for rows.Next() {
+			item, err := scan(rows)
+
+			if !yield(item, err) || err != nil {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			var zero T
+			yield(zero, err)
+		}
+	}
+}
+
+// StreamRows is Stream over pgx rows, e.g. StreamRows(w, r, rows, pgx.RowToStructByName[Item], opts)
+func StreamRows[T any](w http.ResponseWriter, r *http.Request, rows pgx.Rows, scan pgx.RowToFunc[T], opts StreamOptions) error {
+	return Stream(w, r, Rows(rows, scan), opts)
+}
+
+// StreamResponse documents the 200 of a route streaming items of type T in format.
+// NDJSON is documented with the schema of a single line
+func StreamResponse[T any](format StreamFormat) option.OperationOption {
+	description := "A JSON array written as items are read. If the stream fails it is left unterminated " +
+		"and the " + StreamErrorTrailer + " trailer holds the problem code"
+	schema := Encoded(new([]T), string(format))
+
+	if format == NDJSON {
+		description = "One JSON value per line, written as items are read. If the stream fails it ends with " +
+			`an {"error": problem} line and the ` + StreamErrorTrailer + " trailer holds the problem code"
+		schema = Encoded(new(T), string(format))
+	}
+
+	return option.Response(http.StatusOK, schema, option.ContentDescription(description))
+}
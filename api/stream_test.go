@@ -0,0 +1,127 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"iter"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api"
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+type streamItem struct {
+	Id int `json:"id"`
+}
+
+// items yields n items, then err when it is set
+func items(n int, err error) iter.Seq2[streamItem, error] {
+	return func(yield func(streamItem, error) bool) {
+		for i := range n {
+			if !yield(streamItem{Id: i + 1}, nil) {
+				return
+			}
+		}
+
+		if err != nil {
+			yield(streamItem{}, err)
+		}
+	}
+}
+
+func serveStream(ctx context.Context, seq iter.Seq2[streamItem, error], format api.StreamFormat) (*http.Response, string, error) {
+	req := httptest.NewRequest(http.MethodGet, "/items", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+
+	err := api.Stream(rec, req, seq, api.StreamOptions{Format: format, FlushEvery: 2})
+	res := rec.Result()
+
+	return res, rec.Body.String(), err
+}
+
+func TestStreamFormats(t *testing.T) {
+	cases := []struct {
+		format api.StreamFormat
+		n      int
+		body   string
+	}{
+		{api.NDJSON, 3, "{\"id\":1}\n{\"id\":2}\n{\"id\":3}\n"},
+		{api.NDJSON, 0, ""},
+		{api.JSONArray, 3, "[{\"id\":1},{\"id\":2},{\"id\":3}]\n"},
+		{api.JSONArray, 0, "[]\n"},
+	}
+
+	for _, c := range cases {
+		res, body, err := serveStream(context.Background(), items(c.n, nil), c.format)
+
+		if err != nil || res.StatusCode != http.StatusOK || body != c.body {
+			t.Errorf("%s with %d items: got %d %q, %v", c.format, c.n, res.StatusCode, body, err)
+		}
+
+		if res.Header.Get("Content-Type") != string(c.format) || res.Trailer.Get(api.StreamErrorTrailer) != "" {
+			t.Errorf("%s with %d items: unexpected headers %v, trailers %v", c.format, c.n, res.Header, res.Trailer)
+		}
+	}
+}
+
+func TestStreamErrorBeforeFirstItem(t *testing.T) {
+	res, body, err := serveStream(context.Background(), items(0, utils.NotFound("no items")), api.NDJSON)
+
+	if err == nil || res.StatusCode != http.StatusNotFound || res.Header.Get("Content-Type") != utils.ProblemContentType {
+		t.Fatalf("Expected a 404 problem, got %d %q", res.StatusCode, body)
+	}
+}
+
+func TestStreamErrorMidStream(t *testing.T) {
+	failure := errors.New("connection reset")
+
+	res, body, err := serveStream(context.Background(), items(2, failure), api.NDJSON)
+
+	if !errors.Is(err, failure) || res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the stream error after a 200, got %d, %v", res.StatusCode, err)
+	}
+
+	if res.Trailer.Get(api.StreamErrorTrailer) != string(utils.CodeInternal) {
+		t.Errorf("Expected the problem code in the trailer, got %v", res.Trailer)
+	}
+
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	var last struct {
+		Error utils.Problem `json:"error"`
+	}
+
+	if len(lines) != 3 || json.Unmarshal([]byte(lines[2]), &last) != nil || last.Error.Code != utils.CodeInternal {
+		t.Errorf("Expected two items and an error line, got %q", body)
+	}
+
+	_, body, _ = serveStream(context.Background(), items(2, failure), api.JSONArray)
+
+	if body != `[{"id":1},{"id":2}` {
+		t.Errorf("Expected an unterminated array, got %q", body)
+	}
+}
+
+func TestStreamStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	seq := func(yield func(streamItem, error) bool) {
+		for i := range 10 {
+			if i == 2 {
+				cancel()
+			}
+
+			if !yield(streamItem{Id: i + 1}, nil) {
+				return
+			}
+		}
+	}
+
+	res, body, err := serveStream(ctx, seq, api.NDJSON)
+
+	if !errors.Is(err, context.Canceled) || body != "{\"id\":1}\n{\"id\":2}\n" || res.Trailer.Get(api.StreamErrorTrailer) != "" {
+		t.Errorf("Expected the stream to stop silently after 2 items, got %q, %v", body, err)
+	}
+}
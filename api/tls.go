@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// TLSConfig serves HTTPS from PEM files, which are reloaded when they change on disk so renewed
+// certificates are picked up without a restart
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mTLS, client certificates are verified against the CAs in it
+	ClientCAFile string
+	// ClientAuth defaults to tls.RequireAndVerifyClientCert when ClientCAFile is set
+	ClientAuth tls.ClientAuthType
+	// ReloadInterval is how often the files are checked for changes, defaults to 1 minute
+	ReloadInterval time.Duration
+}
+
+// tlsReloader hands out a config built from the current files to every handshake
+type tlsReloader struct {
+	cfg     TLSConfig
+	current atomic.Pointer[tls.Config]
+	modTime time.Time
+}
+
+func newTLSReloader(cfg TLSConfig) (*tlsReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls: cert and key files are required")
+	}
+
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = time.Minute
+	}
+
+	reloader := &tlsReloader{cfg: cfg}
+
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// latestModTime is the newest modification time of the configured files
+func (t *tlsReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range []string{t.cfg.CertFile, t.cfg.KeyFile, t.cfg.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (t *tlsReloader) load() error {
+	modTime, err := t.latestModTime()
+
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.cfg.CertFile, t.cfg.KeyFile)
+
+	if err != nil {
+		return fmt.Errorf("tls: loading key pair: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256},
+		Certificates:     []tls.Certificate{cert},
+		// Configs handed out per handshake don't get the server's ALPN defaults
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if t.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.cfg.ClientCAFile)
+
+		if err != nil {
+			return fmt.Errorf("tls: reading client CAs: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls: no certificates found in %s", t.cfg.ClientCAFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = t.cfg.ClientAuth
+
+		if config.ClientAuth == tls.NoClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	t.current.Store(config)
+	t.modTime = modTime
+
+	return nil
+}
+
+// serverConfig is the config to give http.Server, the actual one is picked per handshake
+func (t *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current.Load(), nil
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &t.current.Load().Certificates[0], nil
+		},
+	}
+}
+
+// watch reloads the files whenever they change until ctx is done. A failed reload, e.g. while
+// a renewal has written the cert but not yet the key, keeps the previous config and is retried
+func (t *tlsReloader) watch(ctx context.Context, logger *slog.Logger) {
+	ticker := time.NewTicker(t.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTime, err := t.latestModTime()
+
+			if err != nil || !modTime.After(t.modTime) {
+				continue
+			}
+
+			if err := t.load(); err != nil {
+				logger.Error("Error reloading TLS certificates", slog.Any("err", err))
+				continue
+			}
+
+			logger.Info("Reloaded TLS certificates")
+		}
+	}
+}
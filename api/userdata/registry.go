@@ -0,0 +1,121 @@
+// Package userdata collects everything stored about a user into a single export archive.
+// Packages owning user data register a section from an init func, so new tables are
+// included in exports by registering next to the queries that create them.
+package userdata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ExportFunc returns the data a section holds about the user, it must be JSON encodable
+type ExportFunc func(ctx context.Context, userId int, db *pgxpool.Pool) (any, error)
+
+type Registry struct {
+	mu       sync.RWMutex
+	sections map[string]ExportFunc
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sections: map[string]ExportFunc{},
+	}
+}
+
+// Register adds a section to the archive, it panics if the name is already taken
+func (r *Registry) Register(name string, fn ExportFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sections[name]; ok {
+		panic(fmt.Sprintf("userdata: section %q registered twice", name))
+	}
+
+	r.sections[name] = fn
+}
+
+// Sections returns the registered section names in archive order
+func (r *Registry) Sections() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.sections))
+
+	for name := range r.sections {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// WriteArchive streams the archive as a single JSON object, encoding and flushing one section at a time.
+// Sections already written can't be taken back, so an error leaves the archive truncated
+func (r *Registry) WriteArchive(ctx context.Context, w io.Writer, userId int, db *pgxpool.Pool) error {
+	header, err := json.Marshal(map[string]any{
+		"userId":     userId,
+		"exportedAt": time.Now().UTC(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Reopen the header object to append the data field
+	if _, err := fmt.Fprintf(w, "%s,\"data\":{", header[:len(header)-1]); err != nil {
+		return err
+	}
+
+	for i, name := range r.Sections() {
+		r.mu.RLock()
+		fn := r.sections[name]
+		r.mu.RUnlock()
+
+		data, err := fn(ctx, userId, db)
+
+		if err != nil {
+			return fmt.Errorf("userdata: section %s: %w", name, err)
+		}
+
+		key, _ := json.Marshal(name)
+		value, err := json.Marshal(data)
+
+		if err != nil {
+			return fmt.Errorf("userdata: section %s: %w", name, err)
+		}
+
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "%s:%s", key, value); err != nil {
+			return err
+		}
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	_, err = io.WriteString(w, "}}\n")
+
+	return err
+}
+
+var DefaultRegistry = NewRegistry()
+
+// Register adds a section to DefaultRegistry
+func Register(name string, fn ExportFunc) {
+	DefaultRegistry.Register(name, fn)
+}
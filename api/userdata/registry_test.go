@@ -0,0 +1,77 @@
+package userdata_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/maybemaby/oapibase/api/userdata"
+)
+
+func TestWriteArchive(t *testing.T) {
+	registry := userdata.NewRegistry()
+
+	registry.Register("profile", func(ctx context.Context, userId int, db *pgxpool.Pool) (any, error) {
+		return map[string]int{"id": userId}, nil
+	})
+
+	registry.Register("accounts", func(ctx context.Context, userId int, db *pgxpool.Pool) (any, error) {
+		return []string{"google"}, nil
+	})
+
+	var buf bytes.Buffer
+
+	if err := registry.WriteArchive(context.Background(), &buf, 7, nil); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+
+	var archive struct {
+		UserId int                        `json:"userId"`
+		Data   map[string]json.RawMessage `json:"data"`
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &archive); err != nil {
+		t.Fatalf("Archive is not valid JSON: %v\n%s", err, buf.String())
+	}
+
+	if archive.UserId != 7 {
+		t.Errorf("Expected user id 7, got %d", archive.UserId)
+	}
+
+	if string(archive.Data["profile"]) != `{"id":7}` || string(archive.Data["accounts"]) != `["google"]` {
+		t.Errorf("Unexpected archive data: %s", buf.String())
+	}
+}
+
+func TestWriteArchiveSectionError(t *testing.T) {
+	registry := userdata.NewRegistry()
+	sectionErr := errors.New("boom")
+
+	registry.Register("broken", func(ctx context.Context, userId int, db *pgxpool.Pool) (any, error) {
+		return nil, sectionErr
+	})
+
+	err := registry.WriteArchive(context.Background(), &bytes.Buffer{}, 1, nil)
+
+	if !errors.Is(err, sectionErr) {
+		t.Errorf("Expected section error, got %v", err)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	registry := userdata.NewRegistry()
+	fn := func(ctx context.Context, userId int, db *pgxpool.Pool) (any, error) { return nil, nil }
+
+	registry.Register("profile", fn)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected duplicate registration to panic")
+		}
+	}()
+
+	registry.Register("profile", fn)
+}
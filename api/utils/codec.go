@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes responses and decodes request bodies in one media type.
+// Codecs read the json struct tags so every encoding has the same field names
+type Codec interface {
+	MediaType() string
+	Encode(w io.Writer, v any) error
+	// Unmarshal decodes data, which must hold exactly one value, rejecting unknown fields unless allowUnknown
+	Unmarshal(data []byte, v any, allowUnknown bool) error
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) MediaType() string {
+	return "application/json"
+}
+
+func (JSONCodec) Encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any, allowUnknown bool) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if !allowUnknown {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	var trailing json.RawMessage
+
+	if err := dec.Decode(&trailing); !errors.Is(err, io.EOF) {
+		return errors.New("json: trailing data after the value")
+	}
+
+	return nil
+}
+
+var (
+	cborEncMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	cborDecMode, _ = cbor.DecOptions{
+		DupMapKey:      cbor.DupMapKeyEnforcedAPF,
+		DefaultMapType: reflect.TypeFor[map[string]any](),
+	}.DecMode()
+	cborStrictDecMode, _ = cbor.DecOptions{
+		DupMapKey:         cbor.DupMapKeyEnforcedAPF,
+		DefaultMapType:    reflect.TypeFor[map[string]any](),
+		ExtraReturnErrors: cbor.ExtraDecErrorUnknownField,
+	}.DecMode()
+)
+
+// CBORCodec encodes times as RFC 3339 strings, like JSON
+type CBORCodec struct{}
+
+func (CBORCodec) MediaType() string {
+	return "application/cbor"
+}
+
+func (CBORCodec) Encode(w io.Writer, v any) error {
+	return cborEncMode.NewEncoder(w).Encode(v)
+}
+
+func (CBORCodec) Unmarshal(data []byte, v any, allowUnknown bool) error {
+	if allowUnknown {
+		return cborDecMode.Unmarshal(data, v)
+	}
+
+	return cborStrictDecMode.Unmarshal(data, v)
+}
+
+type MsgPackCodec struct{}
+
+func (MsgPackCodec) MediaType() string {
+	return "application/msgpack"
+}
+
+func (MsgPackCodec) Encode(w io.Writer, v any) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+
+	return enc.Encode(v)
+}
+
+func (MsgPackCodec) Unmarshal(data []byte, v any, allowUnknown bool) error {
+	reader := bytes.NewReader(data)
+	dec := msgpack.NewDecoder(reader)
+	dec.SetCustomStructTag("json")
+	dec.DisallowUnknownFields(!allowUnknown)
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	if reader.Len() > 0 {
+		return errors.New("msgpack: trailing data after the value")
+	}
+
+	return nil
+}
+
+// CodecRegistry holds the codecs requests and responses can use, in order of preference
+type CodecRegistry struct {
+	mu     sync.RWMutex
+	codecs []Codec
+}
+
+func NewCodecRegistry(codecs ...Codec) *CodecRegistry {
+	registry := &CodecRegistry{}
+
+	for _, codec := range codecs {
+		registry.Register(codec)
+	}
+
+	return registry
+}
+
+// Codecs is the registry used by Decode and WriteResponse, JSON is preferred
+var Codecs = NewCodecRegistry(JSONCodec{}, CBORCodec{}, MsgPackCodec{})
+
+// Register adds codec with the lowest preference, or replaces the codec of the same media type
+func (reg *CodecRegistry) Register(codec Codec) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	codecs := slices.Clone(reg.codecs)
+	index := slices.IndexFunc(codecs, func(c Codec) bool { return c.MediaType() == codec.MediaType() })
+
+	if index >= 0 {
+		codecs[index] = codec
+	} else {
+		codecs = append(codecs, codec)
+	}
+
+	reg.codecs = codecs
+}
+
+func (reg *CodecRegistry) list() []Codec {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	return reg.codecs
+}
+
+// MediaTypes lists the registered media types in order of preference
+func (reg *CodecRegistry) MediaTypes() []string {
+	types := []string{}
+
+	for _, codec := range reg.list() {
+		types = append(types, codec.MediaType())
+	}
+
+	return types
+}
+
+// Lookup finds the codec of mediaType. JSON based types like application/merge-patch+json use the JSON codec
+func (reg *CodecRegistry) Lookup(mediaType string) (Codec, bool) {
+	mediaType = strings.ToLower(mediaType)
+
+	for _, codec := range reg.list() {
+		if codec.MediaType() == mediaType {
+			return codec, true
+		}
+	}
+
+	if strings.HasSuffix(mediaType, "+json") {
+		return reg.Lookup("application/json")
+	}
+
+	return nil, false
+}
+
+// acceptRange is one media range of an Accept header
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(accept string) []acceptRange {
+	ranges := []acceptRange{}
+
+	for part := range strings.SplitSeq(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+
+	return ranges
+}
+
+// quality is the q the ranges give mediaType, taken from the most specific matching range
+func quality(mediaType string, ranges []acceptRange) float64 {
+	kind, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, 0
+
+	for _, r := range ranges {
+		matched := 0
+
+		switch {
+		case r.mediaType == mediaType:
+			matched = 3
+		case r.mediaType == kind+"/*":
+			matched = 2
+		case r.mediaType == "*/*":
+			matched = 1
+		}
+
+		if matched > specificity {
+			q, specificity = r.q, matched
+		}
+	}
+
+	return q
+}
+
+// Negotiate picks the codec with the highest q value in accept, ties go to the preferred codec.
+// An empty or unparseable Accept accepts anything
+func (reg *CodecRegistry) Negotiate(accept string) (Codec, bool) {
+	codecs := reg.list()
+
+	if len(codecs) == 0 {
+		return nil, false
+	}
+
+	ranges := parseAccept(accept)
+
+	if len(ranges) == 0 {
+		return codecs[0], true
+	}
+
+	var best Codec
+	bestQ := 0.0
+
+	for _, codec := range codecs {
+		if q := quality(codec.MediaType(), ranges); q > bestQ {
+			best, bestQ = codec, q
+		}
+	}
+
+	return best, best != nil
+}
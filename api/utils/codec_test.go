@@ -0,0 +1,125 @@
+package utils_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		accept    string
+		mediaType string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"application/cbor", "application/cbor"},
+		{"application/json;q=0.5, application/msgpack", "application/msgpack"},
+		{"application/*;q=0.2, application/cbor;q=0.9", "application/cbor"},
+		{"application/json;q=0, */*", "application/cbor"},
+		{"text/html, application/json;q=0.1", "application/json"},
+		{"text/html", ""},
+	}
+
+	for _, c := range cases {
+		codec, ok := utils.Codecs.Negotiate(c.accept)
+		mediaType := ""
+
+		if ok {
+			mediaType = codec.MediaType()
+		}
+
+		if mediaType != c.mediaType {
+			t.Errorf("Accept %q: expected %q, got %q", c.accept, c.mediaType, mediaType)
+		}
+	}
+}
+
+func TestWriteResponseNotAcceptable(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+
+	if err := utils.WriteResponse(rec, req, http.StatusOK, decodeTarget{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != http.StatusNotAcceptable || rec.Header().Get("Content-Type") != utils.ProblemContentType {
+		t.Errorf("Expected a 406 problem, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestDecodeRoundTrip(t *testing.T) {
+	for _, mediaType := range []string{"application/cbor", "application/msgpack"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", mediaType)
+		rec := httptest.NewRecorder()
+
+		if err := utils.WriteResponse(rec, req, http.StatusOK, decodeTarget{Name: "a", Count: 2}); err != nil {
+			t.Fatal(err)
+		}
+
+		if rec.Header().Get("Content-Type") != mediaType || rec.Header().Get("Vary") != "Accept" {
+			t.Errorf("%s: unexpected headers %v", mediaType, rec.Header())
+		}
+
+		req = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(rec.Body.Bytes()))
+		req.Header.Set("Content-Type", mediaType)
+
+		var target decodeTarget
+
+		if err := utils.Decode(httptest.NewRecorder(), req, &target, utils.DecodeOptions{}); err != nil {
+			t.Fatalf("%s: %v", mediaType, err)
+		}
+
+		if target != (decodeTarget{Name: "a", Count: 2}) {
+			t.Errorf("%s: expected the written value back, got %+v", mediaType, target)
+		}
+	}
+}
+
+func TestDecodeRejectsUnknownFields(t *testing.T) {
+	type extended struct {
+		decodeTarget
+		Extra bool `json:"extra"`
+	}
+
+	for _, mediaType := range []string{"application/cbor", "application/msgpack"} {
+		codec, _ := utils.Codecs.Lookup(mediaType)
+		var body bytes.Buffer
+
+		if err := codec.Encode(&body, extended{Extra: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/", &body)
+		req.Header.Set("Content-Type", mediaType)
+
+		var target decodeTarget
+		err := utils.Decode(httptest.NewRecorder(), req, &target, utils.DecodeOptions{})
+
+		var decodeErr *utils.DecodeError
+
+		if !errors.As(err, &decodeErr) || decodeErr.Status != http.StatusBadRequest {
+			t.Errorf("%s: expected a 400 DecodeError, got %v", mediaType, err)
+		}
+	}
+}
+
+func TestDecodeUnsupportedMediaType(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte{0xa0}))
+	req.Header.Set("Content-Type", "application/cbor")
+
+	var target decodeTarget
+	err := utils.Decode(httptest.NewRecorder(), req, &target, utils.DecodeOptions{ContentTypes: []string{"application/json"}})
+
+	var decodeErr *utils.DecodeError
+
+	if !errors.As(err, &decodeErr) || decodeErr.Status != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected a 415 DecodeError, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// DefaultMaxBodyBytes caps request bodies when DecodeOptions.MaxBytes is not set
+var DefaultMaxBodyBytes int64 = 1 << 20
+
+// DecodeOptions configures Decode and DecodeJSON. The zero value is strict: 1MiB, no unknown fields
+type DecodeOptions struct {
+	MaxBytes int64
+	// ContentTypes are the accepted media types. Decode defaults to every registered codec, DecodeJSON to application/json
+	ContentTypes       []string
+	AllowUnknownFields bool
+	// AllowEmpty leaves the target untouched when the request has no body
+	AllowEmpty bool
+}
+
+// DecodeError is a client error found while decoding a request body
+type DecodeError struct {
+	Status  int
+	Message string
+	// Field is the dotted path of the offending field, if any
+	Field string
+	// Offset is the byte offset in the body where decoding failed, -1 when unknown
+	Offset int64
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return e.Message
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func badRequest(message string, field string, offset int64, err error) *DecodeError {
+	return &DecodeError{Status: http.StatusBadRequest, Message: message, Field: field, Offset: offset, Err: err}
+}
+
+// jsonTypeName names t the way a client sees it in JSON
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	default:
+		return "object"
+	}
+}
+
+// decodeError turns a json decoding error into a DecodeError, errors that aren't the client's fault are returned as is
+func decodeError(err error, offset int64) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return &DecodeError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("Request body must not be larger than %d bytes", maxBytesErr.Limit),
+			Offset:  -1,
+			Err:     err,
+		}
+	case errors.As(err, &syntaxErr):
+		return badRequest(fmt.Sprintf("Malformed JSON at offset %d", syntaxErr.Offset), "", syntaxErr.Offset, err)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return badRequest("Malformed JSON, the body ended unexpectedly", "", offset, err)
+	case errors.As(err, &typeErr):
+		return badRequest(fmt.Sprintf("Expected %s, got %s", jsonTypeName(typeErr.Type), typeErr.Value), typeErr.Field, typeErr.Offset, err)
+	}
+
+	// encoding/json has no typed error for unknown fields
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return badRequest("Unknown field", strings.Trim(field, `"`), offset, err)
+	}
+
+	if errors.Is(err, io.EOF) {
+		return badRequest("Request body must not be empty", "", 0, err)
+	}
+
+	return err
+}
+
+func unsupportedMediaType(contentTypes []string) *DecodeError {
+	return &DecodeError{
+		Status:  http.StatusUnsupportedMediaType,
+		Message: "Content-Type must be " + strings.Join(contentTypes, " or "),
+		Offset:  -1,
+	}
+}
+
+// Decode strictly decodes the body of r into target with the codec of its Content-Type, see Codecs.
+// Client errors are returned as *DecodeError, anything else is a failure to read the body
+func Decode(w http.ResponseWriter, r *http.Request, target any, opts DecodeOptions) error {
+	if opts.AllowEmpty && (r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0) {
+		return nil
+	}
+
+	contentTypes := opts.ContentTypes
+
+	if contentTypes == nil {
+		contentTypes = Codecs.MediaTypes()
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	codec, ok := Codecs.Lookup(mediaType)
+
+	if !ok || !slices.Contains(contentTypes, mediaType) {
+		return unsupportedMediaType(contentTypes)
+	}
+
+	// JSON keeps its detailed errors, with offsets and field paths
+	if _, isJSON := codec.(JSONCodec); isJSON {
+		opts.ContentTypes = []string{mediaType}
+		return DecodeJSON(w, r, target, opts)
+	}
+
+	maxBytes := opts.MaxBytes
+
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBodyBytes
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+
+	if err != nil {
+		return decodeError(err, -1)
+	}
+
+	if len(body) == 0 {
+		return badRequest("Request body must not be empty", "", 0, io.EOF)
+	}
+
+	if err := codec.Unmarshal(body, target, opts.AllowUnknownFields); err != nil {
+		return badRequest("Malformed "+mediaType+" body: "+err.Error(), "", -1, err)
+	}
+
+	return nil
+}
+
+// DecodeJSON strictly decodes the body of r into target.
+// Client errors are returned as *DecodeError, anything else is a failure to read the body
+func DecodeJSON(w http.ResponseWriter, r *http.Request, target any, opts DecodeOptions) error {
+	if opts.AllowEmpty && (r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0) {
+		return nil
+	}
+
+	contentTypes := opts.ContentTypes
+
+	if contentTypes == nil {
+		contentTypes = []string{"application/json"}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if !slices.Contains(contentTypes, mediaType) {
+		return unsupportedMediaType(contentTypes)
+	}
+
+	maxBytes := opts.MaxBytes
+
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBodyBytes
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes))
+
+	if !opts.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(target); err != nil {
+		return decodeError(err, dec.InputOffset())
+	}
+
+	// Anything but whitespace after the value means the client sent something we'd silently ignore
+	var trailing json.RawMessage
+	offset := dec.InputOffset()
+
+	if err := dec.Decode(&trailing); !errors.Is(err, io.EOF) {
+		var maxBytesErr *http.MaxBytesError
+
+		if errors.As(err, &maxBytesErr) {
+			return decodeError(err, offset)
+		}
+
+		return badRequest("Request body must contain a single JSON value", "", offset, err)
+	}
+
+	return nil
+}
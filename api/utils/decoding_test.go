@@ -0,0 +1,67 @@
+package utils_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+type decodeTarget struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func decode(body, contentType string, opts utils.DecodeOptions) (*utils.DecodeError, error) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+
+	var target decodeTarget
+	err := utils.DecodeJSON(httptest.NewRecorder(), req, &target, opts)
+
+	var decodeErr *utils.DecodeError
+	errors.As(err, &decodeErr)
+
+	return decodeErr, err
+}
+
+func TestDecodeJSONAcceptsValidBody(t *testing.T) {
+	if _, err := decode(`{"name": "a", "count": 1}`+"\n", "application/json; charset=utf-8", utils.DecodeOptions{}); err != nil {
+		t.Fatalf("Expected valid body to decode, got %v", err)
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	cases := []struct {
+		name        string
+		body        string
+		contentType string
+		opts        utils.DecodeOptions
+		status      int
+		field       string
+	}{
+		{"unknown field", `{"name": "a", "extra": 1}`, "application/json", utils.DecodeOptions{}, 400, "extra"},
+		{"wrong type", `{"count": "1"}`, "application/json", utils.DecodeOptions{}, 400, "count"},
+		{"trailing data", `{"name": "a"} {"name": "b"}`, "application/json", utils.DecodeOptions{}, 400, ""},
+		{"malformed", `{"name": `, "application/json", utils.DecodeOptions{}, 400, ""},
+		{"empty", ``, "application/json", utils.DecodeOptions{}, 400, ""},
+		{"content type", `{"name": "a"}`, "text/plain", utils.DecodeOptions{}, 415, ""},
+		{"too large", `{"name": "aaaaaaaaaa"}`, "application/json", utils.DecodeOptions{MaxBytes: 8}, 413, ""},
+	}
+
+	for _, c := range cases {
+		decodeErr, err := decode(c.body, c.contentType, c.opts)
+
+		if decodeErr == nil {
+			t.Errorf("%s: expected a DecodeError, got %v", c.name, err)
+			continue
+		}
+
+		if decodeErr.Status != c.status || decodeErr.Field != c.field {
+			t.Errorf("%s: expected status %d and field %q, got %d and %q", c.name, c.status, c.field, decodeErr.Status, decodeErr.Field)
+		}
+	}
+}
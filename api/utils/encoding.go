@@ -7,11 +7,29 @@ import (
 	"strings"
 )
 
+// ReadJSON decodes the body of r into target with the strict defaults of DecodeJSON
 func ReadJSON[T any](r *http.Request, target T) error {
-	dec := json.NewDecoder(r.Body)
-	return dec.Decode(target)
+	return DecodeJSON(nil, r, target, DecodeOptions{})
 }
 
+// WriteResponse writes data with status in the encoding negotiated from the Accept header of r,
+// or a 406 problem when no codec is acceptable
+func WriteResponse(w http.ResponseWriter, r *http.Request, status int, data any) error {
+	codec, ok := Codecs.Negotiate(r.Header.Get("Accept"))
+
+	if !ok {
+		WriteProblem(w, r, NotAcceptable())
+		return nil
+	}
+
+	w.Header().Set("Content-Type", codec.MediaType())
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+
+	return codec.Encode(w, data)
+}
+
+// WriteJSON writes data as JSON whatever the client accepts, for endpoints outside content negotiation
 func WriteJSON[T any](w http.ResponseWriter, r *http.Request, data T) error {
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
@@ -25,11 +43,6 @@ func WriteJSON[T any](w http.ResponseWriter, r *http.Request, data T) error {
 	return nil
 }
 
-func ErrorJSON[T any](w http.ResponseWriter, error T, code int) {
-	w.WriteHeader(code)
-	_ = WriteJSON(w, nil, error)
-}
-
 // CacheControlOpts represents Cache-Control response directives
 type CacheControlOpts struct {
 	Public          bool
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// ETag derives an entity tag from a response body
+func ETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	tag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+
+	if weak {
+		return "W/" + tag
+	}
+
+	return tag
+}
+
+// RepresentationETags are the strong ETags of data in each encoding WriteResponse may send it in
+func RepresentationETags(data any) ([]string, error) {
+	etags := []string{}
+
+	for _, codec := range Codecs.list() {
+		var buf bytes.Buffer
+
+		if err := codec.Encode(&buf, data); err != nil {
+			return nil, err
+		}
+
+		etags = append(etags, ETag(buf.Bytes(), false))
+	}
+
+	return etags, nil
+}
+
+// ETagMatch reports whether etag is listed in an If-None-Match header value.
+// Tags are compared weakly, ignoring W/ prefixes (RFC 9110 section 8.8.3.2)
+func ETagMatch(header, etag string) bool {
+	header = strings.TrimSpace(header)
+
+	if header == "" || etag == "" {
+		return false
+	}
+
+	if header == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for candidate := range strings.SplitSeq(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ETagMatchStrong reports whether etag is listed in an If-Match header value. Tags are compared strongly,
+// a weak tag on either side never matches, as a weak validator can't prevent lost updates
+func ETagMatchStrong(header, etag string) bool {
+	header = strings.TrimSpace(header)
+
+	if header == "" || etag == "" {
+		return false
+	}
+
+	// Any current representation satisfies *
+	if header == "*" {
+		return true
+	}
+
+	if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+
+	for candidate := range strings.SplitSeq(header, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true
+		}
+	}
+
+	return false
+}
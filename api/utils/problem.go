@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ProblemContentType is the media type of RFC 9457 problem details
+const ProblemContentType = "application/problem+json"
+
+// ProblemCode identifies an error for clients, unlike Detail it is stable and never localized
+type ProblemCode string
+
+const (
+	CodeBadRequest           ProblemCode = "bad_request"
+	CodeInvalidBody          ProblemCode = "invalid_body"
+	CodeBodyTooLarge         ProblemCode = "body_too_large"
+	CodeUnsupportedMediaType ProblemCode = "unsupported_media_type"
+	CodeNotAcceptable        ProblemCode = "not_acceptable"
+	CodeValidationFailed     ProblemCode = "validation_failed"
+	CodeUnauthorized         ProblemCode = "unauthorized"
+	CodeInvalidCredentials   ProblemCode = "invalid_credentials"
+	CodeForbidden            ProblemCode = "forbidden"
+	CodeNotFound             ProblemCode = "not_found"
+	CodeConflict             ProblemCode = "conflict"
+	CodePreconditionFailed   ProblemCode = "precondition_failed"
+	CodeRateLimited          ProblemCode = "rate_limited"
+	CodeIdempotencyInFlight  ProblemCode = "idempotency_key_in_flight"
+	CodeIdempotencyMismatch  ProblemCode = "idempotency_key_reused"
+	CodeInvalidHost          ProblemCode = "invalid_host"
+	CodeInternal             ProblemCode = "internal_error"
+	CodeTimeout              ProblemCode = "timeout"
+
+	CodeInviteOnly       ProblemCode = "invite_only"
+	CodeInvalidInvite    ProblemCode = "invalid_invite"
+	CodeInvalidToken     ProblemCode = "invalid_token"
+	CodeEmailNotVerified ProblemCode = "email_not_verified"
+	CodeEmailTaken       ProblemCode = "email_taken"
+	CodeSlugTaken        ProblemCode = "slug_taken"
+	CodeLastOwner        ProblemCode = "last_owner"
+	CodeAlreadyMember    ProblemCode = "already_member"
+	CodeAccountNotLinked ProblemCode = "account_not_linked"
+	CodeReauthRequired   ProblemCode = "reauthentication_required"
+)
+
+// FieldError points at a single invalid field of the request
+type FieldError struct {
+	// Field is the dotted path of the field, or the name of the parameter
+	Field   string `json:"field" required:"true" example:"email"`
+	Message string `json:"message" required:"true" example:"must be a valid email"`
+}
+
+// Problem is the body of every error response, RFC 9457 problem details with the extension members
+// code, errors and the correlation IDs
+type Problem struct {
+	// Type is about:blank, Code identifies the problem
+	Type   string       `json:"type" required:"true" example:"about:blank"`
+	Title  string       `json:"title" required:"true" example:"Bad Request"`
+	Status int          `json:"status" required:"true" example:"400"`
+	Detail string       `json:"detail,omitempty" example:"Passwords do not match"`
+	Code   ProblemCode  `json:"code" required:"true" example:"validation_failed"`
+	Errors []FieldError `json:"errors,omitempty"`
+	// Offset is the byte offset in the body where decoding failed
+	Offset *int64 `json:"offset,omitempty"`
+	// RequestId and TraceId let support match a report to the server logs
+	RequestId string `json:"requestId,omitempty"`
+	TraceId   string `json:"traceId,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return string(p.Code) + ": " + p.Detail
+	}
+
+	return string(p.Code)
+}
+
+// NewProblem builds a problem titled after status
+func NewProblem(status int, code ProblemCode, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// ForRequest sets the request and trace IDs of r on the problem, for problems sent outside WriteProblem
+func (p *Problem) ForRequest(r *http.Request) *Problem {
+	if r != nil {
+		p.RequestId = RequestIdFunc(r)
+
+		if spanCtx := trace.SpanContextFromContext(r.Context()); spanCtx.IsValid() {
+			p.TraceId = spanCtx.TraceID().String()
+		}
+	}
+
+	return p
+}
+
+// WithErrors attaches field errors to the problem
+func (p *Problem) WithErrors(errs ...FieldError) *Problem {
+	p.Errors = append(p.Errors, errs...)
+	return p
+}
+
+func BadRequest(code ProblemCode, detail string) *Problem {
+	return NewProblem(http.StatusBadRequest, code, detail)
+}
+
+func Unauthorized() *Problem {
+	return NewProblem(http.StatusUnauthorized, CodeUnauthorized, "")
+}
+
+func Forbidden() *Problem {
+	return NewProblem(http.StatusForbidden, CodeForbidden, "")
+}
+
+func NotFound(detail string) *Problem {
+	return NewProblem(http.StatusNotFound, CodeNotFound, detail)
+}
+
+func Conflict(code ProblemCode, detail string) *Problem {
+	return NewProblem(http.StatusConflict, code, detail)
+}
+
+// NotAcceptable is the 406 for an Accept header no codec satisfies
+func NotAcceptable() *Problem {
+	return NewProblem(http.StatusNotAcceptable, CodeNotAcceptable,
+		"Accept must allow one of "+strings.Join(Codecs.MediaTypes(), ", "))
+}
+
+// ValidationFailed is the 422 for a well formed request with invalid fields
+func ValidationFailed(errs ...FieldError) *Problem {
+	return NewProblem(http.StatusUnprocessableEntity, CodeValidationFailed, "Invalid request").WithErrors(errs...)
+}
+
+// RequestIdFunc returns the request ID attached to problems, the api package points it at its request ID middleware
+var RequestIdFunc = func(r *http.Request) string { return "" }
+
+// WriteProblem is the single way errors reach clients, it writes p as application/problem+json
+// with the request and trace IDs of r
+func WriteProblem(w http.ResponseWriter, r *http.Request, p *Problem) {
+	p.ForRequest(r)
+
+	// Content-Type has to be set before the status is written
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,43 @@
+package utils_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+func TestWriteProblem(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Length", "12")
+
+	utils.WriteProblem(rec, httptest.NewRequest(http.MethodPost, "/", nil),
+		utils.ValidationFailed(utils.FieldError{Field: "email", Message: "must be a valid email"}))
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422, got %d", rec.Code)
+	}
+
+	if rec.Header().Get("Content-Type") != utils.ProblemContentType || rec.Header().Get("Content-Length") != "" {
+		t.Errorf("Expected a problem without a stale Content-Length, got %v", rec.Header())
+	}
+
+	var body map[string]any
+
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body["type"] != "about:blank" || body["title"] != "Unprocessable Entity" || body["status"] != float64(422) ||
+		body["code"] != string(utils.CodeValidationFailed) {
+		t.Errorf("Expected the RFC 9457 members, got %v", body)
+	}
+
+	errs, _ := body["errors"].([]any)
+
+	if len(errs) != 1 || errs[0].(map[string]any)["field"] != "email" {
+		t.Errorf("Expected the field error, got %v", body["errors"])
+	}
+}
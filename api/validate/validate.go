@@ -0,0 +1,480 @@
+// Package validate enforces at runtime the jsonschema tags the OpenAPI schemas are generated from,
+// so a documented constraint is always a checked one
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/maybemaby/oapibase/api/utils"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// formats are the checked values of the format tag, others are only documented
+var formats = map[string]func(string) bool{
+	"email": func(s string) bool {
+		addr, err := mail.ParseAddress(s)
+		return err == nil && addr.Address == s
+	},
+	"uuid": uuidPattern.MatchString,
+	"uri": func(s string) bool {
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	},
+	"date-time": func(s string) bool {
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	},
+	"date": func(s string) bool {
+		_, err := time.Parse(time.DateOnly, s)
+		return err == nil
+	},
+	"ipv4": func(s string) bool {
+		addr, err := netip.ParseAddr(s)
+		return err == nil && addr.Is4()
+	},
+	"ipv6": func(s string) bool {
+		addr, err := netip.ParseAddr(s)
+		return err == nil && addr.Is6()
+	},
+}
+
+// rules are the constraints read from the tags of one field, or with the items. prefix of its elements
+type rules struct {
+	required         bool
+	minLength        *int
+	maxLength        *int
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+	pattern          *regexp.Regexp
+	format           string
+	enum             []string
+	minItems         *int
+	maxItems         *int
+	uniqueItems      bool
+}
+
+func (r rules) empty() bool {
+	return reflect.ValueOf(r).IsZero()
+}
+
+type field struct {
+	index []int
+	name  string
+	rules rules
+	items rules
+	// param fields are bound from the request, their presence is checked while binding
+	param bool
+}
+
+type plan struct {
+	fields []field
+}
+
+var plans sync.Map
+
+// Prepare reads and caches the rules of t, reporting tags that can't be parsed.
+// It returns whether values of t have anything to check
+func Prepare(t reflect.Type) (bool, error) {
+	p, err := planFor(t)
+
+	if err != nil {
+		return false, err
+	}
+
+	return p.checks(t, map[reflect.Type]bool{}), nil
+}
+
+// checks reports whether t or the structs reachable from it have rules
+func (p *plan) checks(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if len(p.fields) == 0 || seen[t] {
+		return false
+	}
+
+	seen[t] = true
+
+	for _, f := range p.fields {
+		if !f.rules.empty() || !f.items.empty() {
+			return true
+		}
+	}
+
+	for _, f := range p.fields {
+		nested := t.FieldByIndex(f.index).Type
+
+		for nested.Kind() == reflect.Pointer || nested.Kind() == reflect.Slice || nested.Kind() == reflect.Array {
+			nested = nested.Elem()
+		}
+
+		if nestedPlan, err := planFor(nested); err == nil && nestedPlan.checks(nested, seen) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func planFor(t reflect.Type) (*plan, error) {
+	if t.Kind() != reflect.Struct {
+		return &plan{}, nil
+	}
+
+	if cached, ok := plans.Load(t); ok {
+		return cached.(*plan), nil
+	}
+
+	p := &plan{}
+
+	if err := collectFields(t, nil, p); err != nil {
+		return nil, fmt.Errorf("validate %s: %w", t, err)
+	}
+
+	cached, _ := plans.LoadOrStore(t, p)
+
+	return cached.(*plan), nil
+}
+
+// collectFields flattens embedded structs the way encoding/json does
+func collectFields(t reflect.Type, parent []int, p *plan) error {
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		index := append(append([]int{}, parent...), i)
+		jsonTag, hasJSON := sf.Tag.Lookup("json")
+
+		if sf.Anonymous && !hasJSON && sf.Type.Kind() == reflect.Struct {
+			if err := collectFields(sf.Type, index, p); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+
+		f := field{index: index}
+
+		for _, in := range []string{"path", "query", "header", "cookie"} {
+			if name, ok := sf.Tag.Lookup(in); ok {
+				f.name, f.param = name, true
+			}
+		}
+
+		if !f.param {
+			name, _, _ := strings.Cut(jsonTag, ",")
+
+			if name == "-" {
+				continue
+			}
+
+			if name == "" {
+				name = sf.Name
+			}
+
+			f.name = name
+		}
+
+		var err error
+
+		if f.rules, err = readRules(sf.Tag, ""); err != nil {
+			return fmt.Errorf("field %s: %w", sf.Name, err)
+		}
+
+		if f.items, err = readRules(sf.Tag, "items."); err != nil {
+			return fmt.Errorf("field %s: %w", sf.Name, err)
+		}
+
+		p.fields = append(p.fields, f)
+	}
+
+	return nil
+}
+
+func readRules(tag reflect.StructTag, prefix string) (rules, error) {
+	r := rules{}
+	var err error
+
+	readInt := func(name string, target **int) {
+		if value, ok := tag.Lookup(prefix + name); ok && err == nil {
+			var parsed int
+
+			if parsed, err = strconv.Atoi(value); err == nil {
+				*target = &parsed
+			}
+		}
+	}
+
+	readFloat := func(name string, target **float64) {
+		if value, ok := tag.Lookup(prefix + name); ok && err == nil {
+			var parsed float64
+
+			if parsed, err = strconv.ParseFloat(value, 64); err == nil {
+				*target = &parsed
+			}
+		}
+	}
+
+	if prefix == "" {
+		r.required = tag.Get("required") == "true"
+	}
+
+	readInt("minLength", &r.minLength)
+	readInt("maxLength", &r.maxLength)
+	readInt("minItems", &r.minItems)
+	readInt("maxItems", &r.maxItems)
+	readFloat("minimum", &r.minimum)
+	readFloat("maximum", &r.maximum)
+	readFloat("exclusiveMinimum", &r.exclusiveMinimum)
+	readFloat("exclusiveMaximum", &r.exclusiveMaximum)
+	readFloat("multipleOf", &r.multipleOf)
+
+	if err != nil {
+		return r, err
+	}
+
+	if pattern, ok := tag.Lookup(prefix + "pattern"); ok {
+		if r.pattern, err = regexp.Compile(pattern); err != nil {
+			return r, err
+		}
+	}
+
+	r.format = tag.Get(prefix + "format")
+	r.uniqueItems = tag.Get(prefix+"uniqueItems") == "true"
+
+	if enum := tag.Get(prefix + "enum"); enum != "" {
+		// Like the schema reflector, a JSON array or a comma separated list
+		var values []any
+
+		if json.Unmarshal([]byte(enum), &values) == nil {
+			for _, value := range values {
+				r.enum = append(r.enum, fmt.Sprint(value))
+			}
+		} else {
+			r.enum = strings.Split(enum, ",")
+		}
+	}
+
+	return r, nil
+}
+
+// Struct checks v, a struct or a pointer to one, against its tags and those of the structs and slices in it.
+// Only nil pointers, slices and maps count as absent, optional fields that may be left out should be pointers.
+// Other values are checked even when zero, and required ones must not be zero unless they are pointers or booleans.
+// It panics on tags that can't be parsed, see Prepare to catch them early
+func Struct(v any) []utils.FieldError {
+	errs := []utils.FieldError{}
+	value := reflect.ValueOf(v)
+
+	for value.Kind() == reflect.Pointer && !value.IsNil() {
+		value = value.Elem()
+	}
+
+	if value.Kind() != reflect.Struct {
+		return errs
+	}
+
+	return checkStruct(value, "", errs)
+}
+
+func checkStruct(value reflect.Value, path string, errs []utils.FieldError) []utils.FieldError {
+	p, err := planFor(value.Type())
+
+	if err != nil {
+		panic(err)
+	}
+
+	for _, f := range p.fields {
+		name := f.name
+
+		if path != "" {
+			name = path + "." + f.name
+		}
+
+		errs = checkValue(value.FieldByIndex(f.index), name, f.rules, f.items, f.param, errs)
+	}
+
+	return errs
+}
+
+func checkValue(value reflect.Value, name string, r rules, items rules, param bool, errs []utils.FieldError) []utils.FieldError {
+	fail := func(message string) []utils.FieldError {
+		return append(errs, utils.FieldError{Field: name, Message: message})
+	}
+
+	// Pointers are followed, a present pointer to a zero value is checked like any other value
+	pointed := false
+
+	for (value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface) && !value.IsNil() {
+		value = value.Elem()
+		pointed = true
+	}
+
+	switch {
+	case absent(value):
+		if r.required && !param {
+			return fail("is required")
+		}
+
+		return errs
+	case r.required && !param && !pointed && value.Kind() != reflect.Bool && value.IsZero():
+		// A required field without a pointer can't tell an absent value from a zero one
+		return fail("is required")
+	}
+
+	if len(r.enum) > 0 && value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		if !enumContains(r.enum, value) {
+			return fail("must be one of " + strings.Join(r.enum, ", "))
+		}
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		return checkString(value.String(), r, fail, errs)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return checkNumber(float64(value.Int()), r, fail, errs)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return checkNumber(float64(value.Uint()), r, fail, errs)
+	case reflect.Float32, reflect.Float64:
+		return checkNumber(value.Float(), r, fail, errs)
+	case reflect.Slice, reflect.Array:
+		return checkItems(value, name, r, items, fail, errs)
+	case reflect.Struct:
+		return checkStruct(value, name, errs)
+	}
+
+	return errs
+}
+
+// absent tells whether a value was left out. Other zero values may have been sent, e.g. 0 or "", and are checked
+func absent(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+		return value.IsNil()
+	case reflect.Invalid:
+		return true
+	}
+
+	return false
+}
+
+func enumContains(enum []string, value reflect.Value) bool {
+	s := fmt.Sprint(value.Interface())
+
+	for _, allowed := range enum {
+		if allowed == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkString(s string, r rules, fail func(string) []utils.FieldError, errs []utils.FieldError) []utils.FieldError {
+	length := utf8.RuneCountInString(s)
+
+	if r.minLength != nil && length < *r.minLength {
+		if *r.minLength == 1 {
+			return fail("must not be empty")
+		}
+
+		return fail(fmt.Sprintf("must be at least %d characters", *r.minLength))
+	}
+
+	if r.maxLength != nil && length > *r.maxLength {
+		return fail(fmt.Sprintf("must be at most %d characters", *r.maxLength))
+	}
+
+	if r.pattern != nil && !r.pattern.MatchString(s) {
+		return fail("must match " + r.pattern.String())
+	}
+
+	if check, ok := formats[r.format]; ok && !check(s) {
+		return fail("must be a valid " + r.format)
+	}
+
+	return errs
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+func checkNumber(n float64, r rules, fail func(string) []utils.FieldError, errs []utils.FieldError) []utils.FieldError {
+	switch {
+	case r.minimum != nil && n < *r.minimum:
+		return fail("must be at least " + formatNumber(*r.minimum))
+	case r.maximum != nil && n > *r.maximum:
+		return fail("must be at most " + formatNumber(*r.maximum))
+	case r.exclusiveMinimum != nil && n <= *r.exclusiveMinimum:
+		return fail("must be greater than " + formatNumber(*r.exclusiveMinimum))
+	case r.exclusiveMaximum != nil && n >= *r.exclusiveMaximum:
+		return fail("must be less than " + formatNumber(*r.exclusiveMaximum))
+	case r.multipleOf != nil && *r.multipleOf != 0 && math.Mod(n, *r.multipleOf) != 0:
+		return fail("must be a multiple of " + formatNumber(*r.multipleOf))
+	}
+
+	return errs
+}
+
+func checkItems(value reflect.Value, name string, r rules, items rules, fail func(string) []utils.FieldError, errs []utils.FieldError) []utils.FieldError {
+	// Bytes are a base64 string in JSON
+	if value.Type().Elem().Kind() == reflect.Uint8 {
+		return errs
+	}
+
+	if r.minItems != nil && value.Len() < *r.minItems {
+		return fail(fmt.Sprintf("must have at least %d items", *r.minItems))
+	}
+
+	if r.maxItems != nil && value.Len() > *r.maxItems {
+		return fail(fmt.Sprintf("must have at most %d items", *r.maxItems))
+	}
+
+	if r.uniqueItems {
+		seen := map[any]bool{}
+		// Items holding slices or maps can't be map keys
+		uncomparable := []any{}
+
+		for i := range value.Len() {
+			item := value.Index(i)
+
+			if item.Comparable() {
+				if seen[item.Interface()] {
+					return fail("must not contain duplicates")
+				}
+
+				seen[item.Interface()] = true
+				continue
+			}
+
+			if slices.ContainsFunc(uncomparable, func(other any) bool { return reflect.DeepEqual(other, item.Interface()) }) {
+				return fail("must not contain duplicates")
+			}
+
+			uncomparable = append(uncomparable, item.Interface())
+		}
+	}
+
+	for i := range value.Len() {
+		errs = checkValue(value.Index(i), name+"."+strconv.Itoa(i), items, rules{}, false, errs)
+	}
+
+	return errs
+}
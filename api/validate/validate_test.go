@@ -0,0 +1,136 @@
+package validate_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/maybemaby/oapibase/api/utils"
+	"github.com/maybemaby/oapibase/api/validate"
+)
+
+type address struct {
+	City string  `json:"city" required:"true"`
+	Zip  *string `json:"zip,omitempty" pattern:"^[0-9]{5}$"`
+}
+
+type signup struct {
+	Email    string    `json:"email" format:"email" required:"true"`
+	Password string    `json:"password" minLength:"8" required:"true"`
+	Id       *string   `json:"id,omitempty" format:"uuid"`
+	Role     *string   `json:"role,omitempty" enum:"user,admin"`
+	Age      *int      `json:"age,omitempty" minimum:"18" maximum:"130"`
+	Tags     []string  `json:"tags" maxItems:"2" uniqueItems:"true" items.minLength:"2"`
+	Address  address   `json:"address"`
+	Previous []address `json:"previous"`
+	OrgId    int       `path:"orgId" json:"-" minimum:"1"`
+}
+
+func fieldErrors(errs []utils.FieldError) map[string]string {
+	byField := map[string]string{}
+
+	for _, err := range errs {
+		byField[err.Field] = err.Message
+	}
+
+	return byField
+}
+
+func TestStructAggregatesFieldErrors(t *testing.T) {
+	role, id, age, zip, fullZip := "root", "123", 12, "1", "75001"
+
+	errs := fieldErrors(validate.Struct(&signup{
+		Email:    "not an email",
+		Password: "short",
+		Id:       &id,
+		Role:     &role,
+		Age:      &age,
+		Tags:     []string{"a", "b", "b"},
+		Address:  address{Zip: &zip},
+		Previous: []address{{City: "Paris"}, {Zip: &fullZip}},
+		OrgId:    3,
+	}))
+
+	want := map[string]string{
+		"email":           "must be a valid email",
+		"password":        "must be at least 8 characters",
+		"id":              "must be a valid uuid",
+		"role":            "must be one of user, admin",
+		"age":             "must be at least 18",
+		"tags":            "must have at most 2 items",
+		"address.city":    "is required",
+		"address.zip":     "must match ^[0-9]{5}$",
+		"previous.1.city": "is required",
+	}
+
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("Expected %v, got %v", want, errs)
+	}
+}
+
+func TestStructAcceptsValidValues(t *testing.T) {
+	admin, zip := "admin", "75001"
+
+	errs := validate.Struct(signup{
+		Email:    "user@example.com",
+		Password: "long enough",
+		Role:     &admin,
+		Tags:     []string{"go", "db"},
+		Address:  address{City: "Paris", Zip: &zip},
+		OrgId:    3,
+	})
+
+	if len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+
+	errs = validate.Struct(signup{Email: "user@example.com", Password: "long enough", Address: address{City: "Paris"}, Tags: []string{"x"}, OrgId: 3})
+
+	if got := fieldErrors(errs); len(got) != 1 || got["tags.0"] != "must be at least 2 characters" {
+		t.Errorf("Expected the item rule to apply, got %v", errs)
+	}
+}
+
+func TestStructChecksZeroValues(t *testing.T) {
+	empty := ""
+
+	errs := fieldErrors(validate.Struct(struct {
+		Count int     `json:"count" minimum:"1"`
+		Name  *string `json:"name,omitempty" minLength:"1"`
+		Note  *string `json:"note,omitempty" minLength:"1"`
+	}{Name: &empty}))
+
+	want := map[string]string{
+		"count": "must be at least 1",
+		"name":  "must not be empty",
+	}
+
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("Expected zero values to be checked and nil pointers skipped, got %v", errs)
+	}
+}
+
+func TestStructUniqueItemsOfAnyValue(t *testing.T) {
+	errs := validate.Struct(struct {
+		Items []any `json:"items" uniqueItems:"true"`
+	}{Items: []any{[]any{"a"}, map[string]any{"b": 1.0}, []any{"a"}}})
+
+	if got := fieldErrors(errs); got["items"] != "must not contain duplicates" {
+		t.Errorf("Expected duplicate arrays to be found, got %v", errs)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	if checks, err := validate.Prepare(reflect.TypeFor[signup]()); err != nil || !checks {
+		t.Errorf("Expected rules to be found, got %v %v", checks, err)
+	}
+
+	if checks, _ := validate.Prepare(reflect.TypeFor[struct{ Name string }]()); checks {
+		t.Errorf("Expected a struct without tags to have nothing to check")
+	}
+
+	if _, err := validate.Prepare(reflect.TypeFor[struct {
+		Name string `json:"name" pattern:"("`
+	}]()); err == nil {
+		t.Errorf("Expected an invalid pattern to be reported")
+	}
+}
@@ -2,9 +2,7 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -43,7 +41,28 @@ func loadEnv() {
 	time.Local = location
 }
 
+// durationEnv overrides target with the duration in the name env var, when it is set
+func durationEnv(name string, target *time.Duration) {
+	value := os.Getenv(name)
+
+	if value == "" {
+		return
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+
+	*target = duration
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "spec" {
+		os.Exit(runSpec(os.Args[2:]))
+	}
+
 	args := argParse()
 
 	// OS Signals
@@ -52,25 +71,6 @@ func main() {
 
 	loadEnv()
 
-	// Otel
-	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
-		otelShutdown, err := api.SetupOtel(ctx, api.OtelConfig{
-			TraceExporter:   api.OtlpGrpcExporter,
-			MetricsExporter: api.OtlpGrpcExporter,
-			TraceEnabled:    true,
-			MetricsEnabled:  true,
-			LoggerEnabled:   false,
-		})
-
-		if err != nil {
-			log.Fatalf("Error setting up otel: %v", err)
-		}
-
-		defer func() {
-			err = errors.Join(err, otelShutdown(context.Background()))
-		}()
-	}
-
 	// Server
 	appEnv := os.Getenv("APP_ENV")
 
@@ -80,20 +80,63 @@ func main() {
 
 	if err != nil {
 		log.Fatalf("Error creating server: %v", err)
-		os.Exit(1)
 	}
 
 	server.WithPort(args.Port)
 
-	go func() {
-		err := server.Start(ctx)
+	serverCfg := api.DefaultServerConfig(!isDebug)
+	durationEnv("HTTP_READ_HEADER_TIMEOUT", &serverCfg.ReadHeaderTimeout)
+	durationEnv("HTTP_READ_TIMEOUT", &serverCfg.ReadTimeout)
+	durationEnv("HTTP_WRITE_TIMEOUT", &serverCfg.WriteTimeout)
+	durationEnv("HTTP_IDLE_TIMEOUT", &serverCfg.IdleTimeout)
+	serverCfg.H2C = os.Getenv("HTTP_H2C") == "true"
+
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		serverCfg.TLS = &api.TLSConfig{
+			CertFile:     certFile,
+			KeyFile:      os.Getenv("TLS_KEY_FILE"),
+			ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+		}
+	}
+
+	server.WithServerConfig(serverCfg)
+
+	trustedProxies, err := api.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	server.WithTrustedProxies(trustedProxies)
+
+	shutdownTimeout := api.DefaultShutdownTimeout
+	durationEnv("SHUTDOWN_TIMEOUT", &shutdownTimeout)
+	server.WithShutdownTimeout(shutdownTimeout)
+
+	var shutdownDelay time.Duration
+	durationEnv("SHUTDOWN_DELAY", &shutdownDelay)
+	server.WithShutdownDelay(shutdownDelay)
+
+	// Otel
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		otelShutdown, err := api.SetupOtel(ctx, api.OtelConfig{
+			TraceExporter:   api.OtlpGrpcExporter,
+			MetricsExporter: api.OtlpGrpcExporter,
+			TraceEnabled:    true,
+			MetricsEnabled:  true,
+			LoggerEnabled:   false,
+		})
 
 		if err != nil {
-			log.Println(fmt.Printf("Error starting server: %v", err))
+			log.Fatalf("Error setting up otel: %v", err)
 		}
-	}()
 
-	<-ctx.Done()
-	stop()
+		// Flushed once requests are drained so their spans make it out
+		server.OnShutdown(otelShutdown)
+	}
 
+	// Blocks until a signal arrives and the server has shut down
+	if err := server.Start(ctx); err != nil {
+		log.Fatalf("Server stopped with error: %v", err)
+	}
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/maybemaby/oapibase/api"
+	"github.com/maybemaby/oapibase/api/specdiff"
+)
+
+// runSpec writes the OpenAPI document without starting the server, or with -check fails when the
+// committed file differs from it. It returns the exit code
+func runSpec(arguments []string) int {
+	if len(arguments) > 0 && arguments[0] == "diff" {
+		return runSpecDiff(arguments[1:])
+	}
+
+	flags := flag.NewFlagSet("spec", flag.ContinueOnError)
+	output := flags.String("o", "", "file to write the spec to, stdout when empty")
+	format := flags.String("format", "", "json or yaml, defaults from the extension of -o, else yaml")
+	check := flags.Bool("check", false, "fail when the file given by -o differs from the generated spec instead of writing it")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: server spec [-o file] [-format json|yaml] [-check]")
+		fmt.Fprintln(flags.Output(), "       server spec diff [-format text|json] base [revision]")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+
+	if *format == "" {
+		*format = "yaml"
+
+		if filepath.Ext(*output) == ".json" {
+			*format = "json"
+		}
+	}
+
+	spec, err := api.GenerateSpec(*format)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating spec: %v\n", err)
+		return 1
+	}
+
+	if *check {
+		if *output == "" {
+			fmt.Fprintln(os.Stderr, "-check needs the committed spec as -o")
+			return 2
+		}
+
+		committed, err := os.ReadFile(*output)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading spec: %v\n", err)
+			return 1
+		}
+
+		if !bytes.Equal(committed, spec) {
+			fmt.Fprintf(os.Stderr, "%s is out of date, run: go run ./cmd/server spec -o %s\n", *output, *output)
+			return 1
+		}
+
+		return 0
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(spec)
+	} else {
+		err = os.WriteFile(*output, spec, 0o644)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing spec: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// runSpecDiff compares two specs, the revision defaulting to the generated one, and fails when
+// the changes break clients of the base
+func runSpecDiff(arguments []string) int {
+	flags := flag.NewFlagSet("spec diff", flag.ContinueOnError)
+	format := flags.String("format", "text", "text or json")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: server spec diff [-format text|json] base [revision]")
+		fmt.Fprintln(flags.Output(), "Compares the base spec with the revision, or the generated spec when it is omitted.")
+		fmt.Fprintln(flags.Output(), "Exits with 1 when a change breaks clients of the base.")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+
+	if flags.NArg() < 1 || flags.NArg() > 2 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+
+	base, err := os.ReadFile(flags.Arg(0))
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading spec: %v\n", err)
+		return 1
+	}
+
+	var revision []byte
+
+	if flags.NArg() == 2 {
+		revision, err = os.ReadFile(flags.Arg(1))
+	} else {
+		revision, err = api.GenerateSpec("json")
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading spec: %v\n", err)
+		return 1
+	}
+
+	report, err := specdiff.Compare(base, revision)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error comparing specs: %v\n", err)
+		return 1
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+		return 1
+	}
+
+	if report.Breaking > 0 {
+		return 1
+	}
+
+	return 0
+}
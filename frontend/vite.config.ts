@@ -20,6 +20,10 @@ export default defineConfig({
       },
     }),
   ],
+  html: {
+    // Replaced per request with the server's CSP nonce, see SpaNoncePlaceholder in api/security.go
+    cspNonce: "__CSP_NONCE__",
+  },
   resolve: {
     alias: {
       "@": path.resolve(__dirname, "src"),
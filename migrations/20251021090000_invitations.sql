@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE invitations (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    email TEXT NOT NULL,
+    role TEXT,
+    organization_id INTEGER REFERENCES organizations (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    organization_role TEXT,
+    invited_by INTEGER REFERENCES users (id) ON DELETE SET NULL ON UPDATE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    accepted_at TIMESTAMPTZ,
+    accepted_by INTEGER REFERENCES users (id) ON DELETE SET NULL ON UPDATE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX invitations_email_idx ON invitations (lower(email));
+
+CREATE INDEX invitations_organization_id_idx ON invitations (organization_id);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE invitations;
+
+-- +goose StatementEnd
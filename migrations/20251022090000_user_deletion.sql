@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN delete_after TIMESTAMPTZ;
+
+CREATE INDEX users_delete_after_idx ON users (delete_after) WHERE delete_after IS NOT NULL;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX users_delete_after_idx;
+
+ALTER TABLE users DROP COLUMN delete_after;
+
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN name TEXT,
+    ADD COLUMN given_name TEXT,
+    ADD COLUMN family_name TEXT,
+    ADD COLUMN picture TEXT,
+    ADD COLUMN locale TEXT,
+    ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN pending_email TEXT;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+    DROP COLUMN name,
+    DROP COLUMN given_name,
+    DROP COLUMN family_name,
+    DROP COLUMN picture,
+    DROP COLUMN locale,
+    DROP COLUMN email_verified,
+    DROP COLUMN pending_email;
+
+-- +goose StatementEnd
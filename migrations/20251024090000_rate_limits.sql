@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Unlogged since losing rate limit state on a crash only resets quotas
+CREATE UNLOGGED TABLE rate_limits (
+    key TEXT PRIMARY KEY,
+    tat TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX rate_limits_tat_idx ON rate_limits (tat);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE rate_limits;
+
+-- +goose StatementEnd
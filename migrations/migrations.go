@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"embed"
+	"io/fs"
 
 	"github.com/pressly/goose/v3"
 )
@@ -23,3 +24,26 @@ func RunMigrations(ctx context.Context, db *sql.DB) error {
 
 	return goose.UpContext(ctx, db, ".")
 }
+
+// LatestVersion is the version of the newest embedded migration, the schema version this build expects
+func LatestVersion() (int64, error) {
+	names, err := fs.Glob(migrations, "*.sql")
+
+	if err != nil {
+		return 0, err
+	}
+
+	var latest int64
+
+	for _, name := range names {
+		version, err := goose.NumericComponent(name)
+
+		if err != nil {
+			return 0, err
+		}
+
+		latest = max(latest, version)
+	}
+
+	return latest, nil
+}